@@ -0,0 +1,128 @@
+package shared
+
+import (
+	"log"
+	"os"
+	"path"
+	"runtime"
+)
+
+/*
+WriteFileAtomic writes data to the file at path so that the file always either
+contains the complete old or the complete new data, even if the process crashes.
+The data is written to a temporary file in the same directory, synced to disk
+and renamed over the target. If backup is set, the previous file is kept with
+BACKUPENDING appended to its name.
+*/
+func WriteFileAtomic(path string, data []byte, perm os.FileMode, backup bool) error {
+	return writeFileAtomic(path, data, perm, backup, "")
+}
+
+/*
+writeFileStaged works like WriteFileAtomic without a backup, but writes the
+temporary file to the directory staging, which must be on the same file system.
+Used for synchronized directories, where stray files would spread to all peers.
+*/
+func writeFileStaged(path string, data []byte, perm os.FileMode, staging string) error {
+	return writeFileAtomic(path, data, perm, false, staging)
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode, backup bool, staging string) error {
+	id, err := NewIdentifier()
+	if err != nil {
+		return err
+	}
+	dir, name := splitFilePath(path)
+	if staging == "" {
+		staging = dir
+	}
+	temp := staging + "/." + name + ".tmp-" + id
+	file, err := FS.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		FS.Remove(temp)
+		return err
+	}
+	if backup {
+		// if we crash before the next rename, loaders fall back to the backup
+		err = FS.Rename(path, path+BACKUPENDING)
+		if err != nil && !os.IsNotExist(err) {
+			FS.Remove(temp)
+			return err
+		}
+	}
+	err = FS.Rename(temp, path)
+	if err != nil {
+		FS.Remove(temp)
+		return err
+	}
+	return syncDirectory(dir)
+}
+
+/*
+loadWithBackup reads the file at path and passes it to parse. If either fails,
+the backup written by WriteFileAtomic is tried instead. The error of the
+original file is returned if the backup fails too.
+*/
+func loadWithBackup(path string, parse func(data []byte) error) error {
+	data, err := readFile(FS, path)
+	if err == nil {
+		err = parse(data)
+	}
+	if err == nil {
+		return nil
+	}
+	data, backupErr := readFile(FS, path+BACKUPENDING)
+	if backupErr == nil {
+		backupErr = parse(data)
+	}
+	if backupErr != nil {
+		return err
+	}
+	log.Println("Loaded backup of", path, "because of:", err)
+	return nil
+}
+
+/*
+syncDirectory makes a rename within the directory durable. Directories can not
+be synced on Windows, where renames are durable anyway.
+*/
+func syncDirectory(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	file, err := FS.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+/*
+splitFilePath returns the directory and name of the file at the given path.
+*/
+func splitFilePath(filePath string) (dir, name string) {
+	dir, name = path.Split(filePath)
+	if dir == "" {
+		return ".", name
+	}
+	if dir != "/" {
+		dir = dir[:len(dir)-1]
+	}
+	return dir, name
+}
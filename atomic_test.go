@@ -0,0 +1,120 @@
+package shared
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_WriteFileAtomic(t *testing.T) {
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	path := root + "/file.json"
+	for _, content := range []string{"one", "two", "three"} {
+		err := WriteFileAtomic(path, []byte(content), 0600, true)
+		if err != nil {
+			t.Fatal("Expected no error, got", err)
+		}
+	}
+	data, _ := os.ReadFile(path)
+	backup, _ := os.ReadFile(path + BACKUPENDING)
+	if string(data) != "three" || string(backup) != "two" {
+		t.Error("Expected three with backup two, got", string(data), string(backup))
+	}
+	stats, _ := os.ReadDir(root)
+	if len(stats) != 2 {
+		t.Error("Expected no temporary files, got", stats)
+	}
+}
+
+func Test_WriteFileAtomicFaults(t *testing.T) {
+	defer func(old FileSystem) { FS = old }(FS)
+	setup := func(failAt int) *FaultyFileSystem {
+		mem := CreateMemFileSystem()
+		mem.MkdirAll("/dir", 0700)
+		writeFile(mem, "/dir/file", []byte("old"), 0600)
+		return CreateFaultyFileSystem(mem, failAt)
+	}
+	counter := setup(0)
+	FS = counter
+	err := WriteFileAtomic("/dir/file", []byte("new"), 0600, true)
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	for failAt := 1; failAt <= counter.Operations(); failAt++ {
+		FS = setup(failAt)
+		err := WriteFileAtomic("/dir/file", []byte("new"), 0600, true)
+		if err != ErrInjectedFault {
+			t.Error("Expected failure of operation", failAt, "to be returned, got", err)
+		}
+		// a crash at this point must still load either version completely
+		FS.(*FaultyFileSystem).FailAt = 0
+		var content string
+		err = loadWithBackup("/dir/file", func(data []byte) error {
+			content = string(data)
+			return nil
+		})
+		if err != nil || (content != "old" && content != "new") {
+			t.Error("Expected old or new content after failure", failAt, "got", content, err)
+		}
+		stats, _ := FS.ReadDir("/dir")
+		for _, stat := range stats {
+			if strings.Contains(stat.Name(), ".tmp-") {
+				t.Error("Expected temporary file to be removed after failure", failAt)
+			}
+		}
+	}
+}
+
+func Test_LoadToxDumpFromBackup(t *testing.T) {
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	peer, _ := CreatePeer("name", "address", false)
+	for _, data := range []string{"first", "second"} {
+		dump := &ToxPeerDump{SelfPeer: peer, ToxData: []byte(data)}
+		err := dump.StoreTo(root)
+		if err != nil {
+			t.Fatal("Expected no error, got", err)
+		}
+	}
+	// simulate a truncated write
+	err := os.WriteFile(root+"/"+SELFPEERJSON, []byte(`{"SelfPeer":`), 0600)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	dump, err := LoadToxDumpFrom(root)
+	if err != nil || string(dump.ToxData) != "first" {
+		t.Error("Expected backup to be loaded, got", dump, err)
+	}
+	os.Remove(root + "/" + SELFPEERJSON + BACKUPENDING)
+	_, err = LoadToxDumpFrom(root)
+	if err == nil {
+		t.Error("Expected error without valid backup")
+	}
+}
+
+func Test_LoadPeersBackup(t *testing.T) {
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	err := MakeTinzeniteDir(root)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	dir := root + "/" + STOREPEERDIR
+	peer, _ := CreatePeer("name", "address", false)
+	peer.StoreTo(dir)
+	// older versions could leave only the backup after a crash
+	os.Rename(dir+"/"+peer.Identification+ENDING, dir+"/"+peer.Identification+ENDING+BACKUPENDING)
+	os.WriteFile(dir+"/notes.txt", []byte("not a peer"), 0600)
+	peers, err := LoadPeers(root)
+	if err != nil || len(peers) != 1 || peers["address"] == nil {
+		t.Error("Expected peer from backup, got", peers, err)
+	}
+	// the synchronized directory must not keep backups or temporary files
+	peer.StoreTo(dir)
+	peer.StoreTo(dir)
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Error("Expected only the peer and notes, got", entries)
+	}
+}
@@ -0,0 +1,252 @@
+package shared
+
+import (
+	"context"
+	"os"
+)
+
+/*
+BuildProgress is called by the Builder for every object added to the tree with
+the amount of objects added so far.
+*/
+type BuildProgress func(count int, subpath string)
+
+/*
+Builder builds the complete ObjectInfo tree of a Tinzenite directory.
+*/
+type Builder struct {
+	root     string
+	selfid   string
+	Previous *ObjectInfo   // optional tree of a previous build to keep identifications stable
+	Progress BuildProgress // optional
+	Chunking bool          // if true the ChunkList of every file is computed too
+	Workers  int           // if above one, files are hashed concurrently once walked
+	IOLimit  int           // concurrent reads when hashing concurrently, see HashPool
+	// FileSystem of the directory, FS if nil
+	FileSystem FileSystem
+	previous   map[string]*ObjectInfo
+	pending    []*ObjectInfo // files waiting to be hashed by the pool
+	count      int
+}
+
+/*
+CreateBuilder returns a Builder for the directory at root. The selfid is used to
+increase the version of objects that changed since the Previous tree.
+*/
+func CreateBuilder(root, selfid string) *Builder {
+	return &Builder{root: root, selfid: selfid}
+}
+
+/*
+Build walks the directory and returns the tree of all objects that are not
+ignored by a .tinignore file. Objects of the .tinzenite directory are ignored as
+listed in TINDIRIGNORE even if its .tinignore file is missing. If a Previous
+tree is set, objects at the same path keep their identification and version; the
+version is increased if the object changed. The build can be stopped by
+canceling the context.
+*/
+func (b *Builder) Build(ctx context.Context) (*ObjectInfo, error) {
+	b.previous = make(map[string]*ObjectInfo)
+	b.pending = nil
+	b.count = 0
+	if b.Previous != nil {
+		walk(b.Previous, func(obj *ObjectInfo) {
+			b.previous[obj.Path] = obj
+		})
+	}
+	path := CreatePathRoot(b.root)
+	stat, err := b.fs().Stat(path.FullPath())
+	if err != nil {
+		return nil, err
+	}
+	if !stat.IsDir() {
+		return nil, ErrNotDirectory
+	}
+	root := &ObjectInfo{Name: path.LastElement()}
+	err = b.create(root, stat)
+	if err != nil {
+		return nil, err
+	}
+	err = b.buildDirectory(ctx, root, CreateIgnoreMatcher())
+	if err != nil {
+		return nil, err
+	}
+	err = b.hashPending(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+/*
+fs returns the FileSystem of the directory.
+*/
+func (b *Builder) fs() FileSystem {
+	if b.FileSystem == nil {
+		return FS
+	}
+	return b.FileSystem
+}
+
+/*
+buildDirectory adds all sub objects of the given directory that are not ignored
+by the matcher of the parents or the .tinignore of the directory itself.
+*/
+func (b *Builder) buildDirectory(ctx context.Context, dir *ObjectInfo, matcher *IgnoreMatcher) error {
+	own, err := loadTinignoreDefault(b.fs(), b.root, dir.Path)
+	if err == nil {
+		matcher = matcher.With(own)
+	} else if err != ErrNoTinIgnore {
+		return err
+	}
+	stats, err := b.fs().ReadDir(CreatePath(b.root, dir.Path).FullPath())
+	if err != nil {
+		return err
+	}
+	for _, stat := range stats {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		subpath := joinPath(dir.Path, stat.Name())
+		// ignored directories are never entered, so parents need not be checked
+		if matcher.matches(subpath, stat.IsDir()) {
+			continue
+		}
+		obj := &ObjectInfo{Name: stat.Name(), Path: subpath}
+		err := b.create(obj, stat)
+		if err != nil {
+			return err
+		}
+		// ReadDir is sorted by name, so the children are too
+		dir.Objects = append(dir.Objects, obj)
+		if obj.Directory {
+			err = b.buildDirectory(ctx, obj, matcher)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+create fills in all values of the object, hashing files and taking the identity
+from the previous tree if possible.
+*/
+func (b *Builder) create(obj *ObjectInfo, stat os.FileInfo) error {
+	path := CreatePath(b.root, obj.Path).FullPath()
+	err := obj.setMetadata(b.fs(), path, stat)
+	if err != nil {
+		return err
+	}
+	if obj.Kind == OkFile && b.Workers > 1 {
+		// hashed and identified by hashPending
+		b.pending = append(b.pending, obj)
+		return nil
+	}
+	if obj.Kind == OkFile && b.Chunking {
+		obj.Content, obj.Chunks, err = chunkFile(b.fs(), path)
+	} else if obj.Kind == OkFile {
+		obj.Content, err = cachedContentHash(b.fs(), b.root, path)
+	}
+	if err != nil {
+		return err
+	}
+	return b.finish(obj)
+}
+
+/*
+hashPending hashes all files collected while walking with a HashPool. Every file
+is finished as soon as it is hashed, so that the progress is reported while
+hashing. The first file that could not be hashed fails the build.
+*/
+func (b *Builder) hashPending(ctx context.Context) error {
+	if len(b.pending) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var failed error
+	pool := &HashPool{
+		Workers:    b.Workers,
+		IOLimit:    b.IOLimit,
+		Cache:      lookupHashCache(b.root),
+		Chunking:   b.Chunking,
+		FileSystem: b.FileSystem,
+		OnResult: func(index int, result HashResult) {
+			if failed != nil {
+				return
+			}
+			failed = result.Err
+			if failed == nil {
+				obj := b.pending[index]
+				obj.Content = result.Content
+				obj.Chunks = result.Chunks
+				failed = b.finish(obj)
+			}
+			if failed != nil {
+				// stops the remaining files
+				cancel()
+			}
+		}}
+	paths := make([]string, len(b.pending))
+	for i, obj := range b.pending {
+		paths[i] = CreatePath(b.root, obj.Path).FullPath()
+	}
+	_, err := pool.HashPaths(ctx, paths)
+	if failed != nil {
+		return failed
+	}
+	return err
+}
+
+/*
+finish identifies the hashed object and reports the progress.
+*/
+func (b *Builder) finish(obj *ObjectInfo) error {
+	err := b.identify(obj)
+	if err != nil {
+		return err
+	}
+	b.count++
+	if b.Progress != nil {
+		b.Progress(b.count, obj.Path)
+	}
+	return nil
+}
+
+/*
+identify sets the identification and version of the object.
+*/
+func (b *Builder) identify(obj *ObjectInfo) error {
+	prev, exists := b.previous[obj.Path]
+	if exists && prev.Directory == obj.Directory {
+		obj.Identification = prev.Identification
+		obj.Shadow = prev.Shadow
+		obj.Version = prev.Version.Copy()
+		if obj.Version == nil {
+			obj.Version = CreateVersion()
+		}
+		changed := !obj.sameState(prev)
+		if !changed && obj.Kind == OkFile && !sameHashAlgorithm(obj.Content, prev.Content) {
+			// hashes of other algorithms, including legacy ones, can only be
+			// compared by hashing the file again
+			matches, err := hashMatches(b.fs(), CreatePath(b.root, obj.Path).FullPath(), prev.Content)
+			if err != nil {
+				return err
+			}
+			changed = !matches
+		}
+		if changed {
+			obj.Version.Increase(b.selfid)
+		}
+		return nil
+	}
+	id, err := NewIdentifier()
+	if err != nil {
+		return err
+	}
+	obj.Identification = id
+	obj.Version = CreateVersion()
+	return nil
+}
@@ -0,0 +1,140 @@
+package shared
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func TestBuilder_Build(t *testing.T) {
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	err := MakeTinzeniteDir(root)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	writeTestFiles(t, root, map[string]string{
+		"a.txt":                        "a",
+		"sub/b.txt":                    "b",
+		"sub/skip.txt":                 "skip",
+		"sub/.tinignore":               "skip.txt\n",
+		".tinzenite/local/secret.json": "{}"})
+	builder := CreateBuilder(root, "self")
+	count := 0
+	builder.Progress = func(objects int, subpath string) {
+		count = objects
+	}
+	first, err := builder.Build(context.Background())
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	model, err := CreateModel(first)
+	if err != nil {
+		t.Fatal("Expected valid tree, got", err)
+	}
+	if count != model.Size() {
+		t.Error("Expected progress for", model.Size(), "objects, got", count)
+	}
+	for _, path := range []string{"a.txt", "sub/b.txt", "sub/.tinignore", ".tinzenite/org"} {
+		if _, err := model.Get(path); err != nil {
+			t.Error("Expected", path, "to be tracked")
+		}
+	}
+	for _, path := range []string{"sub/skip.txt", ".tinzenite/local", ".tinzenite/temp"} {
+		if _, err := model.Get(path); err == nil {
+			t.Error("Expected", path, "to be ignored")
+		}
+	}
+	// rebuild keeps identifications and only increases changed versions
+	writeTestFiles(t, root, map[string]string{"a.txt": "changed"})
+	builder.Previous = first
+	second, err := builder.Build(context.Background())
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	secondModel, _ := CreateModel(second)
+	for _, path := range []string{"", "a.txt", "sub/b.txt"} {
+		one, _ := model.Get(path)
+		two, _ := secondModel.Get(path)
+		if one.Identification != two.Identification {
+			t.Error("Expected stable identification for", path)
+		}
+	}
+	changed, _ := secondModel.Get("a.txt")
+	unchanged, _ := secondModel.Get("sub/b.txt")
+	if changed.Version["self"] != 1 || !unchanged.Version.IsEmpty() {
+		t.Error("Expected only changed version to increase, got", changed.Version, unchanged.Version)
+	}
+	// concurrent hashing must build the same tree
+	builder.Workers = 4
+	concurrent, err := builder.Build(context.Background())
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	concurrentModel, err := CreateModel(concurrent)
+	if err != nil || !equalTrees(secondModel, concurrentModel) || count != model.Size() {
+		t.Error("Expected concurrent build to equal sequential build")
+	}
+	// canceled builds must stop
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = builder.Build(ctx)
+	if err != context.Canceled {
+		t.Error("Expected canceled build, got", err)
+	}
+}
+
+func writeTestFiles(t *testing.T, root string, files map[string]string) {
+	for subpath, content := range files {
+		path := CreatePath(root, subpath)
+		err := os.MkdirAll(path.Up().FullPath(), 0755)
+		if err != nil {
+			t.Fatal("Failed test setup", err)
+		}
+		err = os.WriteFile(path.FullPath(), []byte(content), 0644)
+		if err != nil {
+			t.Fatal("Failed test setup", err)
+		}
+	}
+}
+
+func TestBuilder_FileSystem(t *testing.T) {
+	mem := CreateMemFileSystem()
+	files := map[string]string{
+		"a.txt":          "a",
+		"sub/b.txt":      "b",
+		"sub/skip.txt":   "skip",
+		"sub/.tinignore": "skip.txt\n"}
+	for subpath, content := range files {
+		path := CreatePath("/root", subpath)
+		mem.MkdirAll(path.Up().FullPath(), 0755)
+		err := writeFile(mem, path.FullPath(), []byte(content), 0644)
+		if err != nil {
+			t.Fatal("Failed test setup", err)
+		}
+	}
+	// the global FS is left alone so that tests may run in parallel
+	t.Parallel()
+	for _, workers := range []int{0, 4} {
+		builder := CreateBuilder("/root", "self")
+		builder.FileSystem = mem
+		builder.Workers = workers
+		builder.Chunking = true
+		tree, err := builder.Build(context.Background())
+		if err != nil {
+			t.Fatal("Expected no error, got", err)
+		}
+		model, _ := CreateModel(tree)
+		for _, path := range []string{"a.txt", "sub/b.txt", "sub/.tinignore"} {
+			if _, err := model.Get(path); err != nil {
+				t.Error("Expected", path, "to be tracked")
+			}
+		}
+		if _, err := model.Get("sub/skip.txt"); err == nil {
+			t.Error("Expected sub/skip.txt to be ignored")
+		}
+	}
+	if _, err := os.Lstat("/root/sub/skip.txt"); !os.IsNotExist(err) {
+		t.Error("Expected nothing on disk")
+	}
+}
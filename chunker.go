@@ -0,0 +1,249 @@
+package shared
+
+import (
+	"encoding/hex"
+	"io"
+)
+
+// Chunk size limits of the content defined chunker.
+const (
+	/*CHUNKMIN is the minimal size of a chunk, except for the last one.*/
+	CHUNKMIN = 16 * 1024
+	/*CHUNKAVG is the size chunks are normalized towards.*/
+	CHUNKAVG = 64 * 1024
+	/*CHUNKMAX is the maximal size of a chunk.*/
+	CHUNKMAX = 256 * 1024
+)
+
+// masks for normalized chunking: harder to cut before CHUNKAVG, easier after
+const (
+	chunkMaskSmall = uint64(1<<18-1) << (64 - 18)
+	chunkMaskLarge = uint64(1<<14-1) << (64 - 14)
+)
+
+/*
+gearTable holds the random values of the gear hash. It is generated from a fixed
+seed because all peers must cut at the same boundaries.
+*/
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	// splitmix64
+	state := uint64(0x54696e7a656e6974)
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		value := state
+		value = (value ^ (value >> 30)) * 0xbf58476d1ce4e5b9
+		value = (value ^ (value >> 27)) * 0x94d049bb133111eb
+		table[i] = value ^ (value >> 31)
+	}
+	return table
+}()
+
+/*
+Chunker splits a stream into content defined chunks using the FastCDC
+algorithm. Because the boundaries depend on the content, inserting or removing
+bytes only changes the chunks around the edit.
+*/
+type Chunker struct {
+	reader io.Reader
+	buf    []byte
+	start  int // start of unreturned data in buf
+	end    int // end of valid data in buf
+	eof    bool
+}
+
+/*
+CreateChunker returns a Chunker reading from the given reader.
+*/
+func CreateChunker(reader io.Reader) *Chunker {
+	return &Chunker{
+		reader: reader,
+		buf:    make([]byte, 2*CHUNKMAX)}
+}
+
+/*
+Next returns the next chunk. The returned slice is only valid until the next
+call. Returns io.EOF once all data has been returned.
+*/
+func (c *Chunker) Next() ([]byte, error) {
+	err := c.fill()
+	if err != nil {
+		return nil, err
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	cut := chunkBoundary(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+cut]
+	c.start += cut
+	return chunk, nil
+}
+
+/*
+fill makes sure that at least CHUNKMAX bytes are buffered unless the reader is
+exhausted.
+*/
+func (c *Chunker) fill() error {
+	if c.eof || c.end-c.start >= CHUNKMAX {
+		return nil
+	}
+	// move remaining data to the front
+	c.end = copy(c.buf, c.buf[c.start:c.end])
+	c.start = 0
+	for c.end < len(c.buf) {
+		amount, err := c.reader.Read(c.buf[c.end:])
+		c.end += amount
+		if err == io.EOF {
+			c.eof = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+chunkBoundary returns the length of the first chunk of data.
+*/
+func chunkBoundary(data []byte) int {
+	length := len(data)
+	if length <= CHUNKMIN {
+		return length
+	}
+	if length > CHUNKMAX {
+		length = CHUNKMAX
+	}
+	normal := CHUNKAVG
+	if length < normal {
+		normal = length
+	}
+	var hash uint64
+	i := CHUNKMIN
+	for ; i < normal; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&chunkMaskSmall == 0 {
+			return i + 1
+		}
+	}
+	for ; i < length; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&chunkMaskLarge == 0 {
+			return i + 1
+		}
+	}
+	return length
+}
+
+/*
+ChunkList is the compact list of chunks of a file. Offsets are not stored as they
+follow from the sizes. A ChunkList must not be modified once created.
+*/
+type ChunkList struct {
+	Algorithm string   // hash algorithm of all digests
+	Sizes     []int64  // size of each chunk
+	Digests   []string // hex digest of each chunk
+}
+
+/*
+Chunk is a single entry of a ChunkList.
+*/
+type Chunk struct {
+	Offset int64
+	Size   int64
+	Digest string
+}
+
+/*
+ChunkFile splits the file at path into chunks and returns the content hash of
+the complete file, as ContentHash would, together with the chunk list.
+*/
+func ChunkFile(path string) (string, *ChunkList, error) {
+	return chunkFile(FS, path)
+}
+
+func chunkFile(fsys FileSystem, path string) (string, *ChunkList, error) {
+	file, err := fsys.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+	return ChunkReader(file)
+}
+
+/*
+ChunkReader works like ChunkFile on the content of the given reader.
+*/
+func ChunkReader(reader io.Reader) (string, *ChunkList, error) {
+	algorithm := HashAlgorithm()
+	content, err := newHash(algorithm)
+	if err != nil {
+		return "", nil, err
+	}
+	list := &ChunkList{Algorithm: algorithm}
+	chunker := CreateChunker(reader)
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		content.Write(chunk)
+		hash, _ := newHash(algorithm)
+		hash.Write(chunk)
+		list.Sizes = append(list.Sizes, int64(len(chunk)))
+		list.Digests = append(list.Digests, hex.EncodeToString(hash.Sum(nil)))
+	}
+	return formatHash(algorithm, content), list, nil
+}
+
+/*
+Chunks returns all chunks including their offsets.
+*/
+func (c *ChunkList) Chunks() []Chunk {
+	chunks := make([]Chunk, len(c.Sizes))
+	var offset int64
+	for i, size := range c.Sizes {
+		chunks[i] = Chunk{Offset: offset, Size: size, Digest: c.Digests[i]}
+		offset += size
+	}
+	return chunks
+}
+
+/*
+Size returns the total size of all chunks.
+*/
+func (c *ChunkList) Size() int64 {
+	var size int64
+	for _, value := range c.Sizes {
+		size += value
+	}
+	return size
+}
+
+/*
+MissingChunks returns the chunks of want whose content is not contained in
+have, for example the chunks of a new version that a peer holding the old
+version has to receive. Chunks with equal content are only returned once. If
+have is nil or uses another algorithm, all chunks are missing.
+*/
+func MissingChunks(have, want *ChunkList) []Chunk {
+	known := make(map[string]bool)
+	if have != nil && have.Algorithm == want.Algorithm {
+		for _, digest := range have.Digests {
+			known[digest] = true
+		}
+	}
+	var missing []Chunk
+	for _, chunk := range want.Chunks() {
+		if known[chunk.Digest] {
+			continue
+		}
+		known[chunk.Digest] = true
+		missing = append(missing, chunk)
+	}
+	return missing
+}
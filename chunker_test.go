@@ -0,0 +1,72 @@
+package shared
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func Test_ChunkReader(t *testing.T) {
+	data := make([]byte, 4*1024*1024)
+	rand.New(rand.NewSource(42)).Read(data)
+	content, list, err := ChunkReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	if list.Size() != int64(len(data)) || len(list.Sizes) != len(list.Digests) {
+		t.Fatal("Expected chunks to cover all data, got", list.Size())
+	}
+	for i, size := range list.Sizes {
+		last := i == len(list.Sizes)-1
+		if size > CHUNKMAX || (size < CHUNKMIN && !last) {
+			t.Error("Expected chunk size within limits, got", size)
+		}
+	}
+	// content hash must be the same as ContentHash
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	err = os.WriteFile(root+"/file", data, 0644)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	hash, _ := ContentHash(root + "/file")
+	if content != hash {
+		t.Error("Expected", hash, "got", content)
+	}
+	// inserting a byte must only affect the chunks around it
+	edited := append(append(append([]byte{}, data[:len(data)/2]...), 'x'), data[len(data)/2:]...)
+	_, editedList, err := ChunkReader(bytes.NewReader(edited))
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	missing := MissingChunks(list, editedList)
+	if len(missing) == 0 || len(missing) > 2 {
+		t.Error("Expected one or two missing chunks, got", len(missing), "of", len(editedList.Sizes))
+	}
+	// only the edited region needs to be sent
+	var size int64
+	for _, chunk := range missing {
+		size += chunk.Size
+	}
+	if size > 2*CHUNKMAX {
+		t.Error("Expected at most", 2*CHUNKMAX, "missing bytes, got", size)
+	}
+	if len(MissingChunks(nil, list)) != len(list.Sizes) {
+		t.Error("Expected all chunks to be missing without a previous version")
+	}
+}
+
+func Test_ChunkReader_Small(t *testing.T) {
+	testSizes := []int{0, 1, CHUNKMIN, CHUNKMIN + 1}
+	for _, size := range testSizes {
+		_, list, err := ChunkReader(bytes.NewReader(make([]byte, size)))
+		if err != nil {
+			t.Error("Expected no error, got", err)
+			continue
+		}
+		if list.Size() != int64(size) {
+			t.Error("Expected", size, "got", list.Size())
+		}
+	}
+}
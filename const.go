@@ -18,6 +18,17 @@ var (
 	ErrNilInternalState  = errors.New("internal state has illegal NIL values")
 	ErrConflict          = errors.New("conflict, can not apply")
 	ErrIllegalFileState  = errors.New("illegal file state detected")
+	ErrObjectExists      = errors.New("object already exists in the model")
+	ErrNotDirectory      = errors.New("object is not a directory")
+	ErrInvalidModel      = errors.New("model is inconsistent")
+	ErrContentMismatch   = errors.New("content does not match expected hash")
+	ErrInjectedFault     = errors.New("injected file system fault")
+	ErrEncryptedDump     = errors.New("tox dump is encrypted, passphrase required")
+	ErrWrongPassphrase   = errors.New("wrong passphrase or corrupted data")
+	ErrNotRegistered     = errors.New("directory is not registered")
+	ErrLocked            = errors.New("directory is in use by another instance")
+	ErrRepairFailed      = errors.New("missing object could not be repaired")
+	ErrParentMissing     = errors.New("parent directory does not exist")
 )
 
 /*
@@ -25,6 +36,11 @@ Internal errors of Tinzenite.
 */
 var (
 	errWrongObject = errors.New("wrong ObjectInfo")
+	errIsDirectory = errors.New("is a directory")
+	errNotEmpty    = errors.New("directory not empty")
+	errLockHeld    = errors.New("lock is held by another process")
+	// returned to updateRegistry if nothing needs to be written
+	errRegistryUnchanged = errors.New("registry unchanged")
 )
 
 // constant value here
@@ -35,7 +51,8 @@ const (
 	IDMAXLENGTH = 16
 	/*KEYLENGTH is the length of the encryption key used for challenges and file encryption.*/
 	KEYLENGTH = 256
-	/*FILEPERMISSIONMODE used for all file operations.*/
+	/*FILEPERMISSIONMODE was used for all file operations. Kept for compatibility,
+	use Permissions instead.*/
 	FILEPERMISSIONMODE = 0777
 	/*FILEFLAGCREATEAPPEND is the flag required to create a file or append to it if it already exists.*/
 	FILEFLAGCREATEAPPEND = os.O_CREATE | os.O_RDWR | os.O_APPEND
@@ -46,23 +63,33 @@ const (
 // Path constants here
 const (
 	TINZENITEDIR   = ".tinzenite"
-	TINIGNORE      = ".tinignore" // correct valid name of .tinignore files
-	DIRECTORYLIST  = "directory.list"
-	LOCALDIR       = "local" // info to the local peer is stored here
+	TINIGNORE      = ".tinignore"     // correct valid name of .tinignore files
+	DIRECTORYLIST  = "directory.list" // replaced by REGISTRYJSON
+	REGISTRYJSON   = "directories" + ENDING
+	LOCKFILE       = "instance.lock" // stored in LOCALDIR
+	LOCALDIR       = "local"         // info to the local peer is stored here
 	TEMPDIR        = "temp"
 	RECEIVINGDIR   = "receiving" // dir for receiving transfers
-	SENDINGDIR     = "sending"   // send dir for now only used in encrypted
-	REMOVEDIR      = "removed"   // remove
-	REMOVECHECKDIR = "check"     // remove
-	REMOVEDONEDIR  = "done"      // remove
-	REMOVESTOREDIR = "rmstore"   // local remove check dir
+	SENDINGDIR     = "sending"   // outboxes of offline peers, see Outbox
+	REMOVEDIR      = "removed"   // tombstones of removed objects, see RemovalTracker
+	REMOVECHECKDIR = "check"     // peers that must acknowledge a removal
+	REMOVEDONEDIR  = "done"      // peers that have acknowledged a removal
+	REMOVESTOREDIR = "rmstore"   // completed removals, stored in LOCALDIR
 	ORGDIR         = "org"       // only directory that IS synchronized as normal
 	PEERSDIR       = "peers"
 	ENDING         = ".json"
+	BACKUPENDING   = ".bak" // appended to the previous version of stored files
 	AUTHJSON       = "auth" + ENDING
 	MODELJSON      = "model" + ENDING
 	SELFPEERJSON   = "self" + ENDING
 	BOOTJSON       = "boot" + ENDING
+	HASHCACHEJSON  = "hashcache" + ENDING
+	HISTORYDIR     = "history"            // archived revisions, stored in LOCALDIR
+	HISTORYJSON    = "revisions" + ENDING // index of the revisions of an object
+	OUTBOXLOG      = "outbox.log"         // stored per peer in SENDINGDIR
+	LAYOUTJSON     = "layout" + ENDING    // layout version, stored in LOCALDIR
+	MIGRATIONDIR   = "migration"          // backup of a running migration in TEMPDIR
+	MIGRATIONJSON  = "migration" + ENDING // entries before a running migration
 )
 
 /*
@@ -0,0 +1,346 @@
+package shared
+
+import (
+	"encoding/hex"
+	"io"
+	"os"
+)
+
+/*
+DELTALITERALMAX is the maximal amount of literal data in a single DeltaOp.
+*/
+const DELTALITERALMAX = 64 * 1024
+
+/*
+Signature describes the blocks of a file that the receiver of a modification
+already has. It is sent to the peer holding the new version so that only the
+differences need to be transferred.
+*/
+type Signature struct {
+	BlockSize int
+	Size      int64    // size of the described file
+	Algorithm string   // hash algorithm of the strong digests
+	Weak      []uint32 // rolling checksum of each block
+	Strong    []string // hex digest of each block
+}
+
+/*
+DeltaOp is a single instruction for building the new file: either Count blocks
+of the old file starting at Block are copied or, if Data is set, the literal
+data is written.
+*/
+type DeltaOp struct {
+	Block int    `json:",omitempty"`
+	Count int    `json:",omitempty"`
+	Data  []byte `json:",omitempty"`
+}
+
+/*
+Delta contains everything required to build the new version of a file from the
+old version described by a Signature.
+*/
+type Delta struct {
+	BlockSize int
+	Size      int64  // size of the new file
+	Content   string // content hash of the new file, verified if not empty
+	Ops       []DeltaOp
+}
+
+/*
+CreateSignature computes the signature of the file at path. If blockSize is not
+positive, CHUNKSIZE is used.
+*/
+func CreateSignature(path string, blockSize int) (*Signature, error) {
+	file, err := FS.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return SignatureReader(file, blockSize)
+}
+
+/*
+SignatureReader computes the signature of the content of the given reader.
+*/
+func SignatureReader(reader io.Reader, blockSize int) (*Signature, error) {
+	if blockSize <= 0 {
+		blockSize = CHUNKSIZE
+	}
+	sig := &Signature{BlockSize: blockSize, Algorithm: HashAlgorithm()}
+	buf := make([]byte, blockSize)
+	for {
+		amount, err := io.ReadFull(reader, buf)
+		if amount > 0 {
+			block := buf[:amount]
+			strong, err := blockDigest(sig.Algorithm, block)
+			if err != nil {
+				return nil, err
+			}
+			sig.Weak = append(sig.Weak, createRolling(block).sum())
+			sig.Strong = append(sig.Strong, strong)
+			sig.Size += int64(amount)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+/*
+CreateDelta computes the delta that turns the file described by sig into the
+file at path.
+*/
+func CreateDelta(sig *Signature, path string) (*Delta, error) {
+	file, err := FS.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return DeltaReader(sig, file)
+}
+
+/*
+DeltaReader computes the delta that turns the file described by sig into the
+content of the given reader. The content hash of the delta is set using the
+current hash algorithm.
+*/
+func DeltaReader(sig *Signature, reader io.Reader) (*Delta, error) {
+	content, err := newHash(HashAlgorithm())
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[uint32][]int)
+	for block, weak := range sig.Weak {
+		index[weak] = append(index[weak], block)
+	}
+	d := &deltaBuilder{sig: sig, index: index, delta: &Delta{BlockSize: sig.BlockSize}}
+	blockSize := sig.BlockSize
+	// data holds unsent literal bytes up to pos followed by the current window
+	var data []byte
+	pos := 0
+	eof := false
+	buf := make([]byte, CHUNKSIZE)
+	fill := func(size int) error {
+		for len(data) < size && !eof {
+			amount, err := reader.Read(buf)
+			data = append(data, buf[:amount]...)
+			content.Write(buf[:amount])
+			d.delta.Size += int64(amount)
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var weak *rolling
+	for {
+		err := fill(pos + blockSize + 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(data)-pos < blockSize {
+			// only the last block of the old file can be shorter than a block
+			last := int(sig.Size % int64(blockSize))
+			if start := len(data) - last; last > 0 && start >= pos {
+				if block, ok := d.find(createRolling(data[start:]).sum(), data[start:]); ok {
+					d.literal(data[:start])
+					d.copy(block)
+					data = data[:0]
+				}
+			}
+			d.literal(data)
+			break
+		}
+		if weak == nil {
+			weak = createRolling(data[pos : pos+blockSize])
+		}
+		if block, ok := d.find(weak.sum(), data[pos:pos+blockSize]); ok {
+			d.literal(data[:pos])
+			d.copy(block)
+			data = data[pos+blockSize:]
+			pos = 0
+			weak = nil
+			continue
+		}
+		if len(data) > pos+blockSize {
+			weak.roll(data[pos], data[pos+blockSize])
+		} else {
+			weak = nil
+		}
+		pos++
+		if pos >= DELTALITERALMAX {
+			d.literal(data[:pos])
+			data = data[pos:]
+			pos = 0
+		}
+	}
+	d.delta.Content = formatHash(HashAlgorithm(), content)
+	return d.delta, nil
+}
+
+/*
+PatchReader writes the new file built from the old file basis and the delta to
+writer.
+*/
+func PatchReader(basis io.ReaderAt, delta *Delta, writer io.Writer) error {
+	for _, op := range delta.Ops {
+		if op.Data != nil {
+			_, err := writer.Write(op.Data)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		offset := int64(op.Block) * int64(delta.BlockSize)
+		length := int64(op.Count) * int64(delta.BlockSize)
+		_, err := io.Copy(writer, io.NewSectionReader(basis, offset, length))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ApplyDelta replaces the file at subpath below the Tinzenite root with the
+version built from the delta. The new file is written to RECEIVINGDIR first and
+only moved over the old file once complete and, if the delta carries a content
+hash, verified. Returns ErrContentMismatch if verification fails.
+*/
+func ApplyDelta(root, subpath string, delta *Delta) error {
+	target := CreatePath(root, subpath).FullPath()
+	basis, err := FS.Open(target)
+	if err != nil {
+		return err
+	}
+	defer basis.Close()
+	stat, err := basis.Stat()
+	if err != nil {
+		return err
+	}
+	id, err := NewIdentifier()
+	if err != nil {
+		return err
+	}
+	// hidden so that the Receiver does not list it as a pending transfer
+	path := root + "/" + TINZENITEDIR + "/" + RECEIVINGDIR + "/.delta-" + id
+	temp, err := FS.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, Permissions.PrivateFile)
+	if err != nil {
+		return err
+	}
+	// only removes anything if the rename below did not happen
+	defer FS.Remove(path)
+	err = PatchReader(basis, delta, temp)
+	if err == nil {
+		err = temp.Sync()
+	}
+	closeErr := temp.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	if delta.Content != "" {
+		matches, err := HashMatches(path, delta.Content)
+		if err != nil {
+			return err
+		}
+		if !matches {
+			return ErrContentMismatch
+		}
+	}
+	err = FS.Chmod(path, stat.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	return FS.Rename(path, target)
+}
+
+/*
+deltaBuilder collects the ops of a Delta, merging consecutive copies.
+*/
+type deltaBuilder struct {
+	sig   *Signature
+	index map[uint32][]int
+	delta *Delta
+}
+
+/*
+find returns the block of the signature with the given checksum and content.
+*/
+func (d *deltaBuilder) find(weak uint32, data []byte) (int, bool) {
+	candidates, exists := d.index[weak]
+	if !exists {
+		return 0, false
+	}
+	strong, err := blockDigest(d.sig.Algorithm, data)
+	if err != nil {
+		return 0, false
+	}
+	for _, block := range candidates {
+		if d.sig.Strong[block] == strong {
+			return block, true
+		}
+	}
+	return 0, false
+}
+
+func (d *deltaBuilder) literal(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	d.delta.Ops = append(d.delta.Ops, DeltaOp{Data: append([]byte{}, data...)})
+}
+
+func (d *deltaBuilder) copy(block int) {
+	ops := d.delta.Ops
+	if len(ops) > 0 && ops[len(ops)-1].Data == nil && ops[len(ops)-1].Block+ops[len(ops)-1].Count == block {
+		ops[len(ops)-1].Count++
+		return
+	}
+	d.delta.Ops = append(ops, DeltaOp{Block: block, Count: 1})
+}
+
+func blockDigest(algorithm string, data []byte) (string, error) {
+	hash, err := newHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	hash.Write(data)
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+/*
+rolling is the rsync rolling checksum of a window of bytes.
+*/
+type rolling struct {
+	a, b   uint32
+	length uint32
+}
+
+func createRolling(data []byte) *rolling {
+	r := &rolling{length: uint32(len(data))}
+	for i, value := range data {
+		r.a += uint32(value)
+		r.b += uint32(len(data)-i) * uint32(value)
+	}
+	return r
+}
+
+/*
+roll moves the window one byte forward, removing out and adding in.
+*/
+func (r *rolling) roll(out, in byte) {
+	r.a = r.a - uint32(out) + uint32(in)
+	r.b = r.b - r.length*uint32(out) + r.a
+}
+
+func (r *rolling) sum() uint32 {
+	return (r.a & 0xffff) | (r.b << 16)
+}
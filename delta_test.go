@@ -0,0 +1,111 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+type testDelta struct {
+	name string
+	old  []byte
+	new  []byte
+}
+
+func Test_DeltaReader(t *testing.T) {
+	random := make([]byte, 200*1024+123)
+	rand.New(rand.NewSource(7)).Read(random)
+	edited := append(append(append([]byte{}, random[:5000]...), []byte("inserted")...), random[5000:]...)
+	testDeltas := []testDelta{
+		{"empty", nil, nil},
+		{"from empty", nil, random[:100]},
+		{"to empty", random[:100], nil},
+		{"same", random, random},
+		{"insert", random, edited},
+		{"remove", edited, random},
+		{"append", random[:CHUNKSIZE*3], random[:CHUNKSIZE*3+10]},
+		{"truncate", random, random[:len(random)-CHUNKSIZE-5]},
+		{"different", random[:50000], random[50000:]}}
+	for _, test := range testDeltas {
+		sig, err := SignatureReader(bytes.NewReader(test.old), 0)
+		if err != nil {
+			t.Error(test.name, ": expected no error, got", err)
+			continue
+		}
+		delta, err := DeltaReader(sig, bytes.NewReader(test.new))
+		if err != nil {
+			t.Error(test.name, ": expected no error, got", err)
+			continue
+		}
+		var result bytes.Buffer
+		err = PatchReader(bytes.NewReader(test.old), delta, &result)
+		if err != nil || !bytes.Equal(result.Bytes(), test.new) {
+			t.Error(test.name, ": expected patched data to match, got", err)
+		}
+		if delta.Size != int64(len(test.new)) {
+			t.Error(test.name, ": expected size", len(test.new), "got", delta.Size)
+		}
+	}
+	// an insertion must only send little literal data
+	sig, _ := SignatureReader(bytes.NewReader(random), 0)
+	delta, _ := DeltaReader(sig, bytes.NewReader(edited))
+	literal := 0
+	for _, op := range delta.Ops {
+		literal += len(op.Data)
+	}
+	if literal > 2*CHUNKSIZE {
+		t.Error("Expected little literal data, got", literal)
+	}
+}
+
+func Test_ApplyDelta(t *testing.T) {
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	err := MakeTinzeniteDir(root)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	old := bytes.Repeat([]byte("old content "), 5000)
+	updated := append(append([]byte{}, old...), []byte("new content")...)
+	writeTestFiles(t, root, map[string]string{"file": string(old), "new": string(updated)})
+	// receiver builds the signature, sender the delta
+	sig, err := CreateSignature(root+"/file", 0)
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	sigMsg := CreateSignatureMessage("id", *sig)
+	received := &SignatureMessage{}
+	err = json.Unmarshal([]byte(sigMsg.JSON()), received)
+	if err != nil {
+		t.Fatal("Expected signature to survive JSON, got", err)
+	}
+	delta, err := CreateDelta(&received.Signature, root+"/new")
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	// wrong hash must leave the file untouched
+	broken := *delta
+	broken.Content = HASHSHA256 + ":00"
+	err = ApplyDelta(root, "file", &broken)
+	if err != ErrContentMismatch {
+		t.Error("Expected ErrContentMismatch, got", err)
+	}
+	data, _ := os.ReadFile(root + "/file")
+	if !bytes.Equal(data, old) {
+		t.Error("Expected file to be untouched")
+	}
+	err = ApplyDelta(root, "file", delta)
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	data, _ = os.ReadFile(root + "/file")
+	if !bytes.Equal(data, updated) {
+		t.Error("Expected file to be updated")
+	}
+	empty, _ := IsDirectoryEmpty(root + "/" + TINZENITEDIR + "/" + RECEIVINGDIR)
+	if !empty {
+		t.Error("Expected receiving directory to be cleaned up")
+	}
+}
@@ -0,0 +1,266 @@
+package shared
+
+import (
+	"sort"
+	"strings"
+)
+
+/*
+Diff computes the updates required to get from the start tree to the target
+tree. Objects are matched by their identification, so renamed or relocated
+objects result in a move instead of a remove and create. An object that changed
+between file and directory is removed and created anew.
+
+The returned updates are ordered so that they can be applied one after another:
+sub objects are removed before their directories, directories are created
+before their contents and no object is created or moved onto a path that is
+still occupied. Modifications follow at the end, sorted by path.
+
+NOTE: Neither of the given trees is modified.
+*/
+func Diff(start, target *ObjectInfo) ([]*UpdateMessage, error) {
+	if start == nil || target == nil {
+		return nil, ErrIllegalParameters
+	}
+	// work on copies: the current model is modified to track applied updates
+	current, err := CreateModel(start.Copy())
+	if err != nil {
+		return nil, err
+	}
+	wanted, err := CreateModel(target.Copy())
+	if err != nil {
+		return nil, err
+	}
+	d := &differ{
+		current: current,
+		target:  wanted,
+		matched: make(map[string]bool),
+		placed:  make(map[string]bool)}
+	walk(current.Root, func(obj *ObjectInfo) {
+		that, err := wanted.GetByID(obj.Identification)
+		if obj.Path != "" && err == nil && that.Path != "" && that.Directory == obj.Directory {
+			d.matched[obj.Identification] = true
+		}
+	})
+	err = d.structure()
+	if err != nil {
+		return nil, err
+	}
+	d.modifications()
+	return d.messages, nil
+}
+
+/*
+differ holds the state while computing a Diff.
+*/
+type differ struct {
+	current  *Model          // start model with all emitted updates applied
+	target   *Model          // target model
+	matched  map[string]bool // ids that are kept, meaning at most moved and modified
+	placed   map[string]bool // ids that have been moved or created to their final path
+	messages []*UpdateMessage
+}
+
+/*
+structure emits all removes, moves and creates. Every pass emits all updates
+that can currently be applied. If no progress can be made, for example when two
+objects swap their paths, one move is replaced by a remove and a create.
+*/
+func (d *differ) structure() error {
+	for {
+		d.unmatchImpossible()
+		removes, moves, creates := d.pending()
+		if len(removes)+len(moves)+len(creates) == 0 {
+			return nil
+		}
+		progress := false
+		for _, obj := range removes {
+			if len(obj.Objects) > 0 {
+				continue
+			}
+			d.emit(OpRemove, obj)
+			d.current.Remove(obj.Path)
+			progress = true
+		}
+		for _, obj := range moves {
+			that, _ := d.target.GetByID(obj.Identification)
+			if !d.ready(that) || d.current.Move(obj.Path, that.Path) != nil {
+				continue
+			}
+			d.emit(OpMove, that)
+			d.placed[that.Identification] = true
+			progress = true
+		}
+		for _, that := range creates {
+			if _, err := d.current.GetByID(that.Identification); err == nil || !d.ready(that) {
+				continue
+			}
+			if d.current.Insert(that.shallowCopy()) != nil {
+				continue
+			}
+			d.emit(OpCreate, that)
+			d.placed[that.Identification] = true
+			progress = true
+		}
+		if !progress {
+			if len(moves) == 0 {
+				// can only happen if one of the trees is broken
+				return ErrConflict
+			}
+			delete(d.matched, moves[0].Identification)
+		}
+	}
+}
+
+/*
+modifications emits a modify for every kept object whose content changed.
+*/
+func (d *differ) modifications() {
+	var modified []*ObjectInfo
+	walk(d.target.Root, func(that *ObjectInfo) {
+		if !d.matched[that.Identification] {
+			return
+		}
+		obj, _ := d.current.GetByID(that.Identification)
+		if !obj.sameState(that) {
+			modified = append(modified, that)
+		}
+	})
+	sort.Sort(Sortable(modified))
+	for _, that := range modified {
+		d.emit(OpModify, that)
+	}
+}
+
+/*
+unmatchImpossible turns kept objects that can not be moved into a remove and a
+create. This is the case if an object needs to move onto its own path because
+its parent was replaced, and for all objects that would simply travel along with
+a parent that is removed.
+*/
+func (d *differ) unmatchImpossible() {
+	walk(d.current.Root, func(obj *ObjectInfo) {
+		if !d.matched[obj.Identification] || d.placed[obj.Identification] {
+			return
+		}
+		that, _ := d.target.GetByID(obj.Identification)
+		if d.needsMove(obj, that) {
+			if obj.Path == that.Path {
+				delete(d.matched, obj.Identification)
+			}
+			return
+		}
+		parent, _ := d.current.Get(parentPath(obj.Path))
+		if parent.Path != "" && !d.matched[parent.Identification] && !d.placed[parent.Identification] {
+			delete(d.matched, obj.Identification)
+		}
+	})
+}
+
+/*
+pending returns the objects that still need to be removed or moved from the
+current model and the objects that still need to be created from the target.
+*/
+func (d *differ) pending() (removes, moves, creates []*ObjectInfo) {
+	walk(d.current.Root, func(obj *ObjectInfo) {
+		if obj.Path == "" || d.placed[obj.Identification] {
+			return
+		}
+		if !d.matched[obj.Identification] {
+			removes = append(removes, obj)
+			return
+		}
+		that, _ := d.target.GetByID(obj.Identification)
+		if d.needsMove(obj, that) {
+			moves = append(moves, obj)
+		}
+	})
+	walk(d.target.Root, func(that *ObjectInfo) {
+		if that.Path != "" && !d.matched[that.Identification] && !d.placed[that.Identification] {
+			creates = append(creates, that)
+		}
+	})
+	// deepest first so that directories are empty when they are removed
+	sort.Slice(removes, func(i, j int) bool {
+		depthI := strings.Count(removes[i].Path, "/")
+		depthJ := strings.Count(removes[j].Path, "/")
+		if depthI != depthJ {
+			return depthI > depthJ
+		}
+		return removes[i].Path < removes[j].Path
+	})
+	// moves and creates by target path so that parents come first
+	sort.Slice(moves, func(i, j int) bool {
+		thatI, _ := d.target.GetByID(moves[i].Identification)
+		thatJ, _ := d.target.GetByID(moves[j].Identification)
+		return thatI.Path < thatJ.Path
+	})
+	sort.Sort(Sortable(creates))
+	return removes, moves, creates
+}
+
+/*
+needsMove returns whether the current object has a different parent or name than
+the target object.
+*/
+func (d *differ) needsMove(obj, that *ObjectInfo) bool {
+	return obj.Name != that.Name ||
+		parentID(d.current, obj.Path) != parentID(d.target, that.Path)
+}
+
+/*
+ready returns whether the target object can be placed at its path in the current
+model: the path must be free and the parent must already be the final one.
+*/
+func (d *differ) ready(that *ObjectInfo) bool {
+	if _, err := d.current.Get(that.Path); err == nil {
+		return false
+	}
+	parent, err := d.current.Get(parentPath(that.Path))
+	if err != nil || !parent.Directory {
+		return false
+	}
+	return parentID(d.current, that.Path) == parentID(d.target, that.Path)
+}
+
+func (d *differ) emit(op Operation, obj *ObjectInfo) {
+	msg := CreateUpdateMessage(op, *obj.shallowCopy())
+	d.messages = append(d.messages, &msg)
+}
+
+/*
+parentID returns the identification of the parent of path in the given model.
+The root is always returned as the empty string because the roots of different
+models need not share an identification.
+*/
+func parentID(m *Model, path string) string {
+	parent := parentPath(path)
+	if parent == "" {
+		return ""
+	}
+	obj, err := m.Get(parent)
+	if err != nil {
+		return ""
+	}
+	return obj.Identification
+}
+
+/*
+versionEqual compares two versions, treating nil and empty versions as equal.
+*/
+func versionEqual(one, two Version) bool {
+	if one.IsEmpty() && two.IsEmpty() {
+		return true
+	}
+	return one.Equal(two)
+}
+
+/*
+walk applies f to the object and all sub objects, parents before children.
+*/
+func walk(obj *ObjectInfo, f func(obj *ObjectInfo)) {
+	f(obj)
+	for _, child := range obj.Objects {
+		walk(child, f)
+	}
+}
@@ -0,0 +1,125 @@
+package shared
+
+import "testing"
+
+type testDiff struct {
+	name   string
+	change func(m *Model)
+	want   []Operation
+}
+
+func Test_Diff(t *testing.T) {
+	testDiffs := []testDiff{
+		{"no change", func(m *Model) {}, []Operation{}},
+		{"create", func(m *Model) {
+			dir := testObject("a/new", true)
+			dir.Objects = []*ObjectInfo{testObject("a/new/file", false)}
+			m.Insert(dir)
+		}, []Operation{OpCreate, OpCreate}},
+		{"remove", func(m *Model) {
+			m.Remove("a")
+		}, []Operation{OpRemove, OpRemove, OpRemove}},
+		{"modify", func(m *Model) {
+			obj, _ := m.Get("d.txt")
+			obj.Content = "changed"
+			obj.Version.Increase("peer")
+		}, []Operation{OpModify}},
+		{"move", func(m *Model) {
+			m.Move("a/b", "b")
+		}, []Operation{OpMove}},
+		{"move and modify", func(m *Model) {
+			m.Move("d.txt", "a/d.txt")
+			obj, _ := m.Get("a/d.txt")
+			obj.Version.Increase("peer")
+		}, []Operation{OpMove, OpModify}},
+		{"swap", func(m *Model) {
+			m.Move("d.txt", "tmp")
+			m.Move("a", "d.txt")
+			m.Move("tmp", "a")
+		}, nil}, // order of the fallback is not fixed
+		{"directory to file", func(m *Model) {
+			m.Remove("a")
+			m.Insert(testObject("a", false))
+		}, []Operation{OpRemove, OpRemove, OpRemove, OpCreate}},
+		{"file to directory", func(m *Model) {
+			m.Remove("d.txt")
+			dir := testObject("d.txt", true)
+			dir.Objects = []*ObjectInfo{testObject("d.txt/x", false)}
+			m.Insert(dir)
+		}, []Operation{OpRemove, OpCreate, OpCreate}},
+		{"replaced parent", func(m *Model) {
+			old, _ := m.Remove("a/b")
+			dir := testObject("a/b", true)
+			file := old.Objects[0]
+			dir.Objects = []*ObjectInfo{file}
+			m.Insert(dir)
+		}, []Operation{OpRemove, OpRemove, OpCreate, OpCreate}},
+		{"same identification changes type", func(m *Model) {
+			obj, _ := m.Remove("d.txt")
+			dir := testObject("d.txt", true)
+			dir.Identification = obj.Identification
+			m.Insert(dir)
+		}, []Operation{OpRemove, OpCreate}}}
+	for _, test := range testDiffs {
+		start := makeTestModel(t)
+		target, _ := CreateModel(start.Root.Copy())
+		test.change(target)
+		checkModel(t, target)
+		msgs, err := Diff(start.Root, target.Root)
+		if err != nil {
+			t.Error(test.name, ": expected no error, got", err)
+			continue
+		}
+		if test.want != nil {
+			var ops []Operation
+			for _, msg := range msgs {
+				ops = append(ops, msg.Operation)
+			}
+			if !equalOperations(ops, test.want) {
+				t.Error(test.name, ": expected", test.want, "got", ops)
+			}
+		}
+		// applying the updates to start must result in target
+		for _, msg := range msgs {
+			err := start.Apply(msg)
+			if err != nil {
+				t.Error(test.name, ": failed to apply", msg, err)
+				break
+			}
+		}
+		checkModel(t, start)
+		if !equalTrees(start, target) {
+			t.Error(test.name, ": applied updates do not result in target")
+		}
+	}
+}
+
+func equalOperations(one, two []Operation) bool {
+	if len(one) != len(two) {
+		return false
+	}
+	for i := range one {
+		if one[i] != two[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func equalTrees(one, two *Model) bool {
+	if one.Size() != two.Size() {
+		return false
+	}
+	equal := true
+	one.ForEach(func(obj ObjectInfo) {
+		if obj.Path == "" {
+			return
+		}
+		that, err := two.Get(obj.Path)
+		if err != nil || that.Identification != obj.Identification ||
+			that.Content != obj.Content || !versionEqual(that.Version, obj.Version) {
+			equal = false
+		}
+	})
+	return equal
+}
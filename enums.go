@@ -49,6 +49,10 @@ const (
 	MsgPush
 	/*MsgChallenge is a ChallengeMessage.*/
 	MsgChallenge
+	/*MsgSignature is a SignatureMessage.*/
+	MsgSignature
+	/*MsgDelta is a DeltaMessage.*/
+	MsgDelta
 )
 
 func (msg MsgType) String() string {
@@ -67,6 +71,10 @@ func (msg MsgType) String() string {
 		return "push"
 	case MsgChallenge:
 		return "challenge"
+	case MsgSignature:
+		return "signature"
+	case MsgDelta:
+		return "delta"
 	default:
 		return "unknown"
 	}
@@ -104,6 +112,10 @@ func (msg *MsgType) UnmarshalJSON(data []byte) error {
 		*msg = MsgPush
 	case "challenge":
 		*msg = MsgChallenge
+	case "signature":
+		*msg = MsgSignature
+	case "delta":
+		*msg = MsgDelta
 	default:
 		return errors.New("invalid MsgType: " + value)
 	}
@@ -124,6 +136,8 @@ const (
 	OpModify
 	/*OpRemove operation.*/
 	OpRemove
+	/*OpMove operation.*/
+	OpMove
 )
 
 func (op Operation) String() string {
@@ -134,6 +148,8 @@ func (op Operation) String() string {
 		return "modify"
 	case OpRemove:
 		return "remove"
+	case OpMove:
+		return "move"
 	default:
 		return "unknown"
 	}
@@ -163,6 +179,8 @@ func (op *Operation) UnmarshalJSON(data []byte) error {
 		*op = OpModify
 	case "remove":
 		*op = OpRemove
+	case "move":
+		*op = OpMove
 	case "unknown":
 		*op = OpUnknown
 	default:
@@ -409,3 +427,180 @@ func CmdParse(value string) Cmd {
 		return CmdNone
 	}
 }
+
+/*
+ObjectKind defines what kind of file system object an ObjectInfo is.
+*/
+type ObjectKind int
+
+const (
+	/*OkNone is the default for objects that do not state their kind.*/
+	OkNone ObjectKind = iota
+	/*OkFile is a regular file.*/
+	OkFile
+	/*OkDirectory is a directory.*/
+	OkDirectory
+	/*OkSymlink is a symbolic link.*/
+	OkSymlink
+)
+
+func (ok ObjectKind) String() string {
+	switch ok {
+	case OkNone:
+		return "none"
+	case OkFile:
+		return "file"
+	case OkDirectory:
+		return "directory"
+	case OkSymlink:
+		return "symlink"
+	default:
+		return "unknown"
+	}
+}
+
+/*
+MarshalJSON overrides json.Marshal for this type.
+*/
+func (ok *ObjectKind) MarshalJSON() ([]byte, error) {
+	return json.Marshal(ok.String())
+}
+
+/*
+UnmarshalJSON overrides json.Unmarshal for this type.
+*/
+func (ok *ObjectKind) UnmarshalJSON(data []byte) error {
+	value := string(data)
+	if len(value) <= 1 {
+		return errors.New("impossible ObjectKind: " + value)
+	}
+	// split ""
+	value = value[1 : len(value)-1]
+	switch value {
+	case "none":
+		*ok = OkNone
+	case "file":
+		*ok = OkFile
+	case "directory":
+		*ok = OkDirectory
+	case "symlink":
+		*ok = OkSymlink
+	default:
+		return errors.New("invalid ObjectKind: " + value)
+	}
+	return nil
+}
+
+/*
+DirKind defines what kind of Tinzenite directory a path is.
+*/
+type DirKind int
+
+const (
+	/*DkNone is a path that is no Tinzenite directory.*/
+	DkNone DirKind = iota
+	/*DkTinzenite is a directory containing TINZENITEDIR.*/
+	DkTinzenite
+	/*DkEncrypted is the root of an encrypted peer.*/
+	DkEncrypted
+)
+
+func (dk DirKind) String() string {
+	switch dk {
+	case DkNone:
+		return "none"
+	case DkTinzenite:
+		return "tinzenite"
+	case DkEncrypted:
+		return "encrypted"
+	default:
+		return "unknown"
+	}
+}
+
+/*
+MarshalJSON overrides json.Marshal for this type.
+*/
+func (dk *DirKind) MarshalJSON() ([]byte, error) {
+	return json.Marshal(dk.String())
+}
+
+/*
+UnmarshalJSON overrides json.Unmarshal for this type.
+*/
+func (dk *DirKind) UnmarshalJSON(data []byte) error {
+	value := string(data)
+	if len(value) <= 1 {
+		return errors.New("impossible DirKind: " + value)
+	}
+	// split ""
+	value = value[1 : len(value)-1]
+	switch value {
+	case "none":
+		*dk = DkNone
+	case "tinzenite":
+		*dk = DkTinzenite
+	case "encrypted":
+		*dk = DkEncrypted
+	default:
+		return errors.New("invalid DirKind: " + value)
+	}
+	return nil
+}
+
+/*
+Severity defines how serious a Finding of Validate is.
+*/
+type Severity int
+
+const (
+	/*SvInfo is purely informational.*/
+	SvInfo Severity = iota
+	/*SvWarning is a problem that does not stop Tinzenite from working.*/
+	SvWarning
+	/*SvError is a problem that stops Tinzenite from working correctly.*/
+	SvError
+)
+
+func (sv Severity) String() string {
+	switch sv {
+	case SvInfo:
+		return "info"
+	case SvWarning:
+		return "warning"
+	case SvError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+/*
+MarshalJSON overrides json.Marshal for this type.
+*/
+func (sv *Severity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(sv.String())
+}
+
+/*
+UnmarshalJSON overrides json.Unmarshal for this type.
+*/
+func (sv *Severity) UnmarshalJSON(data []byte) error {
+	value := string(data)
+	if len(value) <= 1 {
+		return errors.New("impossible Severity: " + value)
+	}
+	// split ""
+	value = value[1 : len(value)-1]
+	switch value {
+	case "info":
+		*sv = SvInfo
+	case "warning":
+		*sv = SvWarning
+	case "error":
+		*sv = SvError
+	default:
+		return errors.New("invalid Severity: " + value)
+	}
+	return nil
+}
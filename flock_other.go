@@ -0,0 +1,31 @@
+//go:build !unix
+
+package shared
+
+import "os"
+
+/*
+lockFile is not available on this platform.
+*/
+func lockFile(file File, block, shared bool) error {
+	return ErrUnsupported
+}
+
+/*
+unlockFile is not available on this platform.
+*/
+func unlockFile(file File) error {
+	return ErrUnsupported
+}
+
+/*
+processAlive returns whether a process with the given PID exists.
+*/
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
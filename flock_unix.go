@@ -0,0 +1,61 @@
+//go:build unix
+
+package shared
+
+import (
+	"os"
+	"syscall"
+)
+
+/*
+lockFile places an exclusive advisory lock on the file, or a shared one that
+only excludes exclusive locks if shared is set. If block is not set,
+errLockHeld is returned if another process holds the lock. Returns
+ErrUnsupported if the file system does not support locking, which includes all
+files not backed by the operating system.
+*/
+func lockFile(file File, block, shared bool) error {
+	osFile, ok := file.(*os.File)
+	if !ok {
+		return ErrUnsupported
+	}
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	if !block {
+		how |= syscall.LOCK_NB
+	}
+	for {
+		err := syscall.Flock(int(osFile.Fd()), how)
+		switch err {
+		case syscall.EINTR:
+			continue
+		case syscall.EWOULDBLOCK:
+			return errLockHeld
+		case syscall.ENOLCK, syscall.EOPNOTSUPP:
+			return ErrUnsupported
+		}
+		return err
+	}
+}
+
+/*
+unlockFile releases a lock placed by lockFile.
+*/
+func unlockFile(file File) error {
+	osFile, ok := file.(*os.File)
+	if !ok {
+		return ErrUnsupported
+	}
+	return syscall.Flock(int(osFile.Fd()), syscall.LOCK_UN)
+}
+
+/*
+processAlive returns whether a process with the given PID exists.
+*/
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	// EPERM means the process exists but belongs to another user
+	return err == nil || err == syscall.EPERM
+}
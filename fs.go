@@ -0,0 +1,917 @@
+package shared
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+FileSystem is the file system used by the helpers of this package. Paths are
+always separated by '/'.
+*/
+type FileSystem interface {
+	Open(name string) (File, error)
+	Create(name string) (File, error)
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	// ReadDir returns the entries of the directory sorted by name.
+	ReadDir(name string) ([]os.FileInfo, error)
+	Mkdir(name string, perm os.FileMode) error
+	MkdirAll(name string, perm os.FileMode) error
+	Rename(from, to string) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	Chmod(name string, mode os.FileMode) error
+	Chtimes(name string, atime, mtime time.Time) error
+	Readlink(name string) (string, error)
+}
+
+/*
+File is an open file of a FileSystem.
+*/
+type File interface {
+	io.Reader
+	io.Writer
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	// Sync commits the content of the file to stable storage.
+	Sync() error
+	// Truncate changes the size of the file without moving the offset.
+	Truncate(size int64) error
+}
+
+/*
+FS is the FileSystem used by all helpers. It can be replaced, for example with a
+MemFileSystem in tests. As it is global, tests replacing it can not run in
+parallel; the Builder, Model and HashPool therefore also take a FileSystem of
+their own.
+*/
+var FS FileSystem = OSFileSystem{}
+
+/*
+readFile reads the complete file at path from fsys.
+*/
+func readFile(fsys FileSystem, path string) ([]byte, error) {
+	file, err := fsys.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
+
+/*
+writeFile works like ioutil.WriteFile on fsys.
+*/
+func writeFile(fsys FileSystem, path string, data []byte, perm os.FileMode) error {
+	file, err := fsys.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+/*
+OSFileSystem is the FileSystem of the operating system.
+*/
+type OSFileSystem struct{}
+
+/*
+Open a file for reading.
+*/
+func (OSFileSystem) Open(name string) (File, error) {
+	return openOSFile(os.Open(name))
+}
+
+/*
+Create or truncate a file for writing.
+*/
+func (OSFileSystem) Create(name string) (File, error) {
+	return openOSFile(os.Create(name))
+}
+
+/*
+OpenFile with the flags of os.OpenFile.
+*/
+func (OSFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return openOSFile(os.OpenFile(name, flag, perm))
+}
+
+/*
+Stat returns the information of the file, following symbolic links.
+*/
+func (OSFileSystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+/*
+Lstat returns the information of the file without following symbolic links.
+*/
+func (OSFileSystem) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+/*
+ReadDir returns the entries of the directory sorted by name.
+*/
+func (OSFileSystem) ReadDir(name string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(name)
+}
+
+/*
+Mkdir creates a single directory.
+*/
+func (OSFileSystem) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(name, perm)
+}
+
+/*
+MkdirAll creates the directory and all missing parents.
+*/
+func (OSFileSystem) MkdirAll(name string, perm os.FileMode) error {
+	return os.MkdirAll(name, perm)
+}
+
+/*
+Rename moves a file or directory.
+*/
+func (OSFileSystem) Rename(from, to string) error {
+	return os.Rename(from, to)
+}
+
+/*
+Remove a file or empty directory.
+*/
+func (OSFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+/*
+RemoveAll removes the path and everything it contains.
+*/
+func (OSFileSystem) RemoveAll(name string) error {
+	return os.RemoveAll(name)
+}
+
+/*
+Chmod changes the permissions of the file.
+*/
+func (OSFileSystem) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+/*
+Chtimes changes the access and modification times of the file.
+*/
+func (OSFileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+/*
+Readlink returns the target of the symbolic link.
+*/
+func (OSFileSystem) Readlink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
+/*
+openOSFile avoids returning a non nil File interface holding a nil *os.File.
+*/
+func openOSFile(file *os.File, err error) (File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+/*
+MemFileSystem is a FileSystem that only lives in memory. It does not support
+symbolic links, so Lstat equals Stat. Safe for concurrent use.
+*/
+type MemFileSystem struct {
+	mutex sync.Mutex
+	nodes map[string]*memNode // keyed by the clean absolute path
+}
+
+/*
+memNode is a file or directory of a MemFileSystem.
+*/
+type memNode struct {
+	dir     bool
+	mode    os.FileMode
+	modTime time.Time
+	data    []byte
+}
+
+/*
+CreateMemFileSystem returns an empty MemFileSystem that only contains the root
+directory.
+*/
+func CreateMemFileSystem() *MemFileSystem {
+	return &MemFileSystem{nodes: map[string]*memNode{
+		"/": {dir: true, mode: os.ModeDir | 0755, modTime: time.Now()}}}
+}
+
+/*
+Open a file for reading.
+*/
+func (m *MemFileSystem) Open(name string) (File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+/*
+Create or truncate a file for writing.
+*/
+func (m *MemFileSystem) Create(name string) (File, error) {
+	return m.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+/*
+OpenFile with the flags of os.OpenFile.
+*/
+func (m *MemFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	key := memPath(name)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	node, exists := m.nodes[key]
+	switch {
+	case exists && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !exists && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !exists:
+		if err := m.checkParent("open", name, key); err != nil {
+			return nil, err
+		}
+		node = &memNode{mode: perm.Perm(), modTime: time.Now()}
+		m.nodes[key] = node
+	case node.dir && flag&(os.O_WRONLY|os.O_RDWR) != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: errIsDirectory}
+	}
+	if flag&os.O_TRUNC != 0 && !node.dir {
+		node.data = nil
+		node.modTime = time.Now()
+	}
+	access := flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
+	return &memFile{
+		fs:     m,
+		name:   name,
+		node:   node,
+		read:   access != os.O_WRONLY,
+		write:  access != os.O_RDONLY,
+		append: flag&os.O_APPEND != 0}, nil
+}
+
+/*
+Stat returns the information of the file.
+*/
+func (m *MemFileSystem) Stat(name string) (os.FileInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	node, exists := m.nodes[memPath(name)]
+	if !exists {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return node.info(path.Base(memPath(name))), nil
+}
+
+/*
+Lstat equals Stat as symbolic links are not supported.
+*/
+func (m *MemFileSystem) Lstat(name string) (os.FileInfo, error) {
+	return m.Stat(name)
+}
+
+/*
+ReadDir returns the entries of the directory sorted by name.
+*/
+func (m *MemFileSystem) ReadDir(name string) ([]os.FileInfo, error) {
+	key := memPath(name)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	node, exists := m.nodes[key]
+	if !exists {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+	if !node.dir {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: ErrNotDirectory}
+	}
+	var infos []os.FileInfo
+	for _, child := range m.children(key) {
+		infos = append(infos, m.nodes[child].info(path.Base(child)))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+	return infos, nil
+}
+
+/*
+Mkdir creates a single directory.
+*/
+func (m *MemFileSystem) Mkdir(name string, perm os.FileMode) error {
+	key := memPath(name)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, exists := m.nodes[key]; exists {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if err := m.checkParent("mkdir", name, key); err != nil {
+		return err
+	}
+	m.nodes[key] = &memNode{dir: true, mode: os.ModeDir | perm.Perm(), modTime: time.Now()}
+	return nil
+}
+
+/*
+MkdirAll creates the directory and all missing parents.
+*/
+func (m *MemFileSystem) MkdirAll(name string, perm os.FileMode) error {
+	key := memPath(name)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	current := "/"
+	for _, element := range strings.Split(key, "/") {
+		if element == "" {
+			continue
+		}
+		current = path.Join(current, element)
+		node, exists := m.nodes[current]
+		if !exists {
+			m.nodes[current] = &memNode{dir: true, mode: os.ModeDir | perm.Perm(), modTime: time.Now()}
+		} else if !node.dir {
+			return &os.PathError{Op: "mkdir", Path: name, Err: ErrNotDirectory}
+		}
+	}
+	return nil
+}
+
+/*
+Rename moves a file or directory including its contents. An existing file at
+the target is replaced, an existing directory is not.
+*/
+func (m *MemFileSystem) Rename(from, to string) error {
+	source := memPath(from)
+	target := memPath(to)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	node, exists := m.nodes[source]
+	if !exists {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: os.ErrNotExist}
+	}
+	if source == target {
+		return nil
+	}
+	if existing, exists := m.nodes[target]; exists && existing.dir {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: os.ErrExist}
+	}
+	if node.dir && strings.HasPrefix(target, source+"/") {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: ErrIllegalParameters}
+	}
+	if err := m.checkParent("rename", to, target); err != nil {
+		return err
+	}
+	for _, child := range m.descendants(source) {
+		m.nodes[target+strings.TrimPrefix(child, source)] = m.nodes[child]
+		delete(m.nodes, child)
+	}
+	delete(m.nodes, source)
+	m.nodes[target] = node
+	return nil
+}
+
+/*
+Remove a file or empty directory.
+*/
+func (m *MemFileSystem) Remove(name string) error {
+	key := memPath(name)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, exists := m.nodes[key]; !exists {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if len(m.children(key)) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: errNotEmpty}
+	}
+	delete(m.nodes, key)
+	return nil
+}
+
+/*
+RemoveAll removes the path and everything it contains. A missing path is not an
+error.
+*/
+func (m *MemFileSystem) RemoveAll(name string) error {
+	key := memPath(name)
+	if key == "/" {
+		return &os.PathError{Op: "removeall", Path: name, Err: ErrIllegalParameters}
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, child := range m.descendants(key) {
+		delete(m.nodes, child)
+	}
+	delete(m.nodes, key)
+	return nil
+}
+
+/*
+Chmod changes the permissions of the file.
+*/
+func (m *MemFileSystem) Chmod(name string, mode os.FileMode) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	node, exists := m.nodes[memPath(name)]
+	if !exists {
+		return &os.PathError{Op: "chmod", Path: name, Err: os.ErrNotExist}
+	}
+	node.mode = node.mode&os.ModeType | mode.Perm()
+	return nil
+}
+
+/*
+Chtimes changes the modification time of the file; access times are not kept.
+*/
+func (m *MemFileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	node, exists := m.nodes[memPath(name)]
+	if !exists {
+		return &os.PathError{Op: "chtimes", Path: name, Err: os.ErrNotExist}
+	}
+	node.modTime = mtime
+	return nil
+}
+
+/*
+Readlink always fails as symbolic links are not supported.
+*/
+func (m *MemFileSystem) Readlink(name string) (string, error) {
+	return "", &os.PathError{Op: "readlink", Path: name, Err: ErrUnsupported}
+}
+
+/*
+checkParent returns an error if the parent of key is not an existing directory.
+*/
+func (m *MemFileSystem) checkParent(op, name, key string) error {
+	parent, exists := m.nodes[path.Dir(key)]
+	if !exists {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	if !parent.dir {
+		return &os.PathError{Op: op, Path: name, Err: ErrNotDirectory}
+	}
+	return nil
+}
+
+/*
+children returns the keys of all nodes directly within key.
+*/
+func (m *MemFileSystem) children(key string) []string {
+	var children []string
+	for _, child := range m.descendants(key) {
+		if path.Dir(child) == key {
+			children = append(children, child)
+		}
+	}
+	return children
+}
+
+/*
+descendants returns the keys of all nodes below key.
+*/
+func (m *MemFileSystem) descendants(key string) []string {
+	prefix := strings.TrimSuffix(key, "/") + "/"
+	var descendants []string
+	for child := range m.nodes {
+		if child != "/" && strings.HasPrefix(child, prefix) {
+			descendants = append(descendants, child)
+		}
+	}
+	return descendants
+}
+
+func memPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+func (n *memNode) info(name string) os.FileInfo {
+	return &memFileInfo{name: name, size: int64(len(n.data)), mode: n.mode, modTime: n.modTime}
+}
+
+/*
+memFile is an open file of a MemFileSystem.
+*/
+type memFile struct {
+	fs     *MemFileSystem
+	name   string
+	node   *memNode
+	offset int
+	read   bool
+	write  bool
+	append bool
+	closed bool
+}
+
+func (f *memFile) Read(data []byte) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if f.closed || !f.read {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: os.ErrPermission}
+	}
+	if f.node.dir {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: errIsDirectory}
+	}
+	if f.offset >= len(f.node.data) {
+		return 0, io.EOF
+	}
+	amount := copy(data, f.node.data[f.offset:])
+	f.offset += amount
+	return amount, nil
+}
+
+func (f *memFile) Write(data []byte) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if f.closed || !f.write {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+	if f.append {
+		f.offset = len(f.node.data)
+	}
+	if end := f.offset + len(data); end > len(f.node.data) {
+		f.node.data = append(f.node.data, make([]byte, end-len(f.node.data))...)
+	}
+	copy(f.node.data[f.offset:], data)
+	f.offset += len(data)
+	f.node.modTime = time.Now()
+	return len(data), nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) ReadAt(data []byte, offset int64) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if f.closed || !f.read {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: os.ErrPermission}
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: ErrIllegalParameters}
+	}
+	if offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	amount := copy(data, f.node.data[offset:])
+	if amount < len(data) {
+		return amount, io.EOF
+	}
+	return amount, nil
+}
+
+func (f *memFile) WriteAt(data []byte, offset int64) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if f.closed || !f.write {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+	if offset < 0 || f.append {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: ErrIllegalParameters}
+	}
+	if end := int(offset) + len(data); end > len(f.node.data) {
+		f.node.data = append(f.node.data, make([]byte, end-len(f.node.data))...)
+	}
+	copy(f.node.data[offset:], data)
+	f.node.modTime = time.Now()
+	return len(data), nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if f.closed {
+		return &os.PathError{Op: "sync", Path: f.name, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	if f.closed || !f.write {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: os.ErrPermission}
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: ErrIllegalParameters}
+	}
+	if int(size) > len(f.node.data) {
+		f.node.data = append(f.node.data, make([]byte, int(size)-len(f.node.data))...)
+	}
+	f.node.data = f.node.data[:size]
+	f.node.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+	return f.node.info(path.Base(memPath(f.name))), nil
+}
+
+/*
+memFileInfo implements os.FileInfo for nodes of a MemFileSystem.
+*/
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i *memFileInfo) Name() string       { return i.name }
+func (i *memFileInfo) Size() int64        { return i.size }
+func (i *memFileInfo) Mode() os.FileMode  { return i.mode }
+func (i *memFileInfo) ModTime() time.Time { return i.modTime }
+func (i *memFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memFileInfo) Sys() interface{}   { return nil }
+
+/*
+FaultyFileSystem wraps a FileSystem and fails exactly one operation, allowing
+tests to check how errors at any point are handled. Operations on files opened
+through it count too.
+*/
+type FaultyFileSystem struct {
+	fs     FileSystem
+	FailAt int   // number of the failing operation starting with 1, never if 0
+	Err    error // returned error, ErrInjectedFault if nil
+	mutex  sync.Mutex
+	count  int
+}
+
+/*
+CreateFaultyFileSystem returns a FaultyFileSystem wrapping fs that fails the
+failAt-th operation.
+*/
+func CreateFaultyFileSystem(fs FileSystem, failAt int) *FaultyFileSystem {
+	return &FaultyFileSystem{fs: fs, FailAt: failAt}
+}
+
+/*
+Operations returns the amount of operations executed so far, including the
+failed one.
+*/
+func (f *FaultyFileSystem) Operations() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.count
+}
+
+/*
+fail counts an operation and returns the error if it is the failing one.
+*/
+func (f *FaultyFileSystem) fail() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.count++
+	if f.count != f.FailAt {
+		return nil
+	}
+	if f.Err != nil {
+		return f.Err
+	}
+	return ErrInjectedFault
+}
+
+/*
+Open a file for reading.
+*/
+func (f *FaultyFileSystem) Open(name string) (File, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	return f.wrap(f.fs.Open(name))
+}
+
+/*
+Create or truncate a file for writing.
+*/
+func (f *FaultyFileSystem) Create(name string) (File, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	return f.wrap(f.fs.Create(name))
+}
+
+/*
+OpenFile with the flags of os.OpenFile.
+*/
+func (f *FaultyFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	return f.wrap(f.fs.OpenFile(name, flag, perm))
+}
+
+/*
+Stat returns the information of the file.
+*/
+func (f *FaultyFileSystem) Stat(name string) (os.FileInfo, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	return f.fs.Stat(name)
+}
+
+/*
+Lstat returns the information of the file without following symbolic links.
+*/
+func (f *FaultyFileSystem) Lstat(name string) (os.FileInfo, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	return f.fs.Lstat(name)
+}
+
+/*
+ReadDir returns the entries of the directory sorted by name.
+*/
+func (f *FaultyFileSystem) ReadDir(name string) ([]os.FileInfo, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	return f.fs.ReadDir(name)
+}
+
+/*
+Mkdir creates a single directory.
+*/
+func (f *FaultyFileSystem) Mkdir(name string, perm os.FileMode) error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+	return f.fs.Mkdir(name, perm)
+}
+
+/*
+MkdirAll creates the directory and all missing parents.
+*/
+func (f *FaultyFileSystem) MkdirAll(name string, perm os.FileMode) error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+	return f.fs.MkdirAll(name, perm)
+}
+
+/*
+Rename moves a file or directory.
+*/
+func (f *FaultyFileSystem) Rename(from, to string) error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+	return f.fs.Rename(from, to)
+}
+
+/*
+Remove a file or empty directory.
+*/
+func (f *FaultyFileSystem) Remove(name string) error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+	return f.fs.Remove(name)
+}
+
+/*
+RemoveAll removes the path and everything it contains.
+*/
+func (f *FaultyFileSystem) RemoveAll(name string) error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+	return f.fs.RemoveAll(name)
+}
+
+/*
+Chmod changes the permissions of the file.
+*/
+func (f *FaultyFileSystem) Chmod(name string, mode os.FileMode) error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+	return f.fs.Chmod(name, mode)
+}
+
+/*
+Chtimes changes the access and modification times of the file.
+*/
+func (f *FaultyFileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+	return f.fs.Chtimes(name, atime, mtime)
+}
+
+/*
+Readlink returns the target of the symbolic link.
+*/
+func (f *FaultyFileSystem) Readlink(name string) (string, error) {
+	if err := f.fail(); err != nil {
+		return "", err
+	}
+	return f.fs.Readlink(name)
+}
+
+func (f *FaultyFileSystem) wrap(file File, err error) (File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &faultyFile{File: file, fs: f}, nil
+}
+
+/*
+faultyFile counts reads, writes, truncating, syncing and closing as operations
+of its file system.
+*/
+type faultyFile struct {
+	File
+	fs *FaultyFileSystem
+}
+
+func (f *faultyFile) Read(data []byte) (int, error) {
+	if err := f.fs.fail(); err != nil {
+		return 0, err
+	}
+	return f.File.Read(data)
+}
+
+func (f *faultyFile) Write(data []byte) (int, error) {
+	if err := f.fs.fail(); err != nil {
+		return 0, err
+	}
+	return f.File.Write(data)
+}
+
+func (f *faultyFile) ReadAt(data []byte, offset int64) (int, error) {
+	if err := f.fs.fail(); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(data, offset)
+}
+
+func (f *faultyFile) WriteAt(data []byte, offset int64) (int, error) {
+	if err := f.fs.fail(); err != nil {
+		return 0, err
+	}
+	return f.File.WriteAt(data, offset)
+}
+
+func (f *faultyFile) Sync() error {
+	if err := f.fs.fail(); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
+
+func (f *faultyFile) Truncate(size int64) error {
+	if err := f.fs.fail(); err != nil {
+		return err
+	}
+	return f.File.Truncate(size)
+}
+
+func (f *faultyFile) Close() error {
+	if err := f.fs.fail(); err != nil {
+		// the file must not leak even if the failure is reported
+		f.File.Close()
+		return err
+	}
+	return f.File.Close()
+}
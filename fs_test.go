@@ -0,0 +1,119 @@
+package shared
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMemFileSystem(t *testing.T) {
+	fs := CreateMemFileSystem()
+	err := fs.Mkdir("/a/b", 0755)
+	if !os.IsNotExist(err) {
+		t.Error("Expected missing parent, got", err)
+	}
+	err = fs.MkdirAll("/a/b", 0755)
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	err = writeFile(fs, "/a/b/file", []byte("hello"), 0644)
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	file, _ := fs.OpenFile("/a/b/file", os.O_WRONLY|os.O_APPEND, 0)
+	file.Write([]byte(" world"))
+	file.Close()
+	data, err := readFile(fs, "/a/b/file")
+	if err != nil || string(data) != "hello world" {
+		t.Error("Expected hello world, got", string(data), err)
+	}
+	stat, err := fs.Stat("/a/b/file")
+	if err != nil || stat.Size() != 11 || stat.IsDir() || stat.Mode().Perm() != 0644 {
+		t.Error("Expected file of size 11, got", stat, err)
+	}
+	_, err = fs.OpenFile("/a/b/file", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if !os.IsExist(err) {
+		t.Error("Expected exists, got", err)
+	}
+	err = fs.Remove("/a")
+	if err == nil {
+		t.Error("Expected non empty directory to stay")
+	}
+	err = fs.Rename("/a", "/c")
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	infos, err := fs.ReadDir("/c/b")
+	if err != nil || len(infos) != 1 || infos[0].Name() != "file" {
+		t.Error("Expected moved contents, got", infos, err)
+	}
+	if _, err := fs.Stat("/a/b/file"); !os.IsNotExist(err) {
+		t.Error("Expected old path to be gone, got", err)
+	}
+	err = fs.RemoveAll("/c")
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	infos, _ = fs.ReadDir("/")
+	if len(infos) != 0 {
+		t.Error("Expected empty file system, got", infos)
+	}
+}
+
+func TestFaultyFileSystem(t *testing.T) {
+	defer func(old FileSystem) { FS = old }(FS)
+	// count the operations of a successful run first
+	counter := CreateFaultyFileSystem(CreateMemFileSystem(), 0)
+	FS = counter
+	err := MakeTinzeniteDir("/root")
+	operations := counter.Operations()
+	if err != nil || !IsTinzenite("/root") {
+		t.Fatal("Expected no error, got", err)
+	}
+	// every single failure must be reported
+	for failAt := 1; failAt <= operations; failAt++ {
+		FS = CreateFaultyFileSystem(CreateMemFileSystem(), failAt)
+		err := MakeTinzeniteDir("/root")
+		if err != ErrInjectedFault {
+			t.Error("Expected failure of operation", failAt, "to be returned, got", err)
+		}
+	}
+}
+
+func Test_helpersOnMemFileSystem(t *testing.T) {
+	defer func(old FileSystem) { FS = old }(FS)
+	FS = CreateMemFileSystem()
+	err := MakeTinzeniteDir("/root")
+	if err != nil || !IsTinzenite("/root") {
+		t.Fatal("Expected no error, got", err)
+	}
+	peer, _ := CreatePeer("name", "address", false)
+	err = peer.StoreTo("/root/" + STOREPEERDIR)
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	peers, err := LoadPeers("/root")
+	if err != nil || len(peers) != 1 || peers["address"].Name != "name" {
+		t.Error("Expected stored peer, got", peers, err)
+	}
+	dump := &ToxPeerDump{SelfPeer: peer, ToxData: []byte("tox")}
+	err = dump.StoreTo("/root/" + STORETOXDUMPDIR)
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	loaded, err := LoadToxDumpFrom("/root/" + STORETOXDUMPDIR)
+	if err != nil || string(loaded.ToxData) != "tox" {
+		t.Error("Expected stored dump, got", loaded, err)
+	}
+	err = RemoveDirContents("/root/" + STOREPEERDIR)
+	if empty, _ := IsDirectoryEmpty("/root/" + STOREPEERDIR); err != nil || !empty {
+		t.Error("Expected removed peers, got", err)
+	}
+	// nothing may have touched the disk
+	if _, err := os.Lstat("/root/" + STOREPEERDIR); !os.IsNotExist(err) {
+		t.Error("Expected nothing on disk")
+	}
+	err = RemoveDotTinzenite("/root")
+	if err != nil || IsTinzenite("/root") {
+		t.Error("Expected removed .tinzenite, got", err)
+	}
+}
@@ -2,22 +2,29 @@ package shared
 
 import (
 	"bufio"
+	"context"
 	"crypto/md5"
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
-	"os/user"
 	"strconv"
 	"strings"
 )
 
 /*
-IsTinzenite checks whether a given path is indeed a valid directory
+ProgressFunc is called by long running functions with the amount of work done so
+far and the total amount of work, for example bytes or directory entries.
+*/
+type ProgressFunc func(done, total int64)
+
+/*
+IsTinzenite checks whether a given path is indeed a valid directory. Only the
+existence of TINZENITEDIR is checked, use Validate to detect incomplete or
+damaged directories.
 */
-// TODO detect incomplete dir (no connected peers, etc) or write a validate method
 func IsTinzenite(dirpath string) bool {
 	value, _ := DirectoryExists(dirpath + "/" + TINZENITEDIR)
 	return value
@@ -25,9 +32,9 @@ func IsTinzenite(dirpath string) bool {
 
 /*
 IsEncrypted checks whether a given path is indeed a valid directory for an
-encrypted peer.
+encrypted peer. Only the existence of LOCALDIR is checked, use Validate to
+detect incomplete or damaged directories.
 */
-// TODO detect incomplete dir (no connected peers, etc) or write a validate method
 func IsEncrypted(dirpath string) bool {
 	value, _ := DirectoryExists(dirpath + "/" + LOCALDIR)
 	return value
@@ -39,15 +46,56 @@ including the .tinignore file required for it. The given path is the path to the
 directory (NOT the .TINZENITEDIR!).
 */
 func MakeTinzeniteDir(root string) error {
-	root = root + "/" + TINZENITEDIR
+	return MakeTinzeniteDirContext(context.Background(), root, nil)
+}
+
+/*
+MakeTinzeniteDirContext works like MakeTinzeniteDir but stops once the context
+is canceled and reports every directory and file created to progress, which may
+be nil.
+*/
+func MakeTinzeniteDirContext(ctx context.Context, root string, progress ProgressFunc) error {
+	// only new directories get the current layout, old ones must be migrated
+	_, err := FS.Lstat(root + "/" + TINZENITEDIR)
+	existed := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	subdirs := []string{"", ORGDIR + "/" + PEERSDIR, TEMPDIR, REMOVEDIR,
+		LOCALDIR, LOCALDIR + "/" + REMOVESTOREDIR, RECEIVINGDIR, SENDINGDIR}
+	// directories plus the .tinignore and layout files
+	total := int64(len(subdirs) + 2)
+	reportProgress(progress, 0, total)
 	// build directory structure
-	err := MakeDirectories(root, ORGDIR+"/"+PEERSDIR, TEMPDIR, REMOVEDIR,
-		LOCALDIR, LOCALDIR+"/"+REMOVESTOREDIR, RECEIVINGDIR, SENDINGDIR)
-	if err != nil {
+	for i, path := range subdirs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		subpath := joinPath(TINZENITEDIR, path)
+		err := makeDirectoryMode(root+"/"+subpath, Permissions.Mode(subpath, true, false))
+		if err != nil {
+			return err
+		}
+		reportProgress(progress, int64(i+1), total)
+	}
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 	// write required .tinignore file
-	return ioutil.WriteFile(root+"/"+TINIGNORE, []byte(TINDIRIGNORE), FILEPERMISSIONMODE)
+	path := root + "/" + TINZENITEDIR + "/" + TINIGNORE
+	err = writeFile(FS, path, []byte(TINDIRIGNORE), Permissions.SharedFile)
+	if err != nil {
+		return err
+	}
+	reportProgress(progress, total-1, total)
+	if !existed {
+		err = writeLayout(root, DkTinzenite, LayoutVersion(DkTinzenite))
+		if err != nil {
+			return err
+		}
+	}
+	reportProgress(progress, total, total)
+	return nil
 }
 
 /*
@@ -55,48 +103,52 @@ MakeEncryptedDir builds the directory structure for an encrypted peer. The given
 path is the path to the directory.
 */
 func MakeEncryptedDir(root string) error {
+	// only new directories get the current layout, old ones must be migrated
+	_, err := FS.Lstat(root + "/" + LOCALDIR)
+	existed := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	peers := ORGDIR + "/" + PEERSDIR
-	return MakeDirectories(root, LOCALDIR, ORGDIR, peers, RECEIVINGDIR, SENDINGDIR)
+	for _, subpath := range []string{"", LOCALDIR, ORGDIR, peers, RECEIVINGDIR, SENDINGDIR} {
+		err = makeDirectoryMode(CreatePath(root, subpath).FullPath(), Permissions.Mode(subpath, true, true))
+		if err != nil {
+			return err
+		}
+	}
+	if existed {
+		return nil
+	}
+	return writeLayout(root, DkEncrypted, LayoutVersion(DkEncrypted))
 }
 
 /*
 RemoveDotTinzenite directory. Specifically leaves all user files but removes all
-Tinzenite specific items.
+Tinzenite specific items. The directory is unregistered first, so that it is
+never listed without being a Tinzenite directory.
 */
 func RemoveDotTinzenite(path string) error {
 	if !IsTinzenite(path) {
 		return ErrNotTinzenite
 	}
-	/* TODO remove from directory list*/
-	return os.RemoveAll(path + "/" + TINZENITEDIR)
+	err := UnregisterDirectory(path)
+	if err != nil {
+		return err
+	}
+	return FS.RemoveAll(path + "/" + TINZENITEDIR)
 }
 
 /*
-WriteDirectoryList adds the given path to the DIRECTORYLIST file. Will try to
+WriteDirectoryList adds the given path to the directory registry. Will try to
 avoid writing the same path multiple times.
 */
 func WriteDirectoryList(path string) error {
-	filePath, err := directoryListPath()
-	if err != nil {
-		return err
-	}
-	// make dir in case that it doesn't exist yet (root path here is the directory)
-	err = MakeDirectory(filePath.RootPath())
-	if err != nil {
-		return err
-	}
-	lines, err := ReadDirectoryList()
-	if err != nil {
-		return err
-	}
-	// only add new entry if it doesn't yet exist
-	if !Contains(lines, path) {
-		lines = append(lines, path)
-		newContent := strings.Join(lines, "\n")
-		return ioutil.WriteFile(filePath.FullPath(), []byte(newContent), FILEPERMISSIONMODE)
+	kind := DetectDirKind(path)
+	if kind == DkNone {
+		// may be registered before the directory is created
+		kind = DkTinzenite
 	}
-	// if already exists we're done
-	return nil
+	return RegisterDirectory(path, kind, "")
 }
 
 /*
@@ -104,31 +156,15 @@ ReadDirectoryList reads all registered Tinzenite directories in the system. May
 return an empty listing if none found!
 */
 func ReadDirectoryList() ([]string, error) {
-	filePath, err := directoryListPath()
+	entries, err := ListDirectories()
 	if err != nil {
 		return nil, err
 	}
-	exists, err := FileExists(filePath.FullPath())
-	// if file doesn't exist / error happened we're done
-	if !exists || err != nil {
-		return []string{}, nil
+	paths := []string{}
+	for _, entry := range entries {
+		paths = append(paths, entry.Path)
 	}
-	bytes, err := ioutil.ReadFile(filePath.FullPath())
-	if err != nil {
-		return nil, err
-	}
-	return strings.Split(string(bytes), "\n"), nil
-}
-
-/*
-directoryListPath returns the path where the file lies.
-*/
-func directoryListPath() (*RelativePath, error) {
-	user, err := user.Current()
-	if err != nil {
-		return nil, err
-	}
-	return CreatePath(user.HomeDir+"/.config/tinzenite/", DIRECTORYLIST), nil
+	return paths, nil
 }
 
 /*
@@ -150,31 +186,18 @@ func NewIdentifier() (string, error) {
 }
 
 /*
-ContentHash generates the hash of the content of the given file at path.
+MakeDirectory creates the path.
 */
-func ContentHash(path string) (string, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
-	hash := md5.New()
-	buf := make([]byte, CHUNKSIZE)
-	// create hash
-	for amount := CHUNKSIZE; amount == CHUNKSIZE; {
-		amount, _ = file.Read(buf)
-		// log.Printf("Read %d bytes", amount)
-		hash.Write(buf)
-	}
-	// return hex representation
-	return hex.EncodeToString(hash.Sum(nil)), nil
+func MakeDirectory(path string) error {
+	return makeDirectoryMode(path, Permissions.UserDir)
 }
 
 /*
-MakeDirectory creates the path.
+makeDirectoryMode creates the path with the given mode for all missing
+directories.
 */
-func MakeDirectory(path string) error {
-	err := os.MkdirAll(path, FILEPERMISSIONMODE)
+func makeDirectoryMode(path string, mode os.FileMode) error {
+	err := FS.MkdirAll(path, mode)
 	// TODO this doesn't seem to work... why not?
 	if err == os.ErrExist {
 		return nil
@@ -202,24 +225,72 @@ RemoveDirContents removes all files within the given path, leaving the directory
 as is.
 */
 func RemoveDirContents(path string) error {
-	allStat, err := ioutil.ReadDir(path)
+	return RemoveDirContentsContext(context.Background(), path, nil)
+}
+
+/*
+RemoveDirContentsContext works like RemoveDirContents but stops once the context
+is canceled and reports the amount of entries removed to progress, which may be
+nil.
+*/
+func RemoveDirContentsContext(ctx context.Context, path string, progress ProgressFunc) error {
+	allStat, err := FS.ReadDir(path)
 	if err != nil {
 		return err
 	}
-	for _, stat := range allStat {
-		err := os.Remove(path + "/" + stat.Name())
+	total := int64(len(allStat))
+	reportProgress(progress, 0, total)
+	for i, stat := range allStat {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := FS.Remove(path + "/" + stat.Name())
 		if err != nil {
 			return err
 		}
+		reportProgress(progress, int64(i+1), total)
 	}
 	return nil
 }
 
+/*
+reportProgress calls progress if it is set.
+*/
+func reportProgress(progress ProgressFunc, done, total int64) {
+	if progress != nil {
+		progress(done, total)
+	}
+}
+
+/*
+progressReader checks the context before every read and reports the amount of
+bytes read so far.
+*/
+type progressReader struct {
+	ctx      context.Context
+	reader   io.Reader
+	progress ProgressFunc
+	done     int64
+	total    int64
+}
+
+func (r *progressReader) Read(data []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	amount, err := r.reader.Read(data)
+	if amount > 0 {
+		r.done += int64(amount)
+		reportProgress(r.progress, r.done, r.total)
+	}
+	return amount, err
+}
+
 /*
 FileExists checks whether a file at that location exists.
 */
 func FileExists(path string) (bool, error) {
-	stat, err := os.Lstat(path)
+	stat, err := FS.Lstat(path)
 	// sadly any error means it doesn't exist, no way to differentiate easily here
 	if err != nil {
 		return false, nil
@@ -234,7 +305,7 @@ func FileExists(path string) (bool, error) {
 DirectoryExists checks whether a directory at that location exists.
 */
 func DirectoryExists(path string) (bool, error) {
-	stat, err := os.Lstat(path)
+	stat, err := FS.Lstat(path)
 	// sadly any error means it doesn't exist, no way to differentiate easily here
 	if err != nil {
 		return false, nil
@@ -283,7 +354,7 @@ func IsDirectoryEmpty(path string) (bool, error) {
 	if !isDir {
 		return false, errors.New("directory doesn't exist")
 	}
-	subFiles, err := ioutil.ReadDir(path)
+	subFiles, err := FS.ReadDir(path)
 	if err != nil {
 		return false, err
 	}
@@ -1,6 +1,7 @@
 package shared
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -97,6 +98,52 @@ func Test_ObjectExists(t *testing.T) {
 	// missing: error case
 }
 
+func Test_RemoveDirContentsContext(t *testing.T) {
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	for i := 0; i < 3; i++ {
+		makeTempFile(root, "file")
+	}
+	var done, total int64
+	err := RemoveDirContentsContext(context.Background(), root, func(d, t int64) {
+		done, total = d, t
+	})
+	if err != nil || done != 3 || total != 3 {
+		t.Error("Expected 3 of 3 entries removed, got", done, total, err)
+	}
+	makeTempFile(root, "file")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = RemoveDirContentsContext(ctx, root, nil)
+	if err != context.Canceled {
+		t.Error("Expected canceled, got", err)
+	}
+	if empty, _ := IsDirectoryEmpty(root); empty {
+		t.Error("Expected canceled call to remove nothing")
+	}
+}
+
+func Test_MakeTinzeniteDirContext(t *testing.T) {
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := MakeTinzeniteDirContext(ctx, root, nil)
+	if err != context.Canceled || IsTinzenite(root) {
+		t.Error("Expected canceled, got", err)
+	}
+	var done, total int64
+	err = MakeTinzeniteDirContext(context.Background(), root, func(d, t int64) {
+		done, total = d, t
+	})
+	if err != nil || done != total || total == 0 {
+		t.Error("Expected complete progress, got", done, total, err)
+	}
+	if exists, _ := FileExists(root + "/" + TINZENITEDIR + "/" + TINIGNORE); !exists {
+		t.Error("Expected .tinignore to be written")
+	}
+}
+
 func Test_IsDirectoryEmpty(t *testing.T) {
 	// make dir for tests so that we can easily clean up afterwards
 	root := makeTempDir("", "root")
@@ -0,0 +1,298 @@
+package shared
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Hash algorithm names as used in the prefix of content hashes.
+const (
+	/*HASHSHA256 is the default algorithm for content hashes.*/
+	HASHSHA256 = "sha256"
+	/*HASHSHA512 is available as an alternative to HASHSHA256.*/
+	HASHSHA512 = "sha512"
+	/*HASHLEGACY names the untagged MD5 hashes of older versions.*/
+	HASHLEGACY = "md5"
+)
+
+var (
+	hashMutex      sync.RWMutex
+	hashAlgorithm  = HASHSHA256
+	hashAlgorithms = map[string]func() hash.Hash{
+		HASHSHA256: sha256.New,
+		HASHSHA512: sha512.New}
+)
+
+/*
+RegisterHashAlgorithm makes a further hash algorithm available under the given
+name. The name must not contain ':' and the legacy algorithm can not be
+replaced. BLAKE2b is not built in because it is not part of the standard
+library; register it as "blake2b" to use it, for example with blake2b.New512
+of golang.org/x/crypto/blake2b.
+*/
+func RegisterHashAlgorithm(name string, create func() hash.Hash) error {
+	if name == "" || name == HASHLEGACY || strings.Contains(name, ":") || create == nil {
+		return ErrIllegalParameters
+	}
+	hashMutex.Lock()
+	defer hashMutex.Unlock()
+	hashAlgorithms[name] = create
+	return nil
+}
+
+/*
+SetHashAlgorithm selects the registered algorithm used by ContentHash.
+*/
+func SetHashAlgorithm(name string) error {
+	hashMutex.Lock()
+	defer hashMutex.Unlock()
+	if _, exists := hashAlgorithms[name]; !exists {
+		return ErrUnsupported
+	}
+	hashAlgorithm = name
+	return nil
+}
+
+/*
+HashAlgorithm returns the name of the algorithm used by ContentHash.
+*/
+func HashAlgorithm() string {
+	hashMutex.RLock()
+	defer hashMutex.RUnlock()
+	return hashAlgorithm
+}
+
+/*
+ContentHash generates the hash of the content of the given file at path. The
+hash is prefixed with the name of the algorithm, for example "sha256:...".
+*/
+func ContentHash(path string) (string, error) {
+	return ContentHashWith(path, HashAlgorithm())
+}
+
+/*
+ContentHashContext works like ContentHash but stops once the context is canceled
+and reports the amount of bytes hashed to progress, which may be nil.
+*/
+func ContentHashContext(ctx context.Context, path string, progress ProgressFunc) (string, error) {
+	return contentHash(ctx, FS, path, HashAlgorithm(), progress)
+}
+
+/*
+ContentHashWith generates the hash of the file at path with the given algorithm.
+For HASHLEGACY the untagged hash of older versions is returned.
+*/
+func ContentHashWith(path string, algorithm string) (string, error) {
+	return contentHashWith(FS, path, algorithm)
+}
+
+func contentHashWith(fsys FileSystem, path string, algorithm string) (string, error) {
+	if algorithm == HASHLEGACY {
+		return legacyContentHash(fsys, path)
+	}
+	return contentHash(context.Background(), fsys, path, algorithm, nil)
+}
+
+/*
+contentHash hashes the file at path on fsys, checking the context before every
+read.
+*/
+func contentHash(ctx context.Context, fsys FileSystem, path, algorithm string, progress ProgressFunc) (string, error) {
+	hash, err := newHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	file, err := fsys.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	reader := &progressReader{ctx: ctx, reader: file, progress: progress, total: stat.Size()}
+	reportProgress(progress, 0, reader.total)
+	err = hashReader(hash, reader)
+	if err != nil {
+		return "", err
+	}
+	return formatHash(algorithm, hash), nil
+}
+
+/*
+ParseHash splits a content hash into the algorithm and the hex digest. Untagged
+hashes are returned as HASHLEGACY.
+*/
+func ParseHash(value string) (algorithm, digest string) {
+	index := strings.Index(value, ":")
+	if index < 0 {
+		return HASHLEGACY, value
+	}
+	return value[:index], value[index+1:]
+}
+
+/*
+IsLegacyHash returns whether the hash was created by an older version.
+*/
+func IsLegacyHash(value string) bool {
+	algorithm, _ := ParseHash(value)
+	return value != "" && algorithm == HASHLEGACY
+}
+
+/*
+HashMatches checks whether the file at path has the given content hash, using
+the algorithm the hash was created with. Legacy hashes are supported.
+*/
+func HashMatches(path, value string) (bool, error) {
+	return hashMatches(FS, path, value)
+}
+
+func hashMatches(fsys FileSystem, path, value string) (bool, error) {
+	algorithm, _ := ParseHash(value)
+	current, err := contentHashWith(fsys, path, algorithm)
+	if err != nil {
+		return false, err
+	}
+	return current == value, nil
+}
+
+/*
+UpgradeHash replaces a legacy content hash of the given file object below root
+with one of the current algorithm. The hash is only replaced if the file still
+matches the legacy hash, so that changed files are not hidden; returns whether
+the hash was replaced.
+*/
+func UpgradeHash(root string, obj *ObjectInfo) (bool, error) {
+	return upgradeHash(FS, root, obj)
+}
+
+func upgradeHash(fsys FileSystem, root string, obj *ObjectInfo) (bool, error) {
+	if obj.Directory || !IsLegacyHash(obj.Content) {
+		return false, nil
+	}
+	path := CreatePath(root, obj.Path).FullPath()
+	matches, err := hashMatches(fsys, path, obj.Content)
+	if err != nil || !matches {
+		return false, err
+	}
+	obj.Content, err = contentHashWith(fsys, path, HashAlgorithm())
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+/*
+UpgradeHashes replaces the legacy content hashes of at most limit objects of the
+model, allowing models to be migrated lazily in small batches. Returns how many
+hashes were replaced; zero means no upgradable legacy hashes are left.
+*/
+func (m *Model) UpgradeHashes(root string, limit int) (int, error) {
+	var legacy []*ObjectInfo
+	walk(m.Root, func(obj *ObjectInfo) {
+		if len(legacy) < limit && IsLegacyHash(obj.Content) {
+			legacy = append(legacy, obj)
+		}
+	})
+	count := 0
+	for _, obj := range legacy {
+		upgraded, err := upgradeHash(m.fs(), root, obj)
+		if err != nil {
+			return count, err
+		}
+		if upgraded {
+			m.invalidate(parentPath(obj.Path))
+			count++
+		}
+	}
+	return count, nil
+}
+
+/*
+contentEqual compares two content hashes. Hashes of different algorithms can
+not be compared and are considered equal, leaving the decision to the version.
+Where the file is available, use HashMatches instead, see sameHashAlgorithm.
+*/
+func contentEqual(one, two string) bool {
+	if one == two {
+		return true
+	}
+	algorithmOne, _ := ParseHash(one)
+	algorithmTwo, _ := ParseHash(two)
+	return one != "" && two != "" && algorithmOne != algorithmTwo
+}
+
+/*
+sameHashAlgorithm returns whether both hashes were created with the same
+algorithm and can therefore be compared directly.
+*/
+func sameHashAlgorithm(one, two string) bool {
+	algorithmOne, _ := ParseHash(one)
+	algorithmTwo, _ := ParseHash(two)
+	return algorithmOne == algorithmTwo
+}
+
+/*
+newHash returns a new instance of the named algorithm.
+*/
+func newHash(algorithm string) (hash.Hash, error) {
+	hashMutex.RLock()
+	create, exists := hashAlgorithms[algorithm]
+	hashMutex.RUnlock()
+	if !exists {
+		return nil, ErrUnsupported
+	}
+	return create(), nil
+}
+
+/*
+formatHash returns the tagged representation of the sum of hash.
+*/
+func formatHash(algorithm string, hash hash.Hash) string {
+	return algorithm + ":" + hex.EncodeToString(hash.Sum(nil))
+}
+
+/*
+hashReader writes everything read from reader into hash.
+*/
+func hashReader(hash hash.Hash, reader io.Reader) error {
+	buf := make([]byte, CHUNKSIZE)
+	for {
+		amount, err := reader.Read(buf)
+		hash.Write(buf[:amount])
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+/*
+legacyContentHash reproduces the MD5 hash of older versions, which always hashed
+the complete buffer even if less was read. Only used to compare with existing
+legacy hashes.
+*/
+func legacyContentHash(fsys FileSystem, path string) (string, error) {
+	file, err := fsys.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := md5.New()
+	buf := make([]byte, CHUNKSIZE)
+	for amount := CHUNKSIZE; amount == CHUNKSIZE; {
+		amount, _ = file.Read(buf)
+		hash.Write(buf)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
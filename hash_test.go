@@ -0,0 +1,180 @@
+package shared
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_ContentHash(t *testing.T) {
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	// larger than CHUNKSIZE with a partial last chunk
+	content := []byte(strings.Repeat("tinzenite", CHUNKSIZE/4))
+	path := root + "/file"
+	err := os.WriteFile(path, content, 0644)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	hash, err := ContentHash(path)
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	sum := sha256.Sum256(content)
+	want := HASHSHA256 + ":" + hex.EncodeToString(sum[:])
+	if hash != want {
+		t.Error("Expected", want, "got", hash)
+	}
+	_, err = ContentHash(root + "/missing")
+	if err == nil {
+		t.Error("Expected error for missing file")
+	}
+	// the legacy hash is wrong but must stay reproducible
+	legacy, err := ContentHashWith(path, HASHLEGACY)
+	if err != nil || !IsLegacyHash(legacy) {
+		t.Fatal("Expected legacy hash, got", legacy, "or", err)
+	}
+	correct := md5.Sum(content)
+	if legacy == hex.EncodeToString(correct[:]) {
+		t.Error("Expected legacy hash to include stale buffer data")
+	}
+	for _, value := range []string{hash, legacy} {
+		matches, err := HashMatches(path, value)
+		if !matches || err != nil {
+			t.Error("Expected", value, "to match, got", matches, "or", err)
+		}
+	}
+}
+
+func Test_ContentHashContext(t *testing.T) {
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	path := root + "/file"
+	err := os.WriteFile(path, make([]byte, 10*CHUNKSIZE+1), 0644)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	calls := 0
+	var done, total int64
+	hash, err := ContentHashContext(context.Background(), path, func(d, t int64) {
+		calls++
+		done, total = d, t
+	})
+	want, _ := ContentHash(path)
+	if err != nil || hash != want {
+		t.Error("Expected", want, "got", hash, err)
+	}
+	if done != total || total != 10*CHUNKSIZE+1 || calls < 2 {
+		t.Error("Expected progress up to", 10*CHUNKSIZE+1, "got", done, total, calls)
+	}
+	// cancel while hashing
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err = ContentHashContext(ctx, path, func(d, t int64) {
+		if d > 0 {
+			cancel()
+		}
+	})
+	if err != context.Canceled {
+		t.Error("Expected canceled, got", err)
+	}
+}
+
+func Test_ParseHash(t *testing.T) {
+	testParse := []struct {
+		value     string
+		algorithm string
+		digest    string
+	}{
+		{"sha256:abc", HASHSHA256, "abc"},
+		{"blake2b:abc", "blake2b", "abc"},
+		{"abc", HASHLEGACY, "abc"},
+		{"", HASHLEGACY, ""}}
+	for _, test := range testParse {
+		algorithm, digest := ParseHash(test.value)
+		if algorithm != test.algorithm || digest != test.digest {
+			t.Error("Expected", test.algorithm, test.digest, "got", algorithm, digest)
+		}
+	}
+	if RegisterHashAlgorithm(HASHLEGACY, sha256.New) != ErrIllegalParameters {
+		t.Error("Expected legacy algorithm to be protected")
+	}
+	if SetHashAlgorithm("unknown") != ErrUnsupported {
+		t.Error("Expected unknown algorithm to be rejected")
+	}
+}
+
+func TestModel_UpgradeHashes(t *testing.T) {
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	writeTestFiles(t, root, map[string]string{"a": "a", "b": "b"})
+	built, err := CreateBuilder(root, "self").Build(context.Background())
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	model, _ := CreateModel(built)
+	for _, name := range []string{"a", "b"} {
+		obj, _ := model.Get(name)
+		obj.Content, _ = ContentHashWith(root+"/"+name, HASHLEGACY)
+	}
+	// changed files must keep their legacy hash so the change is detected
+	writeTestFiles(t, root, map[string]string{"b": "changed"})
+	count, err := model.UpgradeHashes(root, 10)
+	if count != 1 || err != nil {
+		t.Error("Expected one upgrade, got", count, "or", err)
+	}
+	a, _ := model.Get("a")
+	b, _ := model.Get("b")
+	if IsLegacyHash(a.Content) || !IsLegacyHash(b.Content) {
+		t.Error("Expected only unchanged file to be upgraded, got", a.Content, b.Content)
+	}
+	// rebuilding detects the change despite the legacy hash
+	builder := CreateBuilder(root, "self")
+	builder.Previous = model.Root
+	rebuilt, err := builder.Build(context.Background())
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	rebuiltModel, _ := CreateModel(rebuilt)
+	b, _ = rebuiltModel.Get("b")
+	if b.Version["self"] != 1 || IsLegacyHash(b.Content) {
+		t.Error("Expected changed legacy file to get new version and hash, got", b)
+	}
+}
+
+func TestBuilder_SwitchHashAlgorithm(t *testing.T) {
+	defer SetHashAlgorithm(HashAlgorithm())
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	writeTestFiles(t, root, map[string]string{"same": "same", "changed": "old"})
+	built, err := CreateBuilder(root, "self").Build(context.Background())
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	SetHashAlgorithm(HASHSHA512)
+	// same size and modification time must not hide the change
+	stat, _ := os.Stat(root + "/changed")
+	writeTestFiles(t, root, map[string]string{"changed": "new"})
+	os.Chtimes(root+"/changed", stat.ModTime(), stat.ModTime())
+	builder := CreateBuilder(root, "self")
+	builder.Previous = built
+	rebuilt, err := builder.Build(context.Background())
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	model, _ := CreateModel(rebuilt)
+	type testSwitch struct {
+		path    string
+		version int
+	}
+	for _, test := range []testSwitch{{"same", 0}, {"changed", 1}} {
+		obj, _ := model.Get(test.path)
+		algorithm, _ := ParseHash(obj.Content)
+		if obj.Version["self"] != test.version || algorithm != HASHSHA512 {
+			t.Error("Expected", test.path, "at version", test.version, "got", obj.Version, obj.Content)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+hashCacheRacy is how old a modification time must be for the hash to be cached.
+Files modified more recently could be changed again within the resolution of
+the timestamp without the key changing.
+*/
+const hashCacheRacy = 2 * time.Second
+
+/*
+HashCache stores content hashes keyed by device, inode, size and modification
+time of files, so that unchanged files need not be hashed again. Any change of
+these values results in a different key and thus a new hash. The cache is
+stored in STOREMODELDIR as it is only valid for the local peer. All methods are
+safe for concurrent use.
+*/
+type HashCache struct {
+	path    string
+	mutex   sync.Mutex
+	entries map[string]string // key to content hash
+	used    map[string]bool   // keys looked up since opening
+}
+
+var (
+	hashCacheMutex sync.Mutex
+	hashCaches     = make(map[string]*HashCache)
+)
+
+/*
+OpenHashCache loads the hash cache of the given Tinzenite root. Until it is
+closed, CreateObjectInfo and the Builder use it for all files below root.
+*/
+func OpenHashCache(root string) (*HashCache, error) {
+	path := CreatePath(root, STOREMODELDIR+"/"+HASHCACHEJSON).FullPath()
+	cache := &HashCache{
+		path:    path,
+		entries: make(map[string]string),
+		used:    make(map[string]bool)}
+	data, err := readFile(FS, path)
+	if err == nil {
+		err = json.Unmarshal(data, &cache.entries)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	hashCacheMutex.Lock()
+	hashCaches[CreatePathRoot(root).FullPath()] = cache
+	hashCacheMutex.Unlock()
+	return cache, nil
+}
+
+/*
+Hash returns the content hash of the file at path, only hashing it if it
+changed since it was last hashed.
+*/
+func (c *HashCache) Hash(path string) (string, error) {
+	return c.hashWith(FS, path, ContentHash)
+}
+
+/*
+hashWith works like Hash on fsys but uses the given function to hash changed
+files.
+*/
+func (c *HashCache) hashWith(fsys FileSystem, path string, hash func(string) (string, error)) (string, error) {
+	stat, err := fsys.Lstat(path)
+	if err != nil {
+		return "", err
+	}
+	key, ok := hashCacheKey(stat)
+	if ok {
+		c.mutex.Lock()
+		value, exists := c.entries[key]
+		c.used[key] = true
+		c.mutex.Unlock()
+		// entries of another algorithm are useless
+		if algorithm, _ := ParseHash(value); exists && algorithm == HashAlgorithm() {
+			return value, nil
+		}
+	}
+	value, err := hash(path)
+	if err != nil {
+		return "", err
+	}
+	if ok && time.Since(stat.ModTime()) > hashCacheRacy {
+		c.mutex.Lock()
+		c.entries[key] = value
+		c.mutex.Unlock()
+	}
+	return value, nil
+}
+
+/*
+Prune removes all entries that have not been looked up since the cache was
+opened. Call after a complete scan to drop entries of changed or removed files.
+*/
+func (c *HashCache) Prune() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key := range c.entries {
+		if !c.used[key] {
+			delete(c.entries, key)
+		}
+	}
+}
+
+/*
+Store writes the cache to disk.
+*/
+func (c *HashCache) Store() error {
+	c.mutex.Lock()
+	data, err := json.Marshal(c.entries)
+	c.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(c.path, data, Permissions.PrivateFile, false)
+}
+
+/*
+Close stores the cache and stops it from being used by CreateObjectInfo and the
+Builder.
+*/
+func (c *HashCache) Close() error {
+	hashCacheMutex.Lock()
+	for root, cache := range hashCaches {
+		if cache == c {
+			delete(hashCaches, root)
+		}
+	}
+	hashCacheMutex.Unlock()
+	return c.Store()
+}
+
+/*
+cachedContentHash hashes the file at path below root on fsys, using the hash
+cache of root if one is open.
+*/
+func cachedContentHash(fsys FileSystem, root, path string) (string, error) {
+	hash := func(path string) (string, error) {
+		return contentHashWith(fsys, path, HashAlgorithm())
+	}
+	cache := lookupHashCache(root)
+	if cache == nil {
+		return hash(path)
+	}
+	return cache.hashWith(fsys, path, hash)
+}
+
+/*
+lookupHashCache returns the open hash cache of root or nil.
+*/
+func lookupHashCache(root string) *HashCache {
+	hashCacheMutex.Lock()
+	defer hashCacheMutex.Unlock()
+	return hashCaches[CreatePathRoot(root).FullPath()]
+}
+
+/*
+hashCacheKey returns the cache key of the file or false if the platform provides
+no file identity.
+*/
+func hashCacheKey(stat os.FileInfo) (string, bool) {
+	device, inode, ok := fileIdentity(stat)
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprintf("%d:%d:%d:%d", device, inode, stat.Size(), stat.ModTime().UnixNano()), true
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package shared
+
+import "os"
+
+/*
+fileIdentity is not available on this platform, so nothing is cached.
+*/
+func fileIdentity(stat os.FileInfo) (device, inode uint64, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,85 @@
+package shared
+
+import (
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestHashCache_Hash(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no file identity available")
+	}
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	err := os.MkdirAll(root+"/"+STOREMODELDIR, 0700)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	path := root + "/file"
+	old := time.Now().Add(-time.Hour)
+	write := func(content string, modtime time.Time) {
+		err := os.WriteFile(path, []byte(content), 0644)
+		if err == nil {
+			err = os.Chtimes(path, modtime, modtime)
+		}
+		if err != nil {
+			t.Fatal("Failed test setup", err)
+		}
+	}
+	write("aaaa", old)
+	want, _ := ContentHash(path)
+	cache, err := OpenHashCache(root)
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	hash, err := cache.Hash(path)
+	if err != nil || hash != want {
+		t.Error("Expected", want, "got", hash, err)
+	}
+	// same size and time: the cache can not notice the change, proving it is used
+	write("bbbb", old)
+	hash, _ = cache.Hash(path)
+	if hash != want {
+		t.Error("Expected cached", want, "got", hash)
+	}
+	// the cache must survive being stored
+	err = cache.Close()
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	cache, err = OpenHashCache(root)
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	defer cache.Close()
+	obj, err := CreateObjectInfo(root, "file", "id")
+	if err != nil || obj.Content != want {
+		t.Error("Expected CreateObjectInfo to use cached", want, "got", obj, err)
+	}
+	// a changed modification time invalidates the entry
+	write("bbbb", old.Add(time.Second))
+	hash, _ = cache.Hash(path)
+	if hash == want {
+		t.Error("Expected new hash after modification")
+	}
+	// recently modified files are never cached
+	write("cccc", time.Now())
+	first, _ := cache.Hash(path)
+	write("dddd", time.Now())
+	second, _ := cache.Hash(path)
+	if first == second {
+		t.Error("Expected recently modified file to be rehashed")
+	}
+}
+
+func TestHashCache_Prune(t *testing.T) {
+	cache := &HashCache{
+		entries: map[string]string{"a": "sha256:a", "b": "sha256:b"},
+		used:    map[string]bool{"a": true}}
+	cache.Prune()
+	if _, exists := cache.entries["b"]; exists || len(cache.entries) != 1 {
+		t.Error("Expected only used entries, got", cache.entries)
+	}
+}
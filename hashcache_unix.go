@@ -0,0 +1,19 @@
+//go:build unix
+
+package shared
+
+import (
+	"os"
+	"syscall"
+)
+
+/*
+fileIdentity returns the device and inode of the file.
+*/
+func fileIdentity(stat os.FileInfo) (device, inode uint64, ok bool) {
+	sys, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(sys.Dev), uint64(sys.Ino), true
+}
@@ -0,0 +1,155 @@
+package shared
+
+import (
+	"context"
+	"io"
+	"runtime"
+	"sync"
+)
+
+/*
+HashPool hashes many files concurrently. The amount of files hashed at once and
+the amount of concurrent reads can be limited separately, so that slow disks are
+not overwhelmed while the hashing itself still uses all processors.
+*/
+type HashPool struct {
+	Workers    int        // files hashed at once, runtime.NumCPU() if not positive
+	IOLimit    int        // concurrent reads, Workers if not positive
+	Cache      *HashCache // optional, not used when chunking
+	Chunking   bool       // if true the ChunkList of every file is computed too
+	FileSystem FileSystem // FS if nil
+	// OnResult is optional and called with the index of every path as soon as it
+	// is hashed, never concurrently.
+	OnResult func(index int, result HashResult)
+}
+
+/*
+HashResult is the result of hashing a single path. Err is set if the file could
+not be hashed.
+*/
+type HashResult struct {
+	Path    string
+	Content string
+	Chunks  *ChunkList
+	Err     error
+}
+
+/*
+CreateHashPool returns a HashPool with the given amount of workers.
+*/
+func CreateHashPool(workers int) *HashPool {
+	return &HashPool{Workers: workers}
+}
+
+/*
+HashPaths hashes all given paths and returns the results in the same order.
+Errors of single files are returned in their result and do not stop the other
+files from being hashed. Only if the context is canceled is an error returned.
+*/
+func (p *HashPool) HashPaths(ctx context.Context, paths []string) ([]HashResult, error) {
+	workers := p.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	ioLimit := p.IOLimit
+	if ioLimit <= 0 {
+		ioLimit = workers
+	}
+	limit := make(chan struct{}, ioLimit)
+	results := make([]HashResult, len(paths))
+	jobs := make(chan int)
+	var wait sync.WaitGroup
+	var report sync.Mutex
+	for i := 0; i < workers; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for index := range jobs {
+				results[index] = p.hash(ctx, limit, paths[index])
+				if p.OnResult != nil {
+					report.Lock()
+					p.OnResult(index, results[index])
+					report.Unlock()
+				}
+			}
+		}()
+	}
+feed:
+	for index := range paths {
+		select {
+		case jobs <- index:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wait.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+/*
+hash hashes a single file, reading only while holding a slot of limit.
+*/
+func (p *HashPool) hash(ctx context.Context, limit chan struct{}, path string) HashResult {
+	result := HashResult{Path: path}
+	fsys := p.FileSystem
+	if fsys == nil {
+		fsys = FS
+	}
+	if p.Chunking {
+		file, err := fsys.Open(path)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		defer file.Close()
+		result.Content, result.Chunks, result.Err = ChunkReader(&limitedReader{ctx: ctx, reader: file, limit: limit})
+		return result
+	}
+	hash := func(path string) (string, error) {
+		file, err := fsys.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+		algorithm := HashAlgorithm()
+		hash, err := newHash(algorithm)
+		if err != nil {
+			return "", err
+		}
+		err = hashReader(hash, &limitedReader{ctx: ctx, reader: file, limit: limit})
+		if err != nil {
+			return "", err
+		}
+		return formatHash(algorithm, hash), nil
+	}
+	if p.Cache != nil {
+		result.Content, result.Err = p.Cache.hashWith(fsys, path, hash)
+	} else {
+		result.Content, result.Err = hash(path)
+	}
+	return result
+}
+
+/*
+limitedReader holds a slot of limit during every read and stops reading once the
+context is canceled.
+*/
+type limitedReader struct {
+	ctx    context.Context
+	reader io.Reader
+	limit  chan struct{}
+}
+
+func (r *limitedReader) Read(data []byte) (int, error) {
+	select {
+	case r.limit <- struct{}{}:
+	case <-r.ctx.Done():
+		return 0, r.ctx.Err()
+	}
+	defer func() { <-r.limit }()
+	return r.reader.Read(data)
+}
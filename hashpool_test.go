@@ -0,0 +1,94 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestHashPool_HashPaths(t *testing.T) {
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	var paths []string
+	for i := 0; i < 20; i++ {
+		path := fmt.Sprintf("%s/file%d", root, i)
+		err := os.WriteFile(path, []byte(fmt.Sprint("content", i)), 0644)
+		if err != nil {
+			t.Fatal("Failed test setup", err)
+		}
+		paths = append(paths, path)
+	}
+	paths = append(paths, root+"/missing")
+	pool := CreateHashPool(4)
+	pool.IOLimit = 2
+	results, err := pool.HashPaths(context.Background(), paths)
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	if len(results) != len(paths) {
+		t.Fatal("Expected", len(paths), "results, got", len(results))
+	}
+	for i, result := range results[:len(results)-1] {
+		want, _ := ContentHash(paths[i])
+		if result.Path != paths[i] || result.Content != want || result.Err != nil {
+			t.Error("Expected", paths[i], want, "got", result)
+		}
+	}
+	if results[len(results)-1].Err == nil {
+		t.Error("Expected error for missing file")
+	}
+	// chunking must give the same results as ChunkFile
+	pool.Chunking = true
+	results, _ = pool.HashPaths(context.Background(), paths[:1])
+	content, chunks, _ := ChunkFile(paths[0])
+	if results[0].Content != content || !reflect.DeepEqual(results[0].Chunks, chunks) {
+		t.Error("Expected", content, chunks, "got", results[0])
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = pool.HashPaths(ctx, paths)
+	if err != context.Canceled {
+		t.Error("Expected canceled, got", err)
+	}
+}
+
+func TestHashPool_OnResult(t *testing.T) {
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	var paths []string
+	for i := 0; i < 20; i++ {
+		path := fmt.Sprintf("%s/file%d", root, i)
+		err := os.WriteFile(path, []byte(fmt.Sprint("content", i)), 0644)
+		if err != nil {
+			t.Fatal("Failed test setup", err)
+		}
+		paths = append(paths, path)
+	}
+	pool := CreateHashPool(4)
+	reported := make(map[int]HashResult)
+	pool.OnResult = func(index int, result HashResult) {
+		reported[index] = result
+	}
+	results, err := pool.HashPaths(context.Background(), paths)
+	if err != nil || len(reported) != len(paths) {
+		t.Fatal("Expected", len(paths), "reported results, got", len(reported), err)
+	}
+	for i, result := range results {
+		if reported[i] != result {
+			t.Error("Expected", result, "got", reported[i])
+		}
+	}
+	// results are reported before all paths are hashed
+	ctx, cancel := context.WithCancel(context.Background())
+	count := 0
+	pool.OnResult = func(index int, result HashResult) {
+		count++
+		cancel()
+	}
+	_, err = pool.HashPaths(ctx, paths)
+	if err != context.Canceled || count == 0 || count >= len(paths) {
+		t.Error("Expected canceled after the first result, got", count, err)
+	}
+}
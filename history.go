@@ -0,0 +1,508 @@
+package shared
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+HistoryRetention limits the revisions kept by a History. Zero values mean no
+limit.
+*/
+type HistoryRetention struct {
+	Count int           // maximal amount of revisions per object
+	Age   time.Duration // maximal time since a revision was archived
+	Size  int64         // maximal size of all revisions together
+}
+
+/*
+DefaultHistoryRetention is the HistoryRetention used by OpenHistory.
+*/
+var DefaultHistoryRetention = HistoryRetention{
+	Count: 10,
+	Age:   30 * 24 * time.Hour,
+	Size:  1024 * 1024 * 1024}
+
+/*
+Revision is an archived version of a file.
+*/
+type Revision struct {
+	Identification string
+	Number         int // increasing per object
+	Path           string
+	Version        Version
+	Content        string
+	Size           int64
+	Mode           os.FileMode `json:",omitempty"`
+	ModTime        time.Time   `json:",omitzero"`
+	Archived       time.Time
+	Operation      Operation // operation that replaced the revision
+}
+
+/*
+History is the archive of previous file contents of a Tinzenite directory. It is
+stored in LOCALDIR, so every peer keeps its own history. Revisions are stored
+below a directory per object identification, together with an index of them.
+All methods are safe for concurrent use.
+*/
+type History struct {
+	Retention HistoryRetention
+	root      string
+	mutex     sync.Mutex
+}
+
+/*
+OpenHistory returns the History of the Tinzenite directory at root using the
+DefaultHistoryRetention.
+*/
+func OpenHistory(root string) (*History, error) {
+	if !IsTinzenite(root) {
+		return nil, ErrNotTinzenite
+	}
+	return &History{Retention: DefaultHistoryRetention, root: root}, nil
+}
+
+/*
+Archive keeps the current content of the file described by obj before it is
+replaced or removed by op, for example before applying an UpdateMessage of
+another peer. Nothing is archived for directories, symlinks and content that is
+archived already. Returns the new revision, or nil if none was archived or it
+does not fit the retention.
+*/
+func (h *History) Archive(obj *ObjectInfo, op Operation) (*Revision, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.archive(obj, op, nil)
+}
+
+/*
+archive works like Archive but never prunes the revision protect. The mutex must
+be held.
+*/
+func (h *History) archive(obj *ObjectInfo, op Operation, protect *Revision) (*Revision, error) {
+	if obj.kind() != OkFile || !validRemovalName(obj.Identification) {
+		return nil, nil
+	}
+	revisions, err := h.load(obj.Identification)
+	if err != nil {
+		return nil, err
+	}
+	number := 1
+	if count := len(revisions); count > 0 {
+		if revisions[count-1].Content == obj.Content && obj.Content != "" {
+			return nil, nil
+		}
+		number = revisions[count-1].Number + 1
+	}
+	path := CreatePath(h.root, obj.Path).FullPath()
+	dir := h.objectPath(obj.Identification)
+	err = makeDirectoryMode(dir, Permissions.PrivateDir)
+	if err != nil {
+		return nil, err
+	}
+	rev := Revision{
+		Identification: obj.Identification,
+		Number:         number,
+		Path:           obj.Path,
+		Version:        obj.Version.Copy(),
+		Content:        obj.Content,
+		Mode:           obj.Mode,
+		ModTime:        obj.ModTime,
+		Archived:       time.Now(),
+		Operation:      op}
+	err = copyPayload(path, h.revisionPath(rev))
+	if err != nil {
+		return nil, err
+	}
+	// the model may be behind the file system, so describe what was archived
+	stat, err := FS.Stat(h.revisionPath(rev))
+	if err != nil {
+		return nil, err
+	}
+	rev.Size = stat.Size()
+	if matches, _ := HashMatches(h.revisionPath(rev), rev.Content); !matches {
+		rev.Content, err = ContentHashWith(h.revisionPath(rev), HashAlgorithm())
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = h.store(obj.Identification, append(revisions, rev))
+	if err != nil {
+		FS.Remove(h.revisionPath(rev))
+		return nil, err
+	}
+	err = h.prune(protect)
+	if err != nil {
+		return nil, err
+	}
+	revisions, err = h.load(obj.Identification)
+	if err != nil {
+		return nil, err
+	}
+	if !containsRevision(revisions, rev) {
+		// larger than the retention allows
+		return nil, nil
+	}
+	return &rev, nil
+}
+
+/*
+Revisions returns all archived revisions of the object at subpath, oldest
+first. Objects that have been moved are found by any of their paths.
+*/
+func (h *History) Revisions(subpath string) ([]Revision, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	all, err := h.all()
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]bool)
+	for _, rev := range all {
+		if rev.Path == subpath {
+			ids[rev.Identification] = true
+		}
+	}
+	var revisions []Revision
+	for _, rev := range all {
+		if ids[rev.Identification] {
+			revisions = append(revisions, rev)
+		}
+	}
+	return revisions, nil
+}
+
+/*
+Restore writes the content of the revision back to the file system and applies
+it to the model as a new modification of the local peer selfid, archiving the
+current content first. If the object has been removed in the meantime, it is
+recreated at the path of the revision; returns ErrParentMissing if its parent
+directory has been removed too. The file is put back as it was if the model can
+not be updated. Returns the message to send to other peers.
+*/
+func (h *History) Restore(model *Model, rev Revision, selfid string) (*UpdateMessage, error) {
+	// held until written so that the revision can not be pruned in between
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	revisions, err := h.load(rev.Identification)
+	if err != nil {
+		return nil, err
+	}
+	if !containsRevision(revisions, rev) {
+		return nil, ErrUntracked
+	}
+	for _, value := range revisions {
+		if value.Number == rev.Number {
+			rev = value
+		}
+	}
+	current, err := model.GetByID(rev.Identification)
+	var op Operation = OpModify
+	path := rev.Path
+	if err == nil {
+		path = current.Path
+		_, err = h.archive(current, OpModify, &rev)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		op = OpCreate
+		if _, err := model.Get(path); err == nil {
+			// another object took the place in the meantime
+			return nil, ErrObjectExists
+		}
+		if _, err := model.parentOf(path); err != nil {
+			return nil, ErrParentMissing
+		}
+	}
+	target := CreatePath(h.root, path).FullPath()
+	var saved string
+	if op == OpModify {
+		saved, err = h.save(target)
+		if err != nil {
+			return nil, err
+		}
+		defer FS.Remove(saved)
+	}
+	err = h.write(rev, path)
+	if err != nil {
+		if saved != "" {
+			// the file may have been replaced before the error
+			h.rollback(target, saved)
+		}
+		return nil, err
+	}
+	msg, err := h.apply(model, current, op, path, rev, selfid)
+	if err != nil {
+		h.rollback(target, saved)
+		return nil, err
+	}
+	return msg, nil
+}
+
+/*
+apply updates the model to the restored revision written to path.
+*/
+func (h *History) apply(model *Model, current *ObjectInfo, op Operation, path string, rev Revision, selfid string) (*UpdateMessage, error) {
+	var obj *ObjectInfo
+	var err error
+	if op == OpModify {
+		obj = current.shallowCopy()
+		stat, err := FS.Lstat(CreatePath(h.root, path).FullPath())
+		if err != nil {
+			return nil, err
+		}
+		err = obj.setMetadata(FS, CreatePath(h.root, path).FullPath(), stat)
+		if err != nil {
+			return nil, err
+		}
+		obj.Content = rev.Content
+		obj.Chunks = nil
+		obj.Version.Increase(selfid)
+	} else {
+		obj, err = CreateObjectInfo(h.root, path, selfid)
+		if err != nil {
+			return nil, err
+		}
+	}
+	msg := CreateUpdateMessage(op, *obj)
+	err = model.Apply(&msg)
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+/*
+save copies the file at path to TEMPDIR, keeping its mode and modification time,
+and returns the path of the copy.
+*/
+func (h *History) save(path string) (string, error) {
+	stat, err := FS.Lstat(path)
+	if err != nil {
+		return "", err
+	}
+	id, err := NewIdentifier()
+	if err != nil {
+		return "", err
+	}
+	saved := h.root + "/" + TINZENITEDIR + "/" + TEMPDIR + "/restore-" + id
+	err = copyFile(path, saved, stat.Mode().Perm())
+	if err == nil {
+		// the mode is limited by the umask when creating
+		err = FS.Chmod(saved, stat.Mode().Perm())
+	}
+	if err == nil {
+		err = FS.Chtimes(saved, stat.ModTime(), stat.ModTime())
+	}
+	if err != nil {
+		FS.Remove(saved)
+		return "", err
+	}
+	return saved, nil
+}
+
+/*
+rollback puts the file saved by save back to path, or removes the restored file
+if there was none.
+*/
+func (h *History) rollback(path, saved string) {
+	var err error
+	if saved == "" {
+		err = FS.Remove(path)
+	} else {
+		err = FS.Rename(saved, path)
+	}
+	if err != nil {
+		log.Println("History: rollback of", path, "failed:", err)
+	}
+}
+
+/*
+Prune removes all revisions beyond the retention.
+*/
+func (h *History) Prune() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.prune(nil)
+}
+
+/*
+write atomically replaces the file at subpath with the content of rev, staging
+it in TEMPDIR.
+*/
+func (h *History) write(rev Revision, subpath string) error {
+	id, err := NewIdentifier()
+	if err != nil {
+		return err
+	}
+	temp := h.root + "/" + TINZENITEDIR + "/" + TEMPDIR + "/restore-" + id
+	err = copyPayload(h.revisionPath(rev), temp)
+	if err != nil {
+		return err
+	}
+	// only removes anything if the rename below did not happen
+	defer FS.Remove(temp)
+	if matches, err := HashMatches(temp, rev.Content); err != nil || !matches {
+		if err == nil {
+			err = ErrContentMismatch
+		}
+		return err
+	}
+	mode := rev.Mode
+	if mode == 0 {
+		mode = Permissions.UserFile
+	}
+	err = FS.Chmod(temp, mode)
+	if err != nil {
+		return err
+	}
+	target := CreatePath(h.root, subpath).FullPath()
+	err = FS.Rename(temp, target)
+	if err != nil {
+		return err
+	}
+	dir, _ := splitFilePath(target)
+	return syncDirectory(dir)
+}
+
+/*
+prune applies the retention: the count and age per object, then the total size
+by removing the oldest revisions of all objects. The revision protect, if not
+nil, is always kept.
+*/
+func (h *History) prune(protect *Revision) error {
+	all, err := h.all()
+	if err != nil {
+		return err
+	}
+	keep := make(map[string][]Revision)
+	var kept []Revision
+	var size int64
+	full := false
+	// newest first, so that the count keeps the latest revisions
+	for i := len(all) - 1; i >= 0; i-- {
+		rev := all[i]
+		id := rev.Identification
+		protected := protect != nil && protect.Identification == id && protect.Number == rev.Number
+		full = full || (h.Retention.Size > 0 && size+rev.Size > h.Retention.Size)
+		if !protected && (full ||
+			(h.Retention.Count > 0 && len(keep[id]) >= h.Retention.Count) ||
+			(h.Retention.Age > 0 && time.Since(rev.Archived) > h.Retention.Age)) {
+			continue
+		}
+		size += rev.Size
+		keep[id] = append(keep[id], rev)
+		kept = append(kept, rev)
+	}
+	if len(kept) == len(all) {
+		return nil
+	}
+	changed := make(map[string]bool)
+	for _, rev := range all {
+		if !containsRevision(keep[rev.Identification], rev) {
+			changed[rev.Identification] = true
+			err := FS.Remove(h.revisionPath(rev))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	for id := range changed {
+		revisions := keep[id]
+		if len(revisions) == 0 {
+			err := FS.RemoveAll(h.objectPath(id))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		// keep was built newest first
+		sort.Slice(revisions, func(i, j int) bool {
+			return revisions[i].Number < revisions[j].Number
+		})
+		err := h.store(id, revisions)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+all returns the revisions of all objects, oldest first.
+*/
+func (h *History) all() ([]Revision, error) {
+	stats, err := FS.ReadDir(h.historyPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var all []Revision
+	for _, stat := range stats {
+		if !stat.IsDir() {
+			continue
+		}
+		revisions, err := h.load(stat.Name())
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, revisions...)
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Archived.Before(all[j].Archived)
+	})
+	return all, nil
+}
+
+/*
+load reads the index of the given object. A missing index means that no
+revisions exist.
+*/
+func (h *History) load(id string) ([]Revision, error) {
+	var revisions []Revision
+	err := loadWithBackup(h.objectPath(id)+"/"+HISTORYJSON, func(data []byte) error {
+		revisions = nil
+		return json.Unmarshal(data, &revisions)
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return revisions, err
+}
+
+func (h *History) store(id string, revisions []Revision) error {
+	data, err := json.MarshalIndent(revisions, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(h.objectPath(id)+"/"+HISTORYJSON, data, Permissions.PrivateFile, true)
+}
+
+func (h *History) historyPath() string {
+	return h.root + "/" + TINZENITEDIR + "/" + LOCALDIR + "/" + HISTORYDIR
+}
+
+func (h *History) objectPath(id string) string {
+	return h.historyPath() + "/" + id
+}
+
+func (h *History) revisionPath(rev Revision) string {
+	return h.objectPath(rev.Identification) + "/" + strconv.Itoa(rev.Number)
+}
+
+func containsRevision(revisions []Revision, rev Revision) bool {
+	for _, value := range revisions {
+		if value.Number == rev.Number {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,265 @@
+package shared
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHistory_Restore(t *testing.T) {
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	err := MakeTinzeniteDir(root)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	writeTestFiles(t, root, map[string]string{"file": "first"})
+	built, err := CreateBuilder(root, "self").Build(context.Background())
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	model, _ := CreateModel(built)
+	history, err := OpenHistory(root)
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	obj, _ := model.Get("file")
+	rev, err := history.Archive(obj, OpModify)
+	if err != nil || rev == nil || rev.Number != 1 || rev.Size != 5 {
+		t.Fatal("Expected first revision, got", rev, err)
+	}
+	again, err := history.Archive(obj, OpModify)
+	if again != nil || err != nil {
+		t.Error("Expected unchanged content not to be archived, got", again, err)
+	}
+	// a remote modification replaces the content
+	writeTestFiles(t, root, map[string]string{"file": "second"})
+	update, _ := CreateObjectInfo(root, "file", "other")
+	update.Identification = obj.Identification
+	update.Version = obj.Version.Copy()
+	update.Version.Increase("other")
+	msg := CreateUpdateMessage(OpModify, *update)
+	model.Apply(&msg)
+	restored, err := history.Restore(model, *rev, "self")
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	data, _ := os.ReadFile(root + "/file")
+	if string(data) != "first" {
+		t.Error("Expected", "first", "got", string(data))
+	}
+	obj, _ = model.Get("file")
+	if restored.Operation != OpModify || obj.Content != rev.Content || !obj.Version.Includes(update.Version) || obj.Version.Equal(update.Version) {
+		t.Error("Expected new modification with first content, got", restored.String())
+	}
+	// the overwritten content is archived as well
+	revisions, err := history.Revisions("file")
+	if err != nil || len(revisions) != 2 || revisions[1].Content != update.Content {
+		t.Error("Expected two revisions, got", revisions, err)
+	}
+	// restoring a removed object creates it again
+	model.Remove("file")
+	os.Remove(root + "/file")
+	restored, err = history.Restore(model, revisions[1], "self")
+	if err != nil || restored.Operation != OpCreate {
+		t.Fatal("Expected creation, got", restored, err)
+	}
+	data, _ = os.ReadFile(root + "/file")
+	if string(data) != "second" {
+		t.Error("Expected", "second", "got", string(data))
+	}
+	if _, err := history.Restore(model, Revision{Identification: "unknown", Number: 1}, "self"); err != ErrUntracked {
+		t.Error("Expected", ErrUntracked, "got", err)
+	}
+}
+
+func TestHistory_Prune(t *testing.T) {
+	type testPrune struct {
+		retention HistoryRetention
+		want      []int // numbers of the kept revisions of a
+	}
+	tests := []testPrune{
+		{HistoryRetention{}, []int{1, 2, 3, 4}},
+		{HistoryRetention{Count: 2}, []int{3, 4}},
+		{HistoryRetention{Size: 9}, []int{3, 4}},
+		{HistoryRetention{Age: time.Nanosecond}, nil}}
+	for i, test := range tests {
+		root := makeTempDir("", "root")
+		defer removeTemp(root)
+		err := MakeTinzeniteDir(root)
+		if err != nil {
+			t.Fatal("Failed test setup", err)
+		}
+		history, _ := OpenHistory(root)
+		history.Retention = HistoryRetention{}
+		for _, content := range []string{"aaaa", "bbbb", "cccc", "dddd"} {
+			writeTestFiles(t, root, map[string]string{"a": content})
+			obj, _ := CreateObjectInfo(root, "a", "self")
+			obj.Identification = "a"
+			_, err := history.Archive(obj, OpModify)
+			if err != nil {
+				t.Fatal("Expected no error, got", err)
+			}
+		}
+		history.Retention = test.retention
+		time.Sleep(time.Millisecond)
+		err = history.Prune()
+		if err != nil {
+			t.Error(i, "Expected no error, got", err)
+		}
+		revisions, _ := history.Revisions("a")
+		if len(revisions) != len(test.want) {
+			t.Fatal(i, "Expected", test.want, "got", revisions)
+		}
+		for j, rev := range revisions {
+			if rev.Number != test.want[j] {
+				t.Error(i, "Expected", test.want, "got", revisions)
+			}
+			if _, err := os.Stat(history.revisionPath(rev)); err != nil {
+				t.Error(i, "Expected revision content, got", err)
+			}
+		}
+		if test.want == nil {
+			if _, err := os.Stat(history.objectPath("a")); !os.IsNotExist(err) {
+				t.Error(i, "Expected empty history to be removed")
+			}
+		}
+	}
+}
+
+func TestHistory_RestoreFull(t *testing.T) {
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	err := MakeTinzeniteDir(root)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	writeTestFiles(t, root, map[string]string{"file": "0"})
+	built, err := CreateBuilder(root, "self").Build(context.Background())
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	model, _ := CreateModel(built)
+	history, _ := OpenHistory(root)
+	history.Retention = HistoryRetention{Count: 3}
+	obj, _ := model.Get("file")
+	for _, content := range []string{"1", "2", "3", "4"} {
+		obj.Content, _ = ContentHash(root + "/file")
+		history.Archive(obj, OpModify)
+		writeTestFiles(t, root, map[string]string{"file": content})
+	}
+	obj.Content, _ = ContentHash(root + "/file")
+	revisions, _ := history.Revisions("file")
+	if len(revisions) != 3 || revisions[0].Number != 2 {
+		t.Fatal("Expected full history starting at 2, got", revisions)
+	}
+	// archiving the current content must not prune the oldest revision
+	_, err = history.Restore(model, revisions[0], "self")
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	data, _ := os.ReadFile(root + "/file")
+	if string(data) != "1" {
+		t.Error("Expected", "1", "got", string(data))
+	}
+	// a revision larger than the retention is not kept
+	history.Retention = HistoryRetention{Size: 1}
+	writeTestFiles(t, root, map[string]string{"file": "large"})
+	obj, _ = model.Get("file")
+	rev, err := history.Archive(obj, OpModify)
+	if rev != nil || err != nil {
+		t.Error("Expected no revision, got", rev, err)
+	}
+}
+
+func TestHistory_RestoreFailure(t *testing.T) {
+	defer func(old FileSystem) { FS = old }(FS)
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	err := MakeTinzeniteDir(root)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	writeTestFiles(t, root, map[string]string{"file": "first", "dir/sub": "sub"})
+	built, err := CreateBuilder(root, "self").Build(context.Background())
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	history, _ := OpenHistory(root)
+	model, _ := CreateModel(built.Copy())
+	obj, _ := model.Get("file")
+	rev, _ := history.Archive(obj, OpModify)
+	sub, _ := model.Get("dir/sub")
+	subRev, _ := history.Archive(sub, OpRemove)
+	if rev == nil || subRev == nil {
+		t.Fatal("Failed test setup")
+	}
+	// a removed object can not be restored without its parent
+	model.Remove("dir/sub")
+	model.Remove("dir")
+	os.RemoveAll(root + "/dir")
+	_, err = history.Restore(model, *subRev, "self")
+	if err != ErrParentMissing {
+		t.Error("Expected", ErrParentMissing, "got", err)
+	}
+	writeTestFiles(t, root, map[string]string{"file": "second"})
+	changed, _ := ContentHash(root + "/file")
+	setup := func() *Model {
+		writeTestFiles(t, root, map[string]string{"file": "second"})
+		model, _ := CreateModel(built.Copy())
+		obj, _ := model.Get("file")
+		obj.Content = changed
+		return model
+	}
+	// count the operations of a successful run first
+	counter := CreateFaultyFileSystem(OSFileSystem{}, 0)
+	model = setup()
+	FS = counter
+	_, err = history.Restore(model, *rev, "self")
+	FS = OSFileSystem{}
+	operations := counter.Operations()
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	// any failure must leave the file and the model as they were
+	for failAt := 1; failAt <= operations; failAt++ {
+		model = setup()
+		FS = CreateFaultyFileSystem(OSFileSystem{}, failAt)
+		_, err := history.Restore(model, *rev, "self")
+		FS = OSFileSystem{}
+		if err == nil {
+			continue
+		}
+		data, _ := os.ReadFile(root + "/file")
+		obj, _ := model.Get("file")
+		if string(data) != "second" || obj.Content != changed {
+			t.Error("Expected unchanged file after failure of operation", failAt, "got", string(data), obj.Content)
+		}
+	}
+}
+
+func TestHistory_Revisions(t *testing.T) {
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	err := MakeTinzeniteDir(root)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	history, _ := OpenHistory(root)
+	writeTestFiles(t, root, map[string]string{"old": "1"})
+	obj, _ := CreateObjectInfo(root, "old", "self")
+	history.Archive(obj, OpModify)
+	// moved, then modified
+	os.Rename(root+"/old", root+"/new")
+	writeTestFiles(t, root, map[string]string{"new": "2"})
+	obj.Path = "new"
+	obj.Content, _ = ContentHash(root + "/new")
+	history.Archive(obj, OpModify)
+	for _, path := range []string{"old", "new"} {
+		revisions, err := history.Revisions(path)
+		if err != nil || len(revisions) != 2 {
+			t.Error("Expected both revisions for", path, "got", revisions, err)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+/*
+LockInfo identifies the process holding an InstanceLock.
+*/
+type LockInfo struct {
+	PID      int
+	Hostname string
+	Acquired time.Time
+}
+
+/*
+LockedError is returned if a directory is already locked by another instance.
+It matches ErrLocked with errors.Is.
+*/
+type LockedError struct {
+	Holder LockInfo
+}
+
+func (e *LockedError) Error() string {
+	if e.Holder.PID == 0 {
+		return ErrLocked.Error()
+	}
+	return fmt.Sprintf("%s: process %d on %s since %s", ErrLocked, e.Holder.PID,
+		e.Holder.Hostname, e.Holder.Acquired.Format(time.RFC3339))
+}
+
+/*
+Unwrap allows errors.Is(err, ErrLocked).
+*/
+func (e *LockedError) Unwrap() error {
+	return ErrLocked
+}
+
+/*
+InstanceLock makes sure that only one instance works on a Tinzenite or encrypted
+directory at a time. The lock is an advisory file lock on LOCKFILE in LOCALDIR,
+so it is released by the operating system if the process dies. On file systems
+without file locks the PID and hostname stored in the file are used instead,
+and a lock is considered stale once its process is gone. The same is done on
+file systems not backed by the operating system, which are private to the
+process anyway.
+*/
+type InstanceLock struct {
+	file   File
+	locked bool // whether a file lock is held
+}
+
+/*
+AcquireInstanceLock locks the directory at root. Returns a *LockedError naming
+the holder if another instance has locked it.
+*/
+func AcquireInstanceLock(root string) (*InstanceLock, error) {
+	kind := DetectDirKind(root)
+	if kind == DkNone {
+		return nil, ErrNotTinzenite
+	}
+	path := layoutBase(root, kind) + "/" + LOCALDIR + "/" + LOCKFILE
+	file, err := FS.OpenFile(path, os.O_RDWR|os.O_CREATE, Permissions.PrivateFile)
+	if err != nil {
+		return nil, err
+	}
+	lock := &InstanceLock{file: file}
+	err = lockFile(file, false, false)
+	switch err {
+	case nil:
+		lock.locked = true
+	case errLockHeld:
+		holder, _ := readLockInfo(file)
+		file.Close()
+		return nil, &LockedError{Holder: holder}
+	case ErrUnsupported:
+		holder, err := readLockInfo(file)
+		if err == nil && !holder.stale() {
+			file.Close()
+			return nil, &LockedError{Holder: holder}
+		}
+	default:
+		file.Close()
+		return nil, err
+	}
+	err = lock.write()
+	if err != nil {
+		lock.Release()
+		return nil, err
+	}
+	return lock, nil
+}
+
+/*
+ReadInstanceLock returns the holder of the lock of the directory at root. The
+information may be stale if the holder crashed on a file system without file
+locks.
+*/
+func ReadInstanceLock(root string) (LockInfo, error) {
+	kind := DetectDirKind(root)
+	if kind == DkNone {
+		return LockInfo{}, ErrNotTinzenite
+	}
+	file, err := FS.Open(layoutBase(root, kind) + "/" + LOCALDIR + "/" + LOCKFILE)
+	if err != nil {
+		return LockInfo{}, err
+	}
+	defer file.Close()
+	return readLockInfo(file)
+}
+
+/*
+Release unlocks the directory.
+*/
+func (l *InstanceLock) Release() error {
+	if l.file == nil {
+		return nil
+	}
+	// an empty file marks the lock as free without file locks
+	err := l.file.Truncate(0)
+	if l.locked {
+		unlockFile(l.file)
+	}
+	closeErr := l.file.Close()
+	l.file = nil
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+/*
+write stores the information of this process in the lock file.
+*/
+func (l *InstanceLock) write() error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(&LockInfo{PID: os.Getpid(), Hostname: hostname, Acquired: time.Now()})
+	if err != nil {
+		return err
+	}
+	err = l.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.WriteAt(data, 0)
+	if err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+/*
+readLockInfo reads the holder from the lock file. Returns an error if the file
+is empty, meaning that the lock is free.
+*/
+func readLockInfo(file File) (LockInfo, error) {
+	info := LockInfo{}
+	stat, err := file.Stat()
+	if err != nil {
+		return info, err
+	}
+	data := make([]byte, stat.Size())
+	_, err = file.ReadAt(data, 0)
+	if err != nil {
+		return info, err
+	}
+	err = json.Unmarshal(data, &info)
+	return info, err
+}
+
+/*
+stale returns whether the holder is known to be gone. Processes on other hosts
+can not be checked and are never stale.
+*/
+func (i LockInfo) stale() bool {
+	hostname, err := os.Hostname()
+	if err != nil || hostname != i.Hostname {
+		return false
+	}
+	// our own PID means that this process already holds the lock
+	return i.PID != os.Getpid() && !processAlive(i.PID)
+}
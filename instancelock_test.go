@@ -0,0 +1,103 @@
+package shared
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func Test_AcquireInstanceLock(t *testing.T) {
+	for _, kind := range []DirKind{DkTinzenite, DkEncrypted} {
+		root := makeTempDir("", "root")
+		defer removeTemp(root)
+		var err error
+		if kind == DkTinzenite {
+			err = MakeTinzeniteDir(root)
+		} else {
+			err = MakeEncryptedDir(root)
+		}
+		if err != nil {
+			t.Fatal("Failed test setup", err)
+		}
+		lock, err := AcquireInstanceLock(root)
+		if err != nil {
+			t.Fatal("Expected no error, got", err)
+		}
+		_, err = AcquireInstanceLock(root)
+		locked, ok := err.(*LockedError)
+		if !ok || !errors.Is(err, ErrLocked) || locked.Holder.PID != os.Getpid() {
+			t.Error("Expected lock held by this process, got", err)
+		}
+		holder, err := ReadInstanceLock(root)
+		hostname, _ := os.Hostname()
+		if err != nil || holder.Hostname != hostname {
+			t.Error("Expected holder on", hostname, "got", holder, err)
+		}
+		err = lock.Release()
+		if err != nil {
+			t.Error("Expected no error, got", err)
+		}
+		lock, err = AcquireInstanceLock(root)
+		if err != nil {
+			t.Fatal("Expected released lock to be free, got", err)
+		}
+		lock.Release()
+	}
+	other := makeTempDir("", "other")
+	defer removeTemp(other)
+	_, err := AcquireInstanceLock(other)
+	if err != ErrNotTinzenite {
+		t.Error("Expected", ErrNotTinzenite, "got", err)
+	}
+}
+
+func Test_AcquireInstanceLockFileSystem(t *testing.T) {
+	defer func(old FileSystem) { FS = old }(FS)
+	FS = CreateMemFileSystem()
+	err := MakeTinzeniteDir("/root")
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	// without file locks the stored holder decides
+	lock, err := AcquireInstanceLock("/root")
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	_, err = AcquireInstanceLock("/root")
+	if !errors.Is(err, ErrLocked) {
+		t.Error("Expected", ErrLocked, "got", err)
+	}
+	lock.Release()
+	lock, err = AcquireInstanceLock("/root")
+	if err != nil {
+		t.Fatal("Expected released lock to be free, got", err)
+	}
+	lock.Release()
+}
+
+func TestLockInfo_stale(t *testing.T) {
+	hostname, _ := os.Hostname()
+	// the PID of a finished process is free
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	err := cmd.Run()
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	dead := cmd.Process.Pid
+	type testStale struct {
+		info LockInfo
+		want bool
+	}
+	tests := []testStale{
+		{LockInfo{PID: dead, Hostname: hostname}, true},
+		{LockInfo{PID: os.Getppid(), Hostname: hostname}, false},
+		{LockInfo{PID: os.Getpid(), Hostname: hostname}, false},
+		{LockInfo{PID: dead, Hostname: "other-" + hostname}, false},
+	}
+	for _, test := range tests {
+		if got := test.info.stale(); got != test.want {
+			t.Error("Expected", test.want, "for", test.info, "got", got)
+		}
+	}
+}
@@ -0,0 +1,423 @@
+package shared
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+)
+
+/*
+MigrationFunc upgrades the directory at root by exactly one layout version.
+*/
+type MigrationFunc func(root string) error
+
+/*
+layoutFile is the content of the LAYOUTJSON file.
+*/
+type layoutFile struct {
+	Version int
+	Kind    DirKind
+}
+
+/*
+migrationStep upgrades from version From to From+1.
+*/
+type migrationStep struct {
+	From  int
+	Apply MigrationFunc
+}
+
+var (
+	migrationMutex sync.RWMutex
+	migrations     = make(map[DirKind][]migrationStep)
+)
+
+// the built in migrations are registered here to avoid an initialization cycle
+func init() {
+	RegisterMigration(DkTinzenite, 0, migrateTinzenite0)
+	RegisterMigration(DkEncrypted, 0, migrateEncrypted0)
+}
+
+/*
+RegisterMigration adds the step upgrading directories of the given kind from
+layout version from to from+1. Steps must be registered without gaps and only
+once per version.
+*/
+func RegisterMigration(kind DirKind, from int, migration MigrationFunc) error {
+	if kind == DkNone || migration == nil {
+		return ErrIllegalParameters
+	}
+	migrationMutex.Lock()
+	defer migrationMutex.Unlock()
+	if from != len(migrations[kind]) {
+		return ErrIllegalParameters
+	}
+	migrations[kind] = append(migrations[kind], migrationStep{From: from, Apply: migration})
+	return nil
+}
+
+/*
+LayoutVersion returns the current layout version for directories of the given
+kind, which is the version reached once all registered migrations are applied.
+*/
+func LayoutVersion(kind DirKind) int {
+	migrationMutex.RLock()
+	defer migrationMutex.RUnlock()
+	return len(migrations[kind])
+}
+
+/*
+DetectDirKind returns what kind of Tinzenite directory root is.
+*/
+func DetectDirKind(root string) DirKind {
+	if IsTinzenite(root) {
+		return DkTinzenite
+	}
+	if IsEncrypted(root) {
+		return DkEncrypted
+	}
+	return DkNone
+}
+
+/*
+ReadLayout returns the layout version and kind of the directory at root.
+Directories created before layouts were versioned have version 0.
+*/
+func ReadLayout(root string) (int, DirKind, error) {
+	kind := DetectDirKind(root)
+	if kind == DkNone {
+		return 0, DkNone, ErrNotTinzenite
+	}
+	layout := &layoutFile{}
+	err := loadWithBackup(layoutPath(root, kind), func(data []byte) error {
+		return json.Unmarshal(data, layout)
+	})
+	if os.IsNotExist(err) {
+		return 0, kind, nil
+	}
+	if err != nil {
+		return 0, kind, err
+	}
+	return layout.Version, kind, nil
+}
+
+/*
+Migrate upgrades the Tinzenite or encrypted directory at root to the current
+layout version. The Tinzenite data is backed up before the first step and
+restored if any step fails, so that the directory is either completely migrated
+or left as it was. An interrupted migration is rolled back on the next call.
+For encrypted roots only LOCALDIR and ORGDIR are backed up; migrations must not
+modify stored objects. The InstanceLock is held during the whole migration;
+returns a *LockedError if another instance uses the directory.
+*/
+func Migrate(root string) error {
+	kind := DetectDirKind(root)
+	if kind == DkNone {
+		return ErrNotTinzenite
+	}
+	lock, err := AcquireInstanceLock(root)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	return migrate(root, kind)
+}
+
+/*
+migrate does the work of Migrate; the InstanceLock must be held.
+*/
+func migrate(root string, kind DirKind) error {
+	base := layoutBase(root, kind)
+	backup := base + "/" + TEMPDIR + "/" + MIGRATIONDIR
+	exists, _ := DirectoryExists(backup)
+	if exists {
+		log.Println("Migrate: rolling back interrupted migration of", root)
+		err := rollbackMigration(base, backup)
+		if err != nil {
+			return err
+		}
+	}
+	version, _, err := ReadLayout(root)
+	if err != nil {
+		return err
+	}
+	migrationMutex.RLock()
+	steps := migrations[kind]
+	migrationMutex.RUnlock()
+	if version > len(steps) {
+		// created by a newer version that we can not understand
+		return ErrUnsupported
+	}
+	if version == len(steps) {
+		return nil
+	}
+	err = backupMigration(base, backup, kind)
+	if err != nil {
+		FS.RemoveAll(backup)
+		return err
+	}
+	for _, step := range steps[version:] {
+		err = step.Apply(root)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writeLayout(root, kind, len(steps))
+	}
+	if err != nil {
+		if rollbackErr := rollbackMigration(base, backup); rollbackErr != nil {
+			log.Println("Migrate: rollback failed:", rollbackErr)
+		}
+	} else {
+		err = FS.RemoveAll(backup)
+	}
+	if kind == DkEncrypted {
+		// encrypted roots have no TEMPDIR of their own, fails if still in use
+		FS.Remove(base + "/" + TEMPDIR)
+	}
+	return err
+}
+
+/*
+writeLayout stores the layout version of the directory at root.
+*/
+func writeLayout(root string, kind DirKind, version int) error {
+	data, err := json.MarshalIndent(&layoutFile{Version: version, Kind: kind}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(layoutPath(root, kind), data, Permissions.PrivateFile, true)
+}
+
+/*
+migrationKept lists the entries of LOCALDIR that are neither backed up nor
+restored by a rollback, but kept as they are: the history may be large, the
+hash cache can be rebuilt and the lock file is held during the migration.
+Migrations must not modify them.
+*/
+var migrationKept = []string{HISTORYDIR, HASHCACHEJSON, HASHCACHEJSON + BACKUPENDING, LOCKFILE}
+
+/*
+backupMigration copies the Tinzenite data of base to backup, except for the
+entries of migrationKept. The names of all entries of base are stored too, so
+that entries created by a failed migration can be removed.
+*/
+func backupMigration(base, backup string, kind DirKind) error {
+	stats, err := FS.ReadDir(base)
+	if err != nil {
+		return err
+	}
+	var entries []string
+	for _, stat := range stats {
+		entries = append(entries, stat.Name())
+	}
+	err = makeDirectoryMode(backup, Permissions.PrivateDir)
+	if err != nil {
+		return err
+	}
+	for _, name := range migrationEntries(entries, kind) {
+		var skip []string
+		if name == LOCALDIR {
+			skip = migrationKept
+		}
+		err := copyTree(base+"/"+name, backup+"/"+name, skip)
+		if err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	// written last: a backup without it is incomplete and never restored
+	return WriteFileAtomic(backup+"/"+MIGRATIONJSON, data, Permissions.PrivateFile, false)
+}
+
+/*
+rollbackMigration restores the state saved by backupMigration and removes the
+backup. An incomplete backup means that nothing was changed yet and is simply
+removed.
+*/
+func rollbackMigration(base, backup string) error {
+	var entries []string
+	err := loadWithBackup(backup+"/"+MIGRATIONJSON, func(data []byte) error {
+		return json.Unmarshal(data, &entries)
+	})
+	if os.IsNotExist(err) {
+		return FS.RemoveAll(backup)
+	}
+	if err != nil {
+		return err
+	}
+	stats, err := FS.ReadDir(base)
+	if err != nil {
+		return err
+	}
+	for _, stat := range stats {
+		if stat.Name() != TEMPDIR && !Contains(entries, stat.Name()) {
+			err := FS.RemoveAll(base + "/" + stat.Name())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	saved, err := FS.ReadDir(backup)
+	if err != nil {
+		return err
+	}
+	for _, stat := range saved {
+		if stat.Name() == MIGRATIONJSON {
+			continue
+		}
+		if stat.Name() == LOCALDIR {
+			err := keepMigrationEntries(base+"/"+LOCALDIR, backup+"/"+LOCALDIR)
+			if err != nil {
+				return err
+			}
+		}
+		err := FS.RemoveAll(base + "/" + stat.Name())
+		if err != nil {
+			return err
+		}
+		err = FS.Rename(backup+"/"+stat.Name(), base+"/"+stat.Name())
+		if err != nil {
+			return err
+		}
+	}
+	return FS.RemoveAll(backup)
+}
+
+/*
+keepMigrationEntries moves the entries of migrationKept from the current LOCALDIR
+into the one about to be restored.
+*/
+func keepMigrationEntries(current, restored string) error {
+	for _, name := range migrationKept {
+		err := FS.Rename(current+"/"+name, restored+"/"+name)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+migrationEntries returns the entries of the base directory that are backed up.
+Transfers and temporary data are never touched by migrations.
+*/
+func migrationEntries(entries []string, kind DirKind) []string {
+	var selected []string
+	for _, name := range entries {
+		switch {
+		case kind == DkEncrypted && name != LOCALDIR && name != ORGDIR:
+		case name == TEMPDIR || name == RECEIVINGDIR || name == SENDINGDIR:
+		default:
+			selected = append(selected, name)
+		}
+	}
+	sort.Strings(selected)
+	return selected
+}
+
+/*
+copyTree copies the file or directory at from to to, keeping the modes.
+Symbolic links and the direct children of from named in skip are skipped.
+*/
+func copyTree(from, to string, skip []string) error {
+	stat, err := FS.Lstat(from)
+	if err != nil {
+		return err
+	}
+	if stat.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	if !stat.IsDir() {
+		return copyFile(from, to, stat.Mode().Perm())
+	}
+	err = FS.Mkdir(to, stat.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	stats, err := FS.ReadDir(from)
+	if err != nil {
+		return err
+	}
+	for _, child := range stats {
+		if Contains(skip, child.Name()) {
+			continue
+		}
+		err := copyTree(from+"/"+child.Name(), to+"/"+child.Name(), nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+copyFile streams the file at from to a new file at to, so that large files are
+never read into memory completely.
+*/
+func copyFile(from, to string, perm os.FileMode) error {
+	source, err := FS.Open(from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	target, err := FS.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(target, source)
+	if err == nil {
+		err = target.Sync()
+	}
+	closeErr := target.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+/*
+layoutBase returns the directory containing the Tinzenite data.
+*/
+func layoutBase(root string, kind DirKind) string {
+	if kind == DkEncrypted {
+		return root
+	}
+	return root + "/" + TINZENITEDIR
+}
+
+func layoutPath(root string, kind DirKind) string {
+	return layoutBase(root, kind) + "/" + LOCALDIR + "/" + LAYOUTJSON
+}
+
+/*
+migrateTinzenite0 brings directories of older versions to version 1 by creating
+all missing directories and files and tightening the permissions.
+*/
+func migrateTinzenite0(root string) error {
+	err := MakeTinzeniteDir(root)
+	if err != nil {
+		return err
+	}
+	_, err = RepairPermissions(root)
+	return err
+}
+
+/*
+migrateEncrypted0 works like migrateTinzenite0 for encrypted roots.
+*/
+func migrateEncrypted0(root string) error {
+	err := MakeEncryptedDir(root)
+	if err != nil {
+		return err
+	}
+	_, err = RepairPermissions(root)
+	return err
+}
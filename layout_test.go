@@ -0,0 +1,179 @@
+package shared
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func Test_Migrate(t *testing.T) {
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	err := MakeTinzeniteDir(root)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	version, kind, err := ReadLayout(root)
+	if err != nil || version != LayoutVersion(DkTinzenite) || kind != DkTinzenite {
+		t.Error("Expected current layout for new directory, got", version, kind, err)
+	}
+	// simulate a directory of an older version
+	base := root + "/" + TINZENITEDIR
+	os.Remove(base + "/" + LOCALDIR + "/" + LAYOUTJSON)
+	os.Remove(base + "/" + LOCALDIR + "/" + LAYOUTJSON + BACKUPENDING)
+	os.RemoveAll(base + "/" + SENDINGDIR)
+	os.Chmod(base+"/"+LOCALDIR, 0777)
+	version, _, err = ReadLayout(root)
+	if err != nil || version != 0 {
+		t.Error("Expected version 0, got", version, err)
+	}
+	err = Migrate(root)
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	version, _, _ = ReadLayout(root)
+	if version != LayoutVersion(DkTinzenite) {
+		t.Error("Expected migrated version, got", version)
+	}
+	if exists, _ := DirectoryExists(base + "/" + SENDINGDIR); !exists {
+		t.Error("Expected missing directory to be created")
+	}
+	if stat, _ := os.Stat(base + "/" + LOCALDIR); stat.Mode().Perm() != 0700 {
+		t.Error("Expected permissions to be repaired, got", stat.Mode().Perm())
+	}
+	if exists, _ := DirectoryExists(base + "/" + TEMPDIR + "/" + MIGRATIONDIR); exists {
+		t.Error("Expected backup to be removed")
+	}
+	// nothing to do
+	err = Migrate(root)
+	if err != nil {
+		t.Error("Expected no error, got", err)
+	}
+	// never while another instance uses the directory
+	lock, err := AcquireInstanceLock(root)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	err = Migrate(root)
+	if !errors.Is(err, ErrLocked) {
+		t.Error("Expected", ErrLocked, "got", err)
+	}
+	_, err = Validate(root, true)
+	if !errors.Is(err, ErrLocked) {
+		t.Error("Expected", ErrLocked, "got", err)
+	}
+	lock.Release()
+	// directories of newer versions are not touched
+	writeLayout(root, DkTinzenite, LayoutVersion(DkTinzenite)+1)
+	err = Migrate(root)
+	if err != ErrUnsupported {
+		t.Error("Expected", ErrUnsupported, "got", err)
+	}
+	_, _, err = ReadLayout(makeTempDir(root, "other"))
+	if err != ErrNotTinzenite {
+		t.Error("Expected", ErrNotTinzenite, "got", err)
+	}
+}
+
+func Test_MigrateRollback(t *testing.T) {
+	defer func(old []migrationStep) { migrations[DkTinzenite] = old }(migrations[DkTinzenite])
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	err := MakeTinzeniteDir(root)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	base := root + "/" + TINZENITEDIR
+	os.WriteFile(base+"/"+ORGDIR+"/data", []byte("original"), 0640)
+	// the history is kept in place instead of being copied
+	history := base + "/" + LOCALDIR + "/" + HISTORYDIR
+	os.Mkdir(history, 0700)
+	os.WriteFile(history+"/revision", []byte("revision"), 0600)
+	backedUp := false
+	failure := errors.New("failed step")
+	err = RegisterMigration(DkTinzenite, LayoutVersion(DkTinzenite), func(root string) error {
+		backedUp, _ = DirectoryExists(base + "/" + TEMPDIR + "/" + MIGRATIONDIR + "/" + LOCALDIR + "/" + HISTORYDIR)
+		os.WriteFile(base+"/"+ORGDIR+"/data", []byte("modified"), 0640)
+		os.RemoveAll(base + "/" + REMOVEDIR)
+		os.Mkdir(base+"/new", 0700)
+		return failure
+	})
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	err = RegisterMigration(DkTinzenite, 0, migrateTinzenite0)
+	if err != ErrIllegalParameters {
+		t.Error("Expected duplicate step to fail, got", err)
+	}
+	check := func() {
+		data, _ := os.ReadFile(base + "/" + ORGDIR + "/data")
+		if string(data) != "original" {
+			t.Error("Expected original data, got", string(data))
+		}
+		if exists, _ := DirectoryExists(base + "/" + REMOVEDIR); !exists {
+			t.Error("Expected removed directory to be restored")
+		}
+		if exists, _ := DirectoryExists(base + "/new"); exists {
+			t.Error("Expected created directory to be removed")
+		}
+		version, _, _ := ReadLayout(root)
+		if version != LayoutVersion(DkTinzenite)-1 {
+			t.Error("Expected old version, got", version)
+		}
+		if data, _ := os.ReadFile(history + "/revision"); string(data) != "revision" {
+			t.Error("Expected history to be kept")
+		}
+	}
+	err = Migrate(root)
+	if err != failure {
+		t.Error("Expected", failure, "got", err)
+	}
+	if backedUp {
+		t.Error("Expected history not to be backed up")
+	}
+	check()
+	// simulate a crash during the migration
+	backup := base + "/" + TEMPDIR + "/" + MIGRATIONDIR
+	err = backupMigration(base, backup, DkTinzenite)
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	os.WriteFile(base+"/"+ORGDIR+"/data", []byte("modified"), 0640)
+	os.RemoveAll(base + "/" + REMOVEDIR)
+	os.Mkdir(base+"/new", 0700)
+	// the failing step is gone after the restart
+	migrations[DkTinzenite] = migrations[DkTinzenite][:1]
+	err = Migrate(root)
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	data, _ := os.ReadFile(base + "/" + ORGDIR + "/data")
+	if exists, _ := DirectoryExists(base + "/new"); string(data) != "original" || exists {
+		t.Error("Expected interrupted migration to be rolled back")
+	}
+}
+
+func Test_MigrateEncrypted(t *testing.T) {
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	err := MakeEncryptedDir(root)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	os.Remove(root + "/" + LOCALDIR + "/" + LAYOUTJSON)
+	os.RemoveAll(root + "/" + SENDINGDIR)
+	err = Migrate(root)
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	version, kind, _ := ReadLayout(root)
+	if version != LayoutVersion(DkEncrypted) || kind != DkEncrypted {
+		t.Error("Expected migrated encrypted layout, got", version, kind)
+	}
+	if exists, _ := DirectoryExists(root + "/" + SENDINGDIR); !exists {
+		t.Error("Expected missing directory to be created")
+	}
+	if exists, _ := DirectoryExists(root + "/" + TEMPDIR); exists {
+		t.Error("Expected no temporary directory to be left")
+	}
+}
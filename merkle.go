@@ -0,0 +1,147 @@
+package shared
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strconv"
+)
+
+/*
+UpdateHashes computes the SubtreeHash of every directory whose hash is missing
+and returns the hash of the object. A directory hash is derived from the name,
+version and content of all sub objects, so two directories with equal hashes
+contain the same tree.
+
+Only directories without a hash are visited: to update the hashes after a
+change it is enough to clear the SubtreeHash of the changed directory and all
+of its parents, which the Model does automatically.
+*/
+func (o *ObjectInfo) UpdateHashes() string {
+	if !o.Directory {
+		return ""
+	}
+	if o.SubtreeHash != "" {
+		return o.SubtreeHash
+	}
+	children := o.Objects
+	if !sort.IsSorted(byName(children)) {
+		children = append([]*ObjectInfo{}, children...)
+		sort.Sort(byName(children))
+	}
+	hash := sha256.New()
+	for _, child := range children {
+		child.UpdateHashes()
+		hash.Write([]byte(child.entryHash()))
+	}
+	o.SubtreeHash = hex.EncodeToString(hash.Sum(nil))
+	return o.SubtreeHash
+}
+
+/*
+entryHash is the hash of the object as seen from its parent directory. It
+covers the properties of the object itself and, for directories, the subtree.
+Modification times are not included as they differ between peers.
+*/
+func (o *ObjectInfo) entryHash() string {
+	return o.entryHashWith(o.Content)
+}
+
+/*
+entryHashWith works like entryHash but uses the given content.
+*/
+func (o *ObjectInfo) entryHashWith(content string) string {
+	hash := sha256.New()
+	for _, value := range []string{strconv.FormatBool(o.Directory), strconv.FormatBool(o.Shadow),
+		o.kind().String(), o.Mode.String(), o.Target,
+		o.Name, o.Version.String(), content, o.SubtreeHash} {
+		// length prefix so that the values can not be shifted into each other
+		hash.Write([]byte(strconv.Itoa(len(value)) + ":" + value))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+/*
+Summary returns a copy of the object that only contains the sub objects up to
+the given depth. Deeper directories keep their SubtreeHash, so the summary can
+be compared with CompareHashes without sending the full tree. Hashes must be up
+to date.
+*/
+func (o *ObjectInfo) Summary(depth int) *ObjectInfo {
+	obj := o.shallowCopy()
+	if depth <= 0 {
+		return obj
+	}
+	for _, child := range o.Objects {
+		obj.Objects = append(obj.Objects, child.Summary(depth-1))
+	}
+	return obj
+}
+
+/*
+CompareHashes returns the paths at which the two trees differ. Only directories
+with differing hashes are descended into, so equal subtrees cost nothing. If a
+directory differs but one side has no sub objects for it, for example in a
+Summary, the directory path itself is returned. The hashes of both trees must be
+up to date. Content hashed with different algorithms can not be compared, so
+such files are equal if everything else is; the directories containing them
+always differ though and are descended into until the hashes are upgraded.
+*/
+func CompareHashes(local, remote *ObjectInfo) []string {
+	var paths []string
+	compareHashes(local, remote, &paths)
+	return SortString(paths)
+}
+
+func compareHashes(local, remote *ObjectInfo, paths *[]string) {
+	if local.SubtreeHash == remote.SubtreeHash {
+		return
+	}
+	// if either side has not been expanded we can not descend
+	if !expanded(local) || !expanded(remote) {
+		*paths = append(*paths, local.Path)
+		return
+	}
+	remoteChildren := make(map[string]*ObjectInfo, len(remote.Objects))
+	for _, child := range remote.Objects {
+		remoteChildren[child.Name] = child
+	}
+	for _, child := range local.Objects {
+		that, exists := remoteChildren[child.Name]
+		delete(remoteChildren, child.Name)
+		if !exists {
+			*paths = append(*paths, child.Path)
+			continue
+		}
+		if child.entryHash() == that.entryHash() {
+			continue
+		}
+		if !sameHashAlgorithm(child.Content, that.Content) && child.entryHashWith("") == that.entryHashWith("") {
+			// the equal version already means that the content is the same
+			continue
+		}
+		if child.Directory && that.Directory {
+			// the directory itself may have changed too
+			if !child.sameState(that) {
+				*paths = append(*paths, child.Path)
+			}
+			compareHashes(child, that, paths)
+			continue
+		}
+		*paths = append(*paths, child.Path)
+	}
+	for _, that := range remoteChildren {
+		*paths = append(*paths, that.Path)
+	}
+}
+
+/*
+expanded returns whether the sub objects of the directory are available. An
+empty directory is always expanded.
+*/
+func expanded(o *ObjectInfo) bool {
+	return len(o.Objects) > 0 || o.SubtreeHash == emptyHash
+}
+
+// emptyHash is the SubtreeHash of an empty directory.
+var emptyHash = hex.EncodeToString(sha256.New().Sum(nil))
@@ -0,0 +1,103 @@
+package shared
+
+import "testing"
+
+func TestModel_Hash(t *testing.T) {
+	model := makeTestModel(t)
+	before := model.Hash()
+	if before == "" || before != model.Hash() {
+		t.Fatal("Expected stable hash, got", before)
+	}
+	// modify deep object
+	obj, _ := model.Get("a/b/c.txt")
+	changed := *obj.shallowCopy()
+	changed.Content = "changed"
+	msg := CreateUpdateMessage(OpModify, changed)
+	err := model.Apply(&msg)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	after := model.Hash()
+	if after == before {
+		t.Error("Expected hash to change after modification")
+	}
+	// incremental hash must match full recomputation
+	if after != fullHash(model.Root) {
+		t.Error("Expected incremental hash to match full hash")
+	}
+	// moving back and forth must result in the same hash
+	model.Move("a/b", "x")
+	if model.Hash() == after {
+		t.Error("Expected hash to change after move")
+	}
+	model.Move("x", "a/b")
+	if model.Hash() != after {
+		t.Error("Expected original hash after moving back")
+	}
+}
+
+func Test_CompareHashes(t *testing.T) {
+	local := makeTestModel(t)
+	remote, _ := CreateModel(local.Root.Copy())
+	if paths := CompareHashes(local.Root, remote.Root); len(paths) != 0 {
+		t.Error("Expected no differences, got", paths)
+	}
+	obj, _ := remote.Get("a/b/c.txt")
+	changed := *obj.shallowCopy()
+	changed.Version.Increase("peer")
+	msg := CreateUpdateMessage(OpModify, changed)
+	remote.Apply(&msg)
+	remote.Insert(testObject("a/new", false))
+	remote.Remove("d.txt")
+	local.Hash()
+	remote.Hash()
+	want := []string{"a/b/c.txt", "a/new", "d.txt"}
+	paths := CompareHashes(local.Root, remote.Root)
+	if !equalStrings(paths, want) {
+		t.Error("Expected", want, "got", paths)
+	}
+	// a summary can only point to the differing directory
+	want = []string{"a", "d.txt"}
+	paths = CompareHashes(local.Root, remote.Root.Summary(1))
+	if !equalStrings(paths, want) {
+		t.Error("Expected", want, "got", paths)
+	}
+	// hashes of another algorithm only differ if the version does too
+	upgraded, _ := CreateModel(local.Root.Copy())
+	for _, path := range []string{"a/b/c.txt", "d.txt"} {
+		obj, _ := upgraded.Get(path)
+		changed := *obj.shallowCopy()
+		changed.Content = "other:" + path
+		if path == "d.txt" {
+			changed.Version.Increase("peer")
+		}
+		msg := CreateUpdateMessage(OpModify, changed)
+		upgraded.Apply(&msg)
+	}
+	upgraded.Hash()
+	want = []string{"d.txt"}
+	paths = CompareHashes(local.Root, upgraded.Root)
+	if !equalStrings(paths, want) {
+		t.Error("Expected", want, "got", paths)
+	}
+}
+
+func fullHash(root *ObjectInfo) string {
+	root = root.Copy()
+	walk(root, func(obj *ObjectInfo) {
+		obj.SubtreeHash = ""
+	})
+	return root.UpdateHashes()
+}
+
+func equalStrings(one, two []string) bool {
+	if len(one) != len(two) {
+		return false
+	}
+	for i := range one {
+		if one[i] != two[i] {
+			return false
+		}
+	}
+	return true
+}
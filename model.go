@@ -0,0 +1,443 @@
+package shared
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+Model wraps the root ObjectInfo of a tree and keeps indexes by path and by
+identification so that objects can be found without walking the tree. All
+modifications must go through the Model, otherwise the indexes and the subtree
+hashes will no longer match the tree.
+*/
+type Model struct {
+	Root       *ObjectInfo
+	FileSystem FileSystem // used to read the files of the model, FS if nil
+	paths      map[string]*ObjectInfo
+	ids        map[string]*ObjectInfo
+}
+
+/*
+CreateModel builds a Model for the given root object. The root must be a
+directory with an empty Path. NOTE: the children of all directories are sorted
+by name in place.
+*/
+func CreateModel(root *ObjectInfo) (*Model, error) {
+	if root == nil || !root.Directory || root.Path != "" {
+		return nil, ErrIllegalParameters
+	}
+	m := &Model{
+		Root:  root,
+		paths: make(map[string]*ObjectInfo),
+		ids:   make(map[string]*ObjectInfo)}
+	// check the complete tree before indexing it
+	err := m.checkInsertable(root, "")
+	if err != nil {
+		return nil, err
+	}
+	sortTree(root)
+	m.index(root)
+	return m, nil
+}
+
+/*
+fs returns the FileSystem of the model.
+*/
+func (m *Model) fs() FileSystem {
+	if m.FileSystem == nil {
+		return FS
+	}
+	return m.FileSystem
+}
+
+/*
+Get returns the object at the given path. The root has the empty path.
+*/
+func (m *Model) Get(path string) (*ObjectInfo, error) {
+	obj, exists := m.paths[path]
+	if !exists {
+		return nil, ErrUntracked
+	}
+	return obj, nil
+}
+
+/*
+GetByID returns the object with the given identification.
+*/
+func (m *Model) GetByID(id string) (*ObjectInfo, error) {
+	obj, exists := m.ids[id]
+	if !exists {
+		return nil, ErrUntracked
+	}
+	return obj, nil
+}
+
+/*
+Size returns the amount of objects in the model, including the root.
+*/
+func (m *Model) Size() int {
+	return len(m.paths)
+}
+
+/*
+Insert adds the given object including all of its sub objects to the model. The
+parent directory must already exist and neither the path nor any identification
+of the object tree may already be tracked. Returns ErrIllegalParameters for
+malformed paths.
+*/
+func (m *Model) Insert(obj *ObjectInfo) error {
+	if obj == nil || !validPath(obj.Path) {
+		return ErrIllegalParameters
+	}
+	parent, err := m.parentOf(obj.Path)
+	if err != nil {
+		return err
+	}
+	err = m.checkInsertable(obj, obj.Path)
+	if err != nil {
+		return err
+	}
+	walk(obj, func(obj *ObjectInfo) {
+		// hashes of inserted objects can not be trusted
+		obj.SubtreeHash = ""
+	})
+	sortTree(obj)
+	m.index(obj)
+	addChild(parent, obj)
+	m.invalidate(parent.Path)
+	return nil
+}
+
+/*
+Remove removes the object at the given path including all of its sub objects
+from the model and returns it.
+*/
+func (m *Model) Remove(path string) (*ObjectInfo, error) {
+	if path == "" {
+		// the root can not be removed
+		return nil, ErrIllegalParameters
+	}
+	obj, err := m.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	parent, err := m.parentOf(path)
+	if err != nil {
+		return nil, err
+	}
+	removeChild(parent, obj.Name)
+	m.unindex(obj)
+	m.invalidate(parent.Path)
+	return obj, nil
+}
+
+/*
+Move relocates the object at from to the path to, renaming it if required. All
+sub objects are moved along with it. Returns ErrIllegalParameters for malformed
+paths.
+*/
+func (m *Model) Move(from, to string) error {
+	if !validPath(from) || !validPath(to) || to == from || strings.HasPrefix(to, from+"/") {
+		return ErrIllegalParameters
+	}
+	obj, err := m.Get(from)
+	if err != nil {
+		return err
+	}
+	if _, exists := m.paths[to]; exists {
+		return ErrObjectExists
+	}
+	newParent, err := m.parentOf(to)
+	if err != nil {
+		return err
+	}
+	oldParent, err := m.parentOf(from)
+	if err != nil {
+		return err
+	}
+	removeChild(oldParent, obj.Name)
+	m.unindex(obj)
+	m.invalidate(oldParent.Path)
+	obj.Name = lastElement(to)
+	setPath(obj, to)
+	m.index(obj)
+	addChild(newParent, obj)
+	m.invalidate(newParent.Path)
+	return nil
+}
+
+/*
+Apply executes the given update on the model. Existing objects are found by
+their identification. A created object is inserted as given, including any sub
+objects; for all other operations only the properties of the object itself are
+updated.
+*/
+func (m *Model) Apply(msg *UpdateMessage) error {
+	if msg.Operation == OpCreate {
+		return m.Insert(msg.Object.Copy())
+	}
+	obj, err := m.GetByID(msg.Object.Identification)
+	if err != nil {
+		return err
+	}
+	switch msg.Operation {
+	case OpModify:
+		if obj.Path != msg.Object.Path {
+			return ErrConflict
+		}
+	case OpMove:
+		if obj.Directory != msg.Object.Directory {
+			return ErrConflict
+		}
+		err = m.Move(obj.Path, msg.Object.Path)
+		if err != nil {
+			return err
+		}
+	case OpRemove:
+		_, err = m.Remove(obj.Path)
+		return err
+	default:
+		return ErrIllegalParameters
+	}
+	err = obj.update(&msg.Object)
+	if err != nil {
+		return err
+	}
+	m.invalidate(parentPath(obj.Path))
+	return nil
+}
+
+/*
+Hash returns the SubtreeHash of the root, recomputing only the directories that
+changed since the last call.
+*/
+func (m *Model) Hash() string {
+	return m.Root.UpdateHashes()
+}
+
+/*
+ForEach applies the given function to all objects of the model.
+*/
+func (m *Model) ForEach(f onEach) {
+	m.Root.ForEach(f)
+}
+
+/*
+Check verifies that the tree and the indexes are consistent. Returns nil if all
+invariants hold, otherwise an error describing the first violation.
+*/
+func (m *Model) Check() error {
+	if m.Root == nil || !m.Root.Directory || m.Root.Path != "" {
+		return fmt.Errorf("%w: illegal root", ErrInvalidModel)
+	}
+	count := 0
+	err := m.check(m.Root, &count)
+	if err != nil {
+		return err
+	}
+	if count != len(m.paths) || count != len(m.ids) {
+		return fmt.Errorf("%w: tree has %d objects but indexes have %d paths and %d ids",
+			ErrInvalidModel, count, len(m.paths), len(m.ids))
+	}
+	return nil
+}
+
+func (m *Model) check(obj *ObjectInfo, count *int) error {
+	*count++
+	if m.paths[obj.Path] != obj {
+		return fmt.Errorf("%w: path index mismatch at <%s>", ErrInvalidModel, obj.Path)
+	}
+	if m.ids[obj.Identification] != obj {
+		return fmt.Errorf("%w: id index mismatch at <%s>", ErrInvalidModel, obj.Path)
+	}
+	if !obj.Directory && len(obj.Objects) > 0 {
+		return fmt.Errorf("%w: file <%s> has children", ErrInvalidModel, obj.Path)
+	}
+	for i, child := range obj.Objects {
+		if child.Name == "" || strings.Contains(child.Name, "/") {
+			return fmt.Errorf("%w: illegal name in <%s>", ErrInvalidModel, obj.Path)
+		}
+		if child.Path != joinPath(obj.Path, child.Name) {
+			return fmt.Errorf("%w: path <%s> does not match parent <%s>", ErrInvalidModel, child.Path, obj.Path)
+		}
+		if i > 0 && obj.Objects[i-1].Name >= child.Name {
+			return fmt.Errorf("%w: children of <%s> not sorted", ErrInvalidModel, obj.Path)
+		}
+		err := m.check(child, count)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+checkInsertable makes sure that the given object tree is well formed for the
+given path and conflicts with nothing already tracked. Sorts the children.
+*/
+func (m *Model) checkInsertable(obj *ObjectInfo, path string) error {
+	seenPaths := make(map[string]bool)
+	seenIDs := make(map[string]bool)
+	var visit func(obj *ObjectInfo, path string) error
+	visit = func(obj *ObjectInfo, path string) error {
+		if obj.Path != path {
+			return ErrIllegalParameters
+		}
+		if path != "" && (!validPath(path) || obj.Name != lastElement(path)) {
+			return ErrIllegalParameters
+		}
+		if !obj.Directory && len(obj.Objects) > 0 {
+			return ErrNotDirectory
+		}
+		_, pathExists := m.paths[path]
+		_, idExists := m.ids[obj.Identification]
+		if pathExists || idExists || seenPaths[path] || seenIDs[obj.Identification] {
+			return ErrObjectExists
+		}
+		seenPaths[path] = true
+		seenIDs[obj.Identification] = true
+		// sorted for a stable result, the object is only changed once inserted
+		children := append([]*ObjectInfo{}, obj.Objects...)
+		sort.Sort(byName(children))
+		for _, child := range children {
+			err := visit(child, joinPath(path, child.Name))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return visit(obj, path)
+}
+
+/*
+parentOf returns the parent directory of the given path.
+*/
+func (m *Model) parentOf(path string) (*ObjectInfo, error) {
+	parent, err := m.Get(parentPath(path))
+	if err != nil {
+		return nil, err
+	}
+	if !parent.Directory {
+		return nil, ErrNotDirectory
+	}
+	return parent, nil
+}
+
+/*
+invalidate clears the SubtreeHash of the directory at path and all of its
+parents.
+*/
+func (m *Model) invalidate(path string) {
+	for {
+		if obj, exists := m.paths[path]; exists {
+			obj.SubtreeHash = ""
+		}
+		if path == "" {
+			return
+		}
+		path = parentPath(path)
+	}
+}
+
+/*
+sortTree sorts the sub objects of every directory of the tree by name.
+*/
+func sortTree(obj *ObjectInfo) {
+	walk(obj, func(obj *ObjectInfo) {
+		sort.Sort(byName(obj.Objects))
+	})
+}
+
+func (m *Model) index(obj *ObjectInfo) {
+	m.paths[obj.Path] = obj
+	m.ids[obj.Identification] = obj
+	for _, child := range obj.Objects {
+		m.index(child)
+	}
+}
+
+func (m *Model) unindex(obj *ObjectInfo) {
+	delete(m.paths, obj.Path)
+	delete(m.ids, obj.Identification)
+	for _, child := range obj.Objects {
+		m.unindex(child)
+	}
+}
+
+/*
+addChild inserts the child into the sorted children of parent.
+*/
+func addChild(parent, child *ObjectInfo) {
+	index := sort.Search(len(parent.Objects), func(i int) bool {
+		return parent.Objects[i].Name >= child.Name
+	})
+	parent.Objects = append(parent.Objects, nil)
+	copy(parent.Objects[index+1:], parent.Objects[index:])
+	parent.Objects[index] = child
+}
+
+/*
+removeChild removes the child with the given name from the sorted children of
+parent.
+*/
+func removeChild(parent *ObjectInfo, name string) {
+	index := sort.Search(len(parent.Objects), func(i int) bool {
+		return parent.Objects[i].Name >= name
+	})
+	if index == len(parent.Objects) || parent.Objects[index].Name != name {
+		return
+	}
+	parent.Objects = append(parent.Objects[:index], parent.Objects[index+1:]...)
+	if len(parent.Objects) == 0 {
+		parent.Objects = nil
+	}
+}
+
+/*
+setPath rewrites the path of the object and all sub objects.
+*/
+func setPath(obj *ObjectInfo, path string) {
+	obj.Path = path
+	for _, child := range obj.Objects {
+		setPath(child, joinPath(path, child.Name))
+	}
+}
+
+func joinPath(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "/" + name
+}
+
+func parentPath(path string) string {
+	index := strings.LastIndex(path, "/")
+	if index < 0 {
+		return ""
+	}
+	return path[:index]
+}
+
+/*
+validPath returns whether path is a well formed subpath of an object other than
+the root: not empty, without leading or trailing slash and without empty, "."
+or ".." elements.
+*/
+func validPath(path string) bool {
+	if path == "" {
+		return false
+	}
+	for _, element := range strings.Split(path, "/") {
+		if element == "" || element == "." || element == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+func lastElement(path string) string {
+	return path[strings.LastIndex(path, "/")+1:]
+}
@@ -0,0 +1,171 @@
+package shared
+
+import "testing"
+
+func TestModel_Get(t *testing.T) {
+	model := makeTestModel(t)
+	for _, path := range []string{"", "a", "a/b", "a/b/c.txt", "d.txt"} {
+		obj, err := model.Get(path)
+		if err != nil || obj.Path != path {
+			t.Error("Expected object for", path, "got", obj, "or", err)
+			continue
+		}
+		byID, err := model.GetByID(obj.Identification)
+		if err != nil || byID != obj {
+			t.Error("Expected same object by id for", path, "got", byID, "or", err)
+		}
+	}
+	_, err := model.Get("missing")
+	if err != ErrUntracked {
+		t.Error("Expected ErrUntracked, got", err)
+	}
+	if model.Size() != 5 {
+		t.Error("Expected 5 objects, got", model.Size())
+	}
+}
+
+func TestModel_Insert(t *testing.T) {
+	model := makeTestModel(t)
+	dir := testObject("e", true)
+	dir.Objects = []*ObjectInfo{testObject("e/f.txt", false)}
+	err := model.Insert(dir)
+	if err != nil {
+		t.Fatal("Expected insert to succeed, got", err)
+	}
+	checkModel(t, model)
+	if _, err := model.Get("e/f.txt"); err != nil {
+		t.Error("Expected sub object to be indexed, got", err)
+	}
+	// illegal inserts
+	testInserts := []struct {
+		obj  *ObjectInfo
+		want error
+	}{
+		{testObject("e", false), ErrObjectExists},
+		{testObject("x/y", false), ErrUntracked},
+		{testObject("d.txt/y", false), ErrNotDirectory},
+		{&ObjectInfo{Identification: dir.Identification, Name: "g", Path: "g"}, ErrObjectExists},
+		{&ObjectInfo{Identification: "new", Name: "wrong", Path: "h"}, ErrIllegalParameters},
+		{&ObjectInfo{Identification: "new", Name: "", Path: "e/"}, ErrIllegalParameters},
+		{&ObjectInfo{Identification: "new", Name: "h", Path: "/h"}, ErrIllegalParameters},
+		{&ObjectInfo{Identification: "new", Name: "h", Path: "e//h"}, ErrIllegalParameters},
+		{&ObjectInfo{Identification: "new", Name: "..", Path: "e/.."}, ErrIllegalParameters}}
+	for _, test := range testInserts {
+		err := model.Insert(test.obj)
+		if err != test.want {
+			t.Error("Expected", test.want, "got", err, "for", test.obj.Path)
+		}
+	}
+	// rejected objects are left as they were
+	unsorted := testObject("u", true)
+	unsorted.Objects = []*ObjectInfo{testObject("u/y", false), testObject("u/x", false), testObject("u/x", false)}
+	if err := model.Insert(unsorted); err != ErrObjectExists || unsorted.Objects[0].Name != "y" {
+		t.Error("Expected rejected object to be unchanged, got", err)
+	}
+	checkModel(t, model)
+}
+
+func TestModel_Remove(t *testing.T) {
+	model := makeTestModel(t)
+	removed, err := model.Remove("a/b")
+	if err != nil || removed.Path != "a/b" {
+		t.Fatal("Expected removal to succeed, got", removed, "or", err)
+	}
+	checkModel(t, model)
+	if _, err := model.Get("a/b/c.txt"); err != ErrUntracked {
+		t.Error("Expected sub object to be removed, got", err)
+	}
+	if _, err := model.Remove(""); err != ErrIllegalParameters {
+		t.Error("Expected root removal to fail, got", err)
+	}
+	if _, err := model.Remove("a/b"); err != ErrUntracked {
+		t.Error("Expected ErrUntracked, got", err)
+	}
+}
+
+func TestModel_Move(t *testing.T) {
+	model := makeTestModel(t)
+	file, _ := model.Get("a/b/c.txt")
+	err := model.Move("a/b", "z")
+	if err != nil {
+		t.Fatal("Expected move to succeed, got", err)
+	}
+	checkModel(t, model)
+	moved, err := model.Get("z/c.txt")
+	if err != nil || moved != file || moved.Name != "c.txt" {
+		t.Error("Expected file to move along, got", moved, "or", err)
+	}
+	testMoves := []struct {
+		from string
+		to   string
+		want error
+	}{
+		{"a", "a/x", ErrIllegalParameters},
+		{"z", "d.txt", ErrObjectExists},
+		{"z", "d.txt/x", ErrNotDirectory},
+		{"missing", "x", ErrUntracked},
+		{"", "x", ErrIllegalParameters},
+		{"z", "", ErrIllegalParameters},
+		{"z", "x/", ErrIllegalParameters},
+		{"z", "/x", ErrIllegalParameters},
+		{"z", "a//x", ErrIllegalParameters}}
+	for _, test := range testMoves {
+		err := model.Move(test.from, test.to)
+		if err != test.want {
+			t.Error("Expected", test.want, "got", err, "for", test.from, test.to)
+		}
+	}
+	checkModel(t, model)
+}
+
+func TestModel_Check(t *testing.T) {
+	model := makeTestModel(t)
+	obj, _ := model.Get("a/b")
+	// modify the tree without going through the model
+	obj.Path = "broken"
+	if model.Check() == nil {
+		t.Error("Expected check to detect broken path")
+	}
+	_, err := CreateModel(&ObjectInfo{Directory: true, Objects: []*ObjectInfo{
+		testObject("x", false), testObject("x", false)}})
+	if err != ErrObjectExists {
+		t.Error("Expected duplicate paths to be rejected, got", err)
+	}
+}
+
+func makeTestModel(t *testing.T) *Model {
+	root := testObject("", true)
+	a := testObject("a", true)
+	b := testObject("a/b", true)
+	b.Objects = []*ObjectInfo{testObject("a/b/c.txt", false)}
+	a.Objects = []*ObjectInfo{b}
+	root.Objects = []*ObjectInfo{testObject("d.txt", false), a}
+	model, err := CreateModel(root)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	checkModel(t, model)
+	return model
+}
+
+func checkModel(t *testing.T, model *Model) {
+	err := model.Check()
+	if err != nil {
+		t.Error("Expected valid model, got", err)
+	}
+}
+
+func testObject(path string, dir bool) *ObjectInfo {
+	id, _ := NewIdentifier()
+	content := ""
+	if !dir {
+		content = "hash-" + path
+	}
+	return &ObjectInfo{
+		Directory:      dir,
+		Identification: id,
+		Name:           lastElement(path),
+		Path:           path,
+		Version:        CreateVersion(),
+		Content:        content}
+}
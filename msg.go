@@ -228,3 +228,76 @@ func (am *AuthenticationMessage) String() string {
 	return "AuthenticationMessage{Type:" + am.Type.String() +
 		",Encrypted:" + fmt.Sprintf("%+v", am.Encrypted) + "}"
 }
+
+/*
+SignatureMessage carries the Signature of the version of an object the sender
+already has, requesting a Delta to the current version.
+*/
+type SignatureMessage struct {
+	Type           MsgType
+	Identification string
+	Signature      Signature
+}
+
+/*
+CreateSignatureMessage is a convenience method for building an instance of the message.
+*/
+func CreateSignatureMessage(identification string, sig Signature) SignatureMessage {
+	return SignatureMessage{
+		Type:           MsgSignature,
+		Identification: identification,
+		Signature:      sig}
+}
+
+/*
+JSON representation of this message.
+*/
+func (sm *SignatureMessage) JSON() string {
+	data, err := json.Marshal(sm)
+	if err != nil {
+		log.Println("Msg: JSON error:", err)
+	}
+	return string(data)
+}
+
+func (sm *SignatureMessage) String() string {
+	return "SignatureMessage{Type:" + sm.Type.String() +
+		",Identification:" + sm.Identification +
+		",Blocks:" + fmt.Sprintf("%d", len(sm.Signature.Weak)) + "}"
+}
+
+/*
+DeltaMessage carries the Delta for an object in reply to a SignatureMessage.
+*/
+type DeltaMessage struct {
+	Type           MsgType
+	Identification string
+	Delta          Delta
+}
+
+/*
+CreateDeltaMessage is a convenience method for building an instance of the message.
+*/
+func CreateDeltaMessage(identification string, delta Delta) DeltaMessage {
+	return DeltaMessage{
+		Type:           MsgDelta,
+		Identification: identification,
+		Delta:          delta}
+}
+
+/*
+JSON representation of this message.
+*/
+func (dm *DeltaMessage) JSON() string {
+	data, err := json.Marshal(dm)
+	if err != nil {
+		log.Println("Msg: JSON error:", err)
+	}
+	return string(data)
+}
+
+func (dm *DeltaMessage) String() string {
+	return "DeltaMessage{Type:" + dm.Type.String() +
+		",Identification:" + dm.Identification +
+		",Ops:" + fmt.Sprintf("%d", len(dm.Delta.Ops)) + "}"
+}
@@ -3,6 +3,7 @@ package shared
 import (
 	"encoding/json"
 	"os"
+	"time"
 )
 
 /*
@@ -16,6 +17,13 @@ type ObjectInfo struct {
 	Shadow         bool
 	Version        Version
 	Content        string        `json:",omitempty"`
+	Kind           ObjectKind    `json:",omitempty"` // may be OkNone for objects of older peers
+	Size           int64         `json:",omitempty"`
+	Mode           os.FileMode   `json:",omitempty"` // permission bits only
+	ModTime        time.Time     `json:",omitzero"`
+	Target         string        `json:",omitempty"` // target of symlinks
+	Chunks         *ChunkList    `json:",omitempty"` // optional content defined chunks of files
+	SubtreeHash    string        `json:",omitempty"` // derived hash of all sub objects, see UpdateHashes
 	Objects        []*ObjectInfo `json:",omitempty"`
 }
 
@@ -35,25 +43,106 @@ func CreateObjectInfo(root string, subpath string, selfid string) (*ObjectInfo,
 	if err != nil {
 		return nil, err
 	}
-	stat, err := os.Lstat(path.FullPath())
+	stat, err := FS.Lstat(path.FullPath())
 	if err != nil {
 		return nil, err
 	}
-	hash := ""
-	if !stat.IsDir() {
-		hash, err = ContentHash(path.FullPath())
-		if err != nil {
-			return nil, err
-		}
-	}
-	return &ObjectInfo{
-		Directory:      stat.IsDir(),
+	obj := &ObjectInfo{
 		Identification: id,
 		Name:           path.LastElement(),
 		Path:           path.SubPath(),
 		Shadow:         false,
-		Version:        CreateVersion(),
-		Content:        hash}, nil
+		Version:        CreateVersion()}
+	err = obj.setMetadata(FS, path.FullPath(), stat)
+	if err != nil {
+		return nil, err
+	}
+	if obj.Kind == OkFile {
+		obj.Content, err = cachedContentHash(FS, root, path.FullPath())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return obj, nil
+}
+
+/*
+setMetadata reads all file system properties except the content hash from the
+given stat of the object at path on fsys.
+*/
+func (o *ObjectInfo) setMetadata(fsys FileSystem, path string, stat os.FileInfo) error {
+	o.Directory = stat.IsDir()
+	o.Mode = stat.Mode().Perm()
+	switch {
+	case stat.IsDir():
+		o.Kind = OkDirectory
+	case stat.Mode()&os.ModeSymlink != 0:
+		// symlinks are never followed, we only store where they point to
+		o.Kind = OkSymlink
+		target, err := fsys.Readlink(path)
+		if err != nil {
+			return err
+		}
+		o.Target = target
+	default:
+		o.Kind = OkFile
+		o.Size = stat.Size()
+		o.ModTime = stat.ModTime()
+	}
+	return nil
+}
+
+/*
+ApplyMetadata sets the permissions and modification time stored in the object
+on the file system object below the given root. Values that are not known, for
+example because the object was sent by an older peer, are left untouched.
+Symlinks are skipped.
+*/
+func (o *ObjectInfo) ApplyMetadata(root string) error {
+	if o.Kind == OkSymlink {
+		return nil
+	}
+	path := CreatePath(root, o.Path).FullPath()
+	if o.Mode != 0 {
+		// modes of other peers may not loosen the Tinzenite data
+		err := FS.Chmod(path, Permissions.limit(o.Path, o.Directory, o.Mode))
+		if err != nil {
+			return err
+		}
+	}
+	if !o.Directory && !o.ModTime.IsZero() {
+		return FS.Chtimes(path, o.ModTime, o.ModTime)
+	}
+	return nil
+}
+
+/*
+kind returns the kind of the object, deriving it for objects of older peers.
+*/
+func (o *ObjectInfo) kind() ObjectKind {
+	if o.Kind != OkNone {
+		return o.Kind
+	}
+	if o.Directory {
+		return OkDirectory
+	}
+	return OkFile
+}
+
+/*
+sameState returns whether the object has the same content, version and metadata
+as the given object. Modification times are not compared, unknown permissions
+are ignored and hashes of different algorithms are considered equal.
+*/
+func (o *ObjectInfo) sameState(that *ObjectInfo) bool {
+	if o.Mode != 0 && that.Mode != 0 && o.Mode != that.Mode {
+		return false
+	}
+	return contentEqual(o.Content, that.Content) &&
+		o.Shadow == that.Shadow &&
+		o.kind() == that.kind() &&
+		o.Target == that.Target &&
+		versionEqual(o.Version, that.Version)
 }
 
 /*
@@ -66,6 +155,47 @@ func (o *ObjectInfo) Equal(that *ObjectInfo) bool {
 		o.Content == that.Content
 }
 
+/*
+Copy returns a deep copy of the object including all sub objects.
+*/
+func (o *ObjectInfo) Copy() *ObjectInfo {
+	obj := o.shallowCopy()
+	for _, child := range o.Objects {
+		obj.Objects = append(obj.Objects, child.Copy())
+	}
+	return obj
+}
+
+/*
+shallowCopy returns a copy of the object without any sub objects.
+*/
+func (o *ObjectInfo) shallowCopy() *ObjectInfo {
+	obj := *o
+	obj.Version = o.Version.Copy()
+	obj.Objects = nil
+	return &obj
+}
+
+/*
+update overwrites the properties of the object with those of the given object.
+Identity, location and sub objects are left untouched.
+*/
+func (o *ObjectInfo) update(that *ObjectInfo) error {
+	if o.Directory != that.Directory {
+		return ErrConflict
+	}
+	o.Shadow = that.Shadow
+	o.Version = that.Version.Copy()
+	o.Content = that.Content
+	o.Kind = that.Kind
+	o.Size = that.Size
+	o.Mode = that.Mode
+	o.ModTime = that.ModTime
+	o.Target = that.Target
+	o.Chunks = that.Chunks
+	return nil
+}
+
 /*
 JSON returns a json representation of this object.
 */
@@ -0,0 +1,66 @@
+package shared
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_CreateObjectInfo(t *testing.T) {
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	err := os.WriteFile(root+"/exec", []byte("#!/bin/sh"), 0750)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	err = os.Symlink("exec", root+"/link")
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	file, err := CreateObjectInfo(root, "exec", "self")
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	if file.Kind != OkFile || file.Mode != 0750 || file.Size != 9 || file.ModTime.IsZero() || file.Content == "" {
+		t.Error("Expected file metadata, got", file)
+	}
+	link, err := CreateObjectInfo(root, "link", "self")
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	if link.Kind != OkSymlink || link.Target != "exec" || link.Content != "" {
+		t.Error("Expected symlink metadata, got", link)
+	}
+	// metadata must survive being applied to another file
+	err = os.WriteFile(root+"/copy", []byte("#!/bin/sh"), 0600)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	file.Path = "copy"
+	err = file.ApplyMetadata(root)
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	copied, _ := CreateObjectInfo(root, "copy", "self")
+	if copied.Mode != file.Mode || !copied.ModTime.Equal(file.ModTime) {
+		t.Error("Expected metadata to be applied, got", copied)
+	}
+}
+
+func TestObjectInfo_JSON(t *testing.T) {
+	// objects of older peers must not gain any new fields
+	legacy := &ObjectInfo{Identification: "id", Name: "a", Path: "a", Version: Version{}}
+	data := legacy.JSON()
+	for _, field := range []string{"Kind", "Size", "Mode", "ModTime", "Target"} {
+		if strings.Contains(data, field) {
+			t.Error("Expected", field, "to be omitted, got", data)
+		}
+	}
+	obj := &ObjectInfo{Identification: "id", Kind: OkSymlink, Target: "b", Mode: 0755}
+	loaded := &ObjectInfo{}
+	err := json.Unmarshal([]byte(obj.JSON()), loaded)
+	if err != nil || loaded.Kind != OkSymlink || loaded.Target != "b" || loaded.Mode != 0755 {
+		t.Error("Expected round trip, got", loaded, "or", err)
+	}
+}
@@ -0,0 +1,534 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+OUTBOXCOMPACT is the amount of acknowledged entries after which the log of an
+Outbox is compacted automatically.
+*/
+const OUTBOXCOMPACT = 256
+
+// prefix of payloads that are still being copied
+const outboxStaging = ".payload-"
+
+/*
+OutboxEntry is a single message queued for a peer. Sequence numbers are strictly
+increasing per peer and never reused, so that the peer can drop replays of
+entries it has already applied.
+*/
+type OutboxEntry struct {
+	Sequence uint64
+	Type     MsgType
+	Key      string          `json:",omitempty"` // identification of the object concerned, used for compaction
+	Message  json.RawMessage // JSON of the message
+	Payload  bool            `json:",omitempty"` // if a copy of the pushed file is stored
+}
+
+/*
+Outbox is the durable queue of messages for a single peer that is currently
+offline. It is stored in SENDINGDIR as an append only log of JSON lines;
+payloads of push messages are copied next to it so that later changes to the
+original file do not affect queued transfers. All methods are safe for
+concurrent use.
+*/
+type Outbox struct {
+	dir     string
+	mutex   sync.Mutex
+	next    uint64
+	pending []*OutboxEntry
+	acked   int // acknowledged entries still in the log
+}
+
+/*
+outboxRecord is a single line of the log: either an entry, the acknowledgement
+of an entry, or the next sequence number written when compacting.
+*/
+type outboxRecord struct {
+	Entry *OutboxEntry `json:",omitempty"`
+	Ack   uint64       `json:",omitempty"`
+	Next  uint64       `json:",omitempty"`
+}
+
+/*
+OpenOutbox loads the outbox for the peer with the given identification from the
+Tinzenite or encrypted directory at root, creating it if required.
+*/
+func OpenOutbox(root, peer string) (*Outbox, error) {
+	if peer == "" || strings.ContainsAny(peer, "/\\") || strings.HasPrefix(peer, ".") {
+		return nil, ErrIllegalParameters
+	}
+	kind := DetectDirKind(root)
+	if kind == DkNone {
+		return nil, ErrNotTinzenite
+	}
+	o := &Outbox{dir: layoutBase(root, kind) + "/" + SENDINGDIR + "/" + peer, next: 1}
+	err := FS.MkdirAll(o.dir, Permissions.PrivateDir)
+	if err != nil {
+		return nil, err
+	}
+	clean, err := o.load()
+	if err != nil {
+		return nil, err
+	}
+	// payloads of an interrupted AddPush
+	stats, err := FS.ReadDir(o.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, stat := range stats {
+		if strings.HasPrefix(stat.Name(), outboxStaging) {
+			FS.Remove(o.dir + "/" + stat.Name())
+		}
+	}
+	if !clean {
+		// rewrite so that new records are not appended to a partial line
+		err = o.compact()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+/*
+Add queues the given message, which must be a pointer to one of the messages of
+this package so that its Type is marshalled correctly. A message equal to one
+that is still pending is only queued once. Returns the sequence number of the
+entry.
+*/
+func (o *Outbox) Add(message interface{}) (uint64, error) {
+	return o.add(message, "")
+}
+
+/*
+AddPush queues the given push message together with a copy of the file at path,
+which is sent once the peer is back.
+*/
+func (o *Outbox) AddPush(message *PushMessage, path string) (uint64, error) {
+	if path == "" {
+		return 0, ErrIllegalParameters
+	}
+	return o.add(message, path)
+}
+
+/*
+Pending returns all entries that have not been acknowledged, in order.
+*/
+func (o *Outbox) Pending() []OutboxEntry {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	entries := make([]OutboxEntry, len(o.pending))
+	for i, entry := range o.pending {
+		entries[i] = *entry
+	}
+	return entries
+}
+
+/*
+OpenPayload opens the copy of the file queued with the entry of the given
+sequence number.
+*/
+func (o *Outbox) OpenPayload(sequence uint64) (File, error) {
+	return FS.Open(o.payloadPath(sequence))
+}
+
+/*
+Replay calls send for every pending entry in order, acknowledging each entry
+once send returns without error. Stops at and returns the first error, keeping
+the remaining entries for the next replay.
+*/
+func (o *Outbox) Replay(send func(entry OutboxEntry) error) error {
+	for _, entry := range o.Pending() {
+		err := send(entry)
+		if err != nil {
+			return err
+		}
+		err = o.Ack(entry.Sequence)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Ack removes the entry with the given sequence number, for example once the peer
+has confirmed it. Unknown sequence numbers are ignored.
+*/
+func (o *Outbox) Ack(sequence uint64) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	index := o.find(sequence)
+	if index < 0 {
+		return nil
+	}
+	err := o.append(&outboxRecord{Ack: sequence})
+	if err != nil {
+		return err
+	}
+	entry := o.pending[index]
+	o.pending = append(o.pending[:index], o.pending[index+1:]...)
+	o.acked++
+	if entry.Payload {
+		FS.Remove(o.payloadPath(sequence))
+	}
+	if o.acked >= OUTBOXCOMPACT {
+		return o.compact()
+	}
+	return nil
+}
+
+/*
+Compact collapses pending entries that concern the same object and rewrites the
+log without acknowledged entries. Of several modifications of an object only
+the last is sent, a creation absorbs a directly following modification, and a
+removal replaces all earlier updates and pushes; if the creation is still
+pending too, nothing is sent at all. Of several pushes of the same object only
+the last is kept. Collapsed entries always take the position of the later one,
+so that entries of other objects in between, for example a move of the parent,
+are still sent before them.
+*/
+func (o *Outbox) Compact() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	var kept []*OutboxEntry
+	// indices into kept of the updates and the last push of each object
+	updates := make(map[string][]int)
+	pushes := make(map[string]int)
+	for _, entry := range o.pending {
+		if entry.Key == "" {
+			kept = append(kept, entry)
+			continue
+		}
+		switch entry.Type {
+		case MsgPush:
+			if index, exists := pushes[entry.Key]; exists {
+				kept[index] = nil
+			}
+			pushes[entry.Key] = len(kept)
+			kept = append(kept, entry)
+		case MsgUpdate:
+			second, err := decodeUpdate(entry)
+			if err != nil {
+				return err
+			}
+			indices := updates[entry.Key]
+			if second.Operation == OpRemove {
+				created, err := lastCreation(kept, indices)
+				if err != nil {
+					return err
+				}
+				// everything since the pending creation, or all earlier
+				// updates, are replaced; the removal stays at its position
+				for _, index := range indices[created+1:] {
+					kept[index] = nil
+				}
+				if index, exists := pushes[entry.Key]; exists {
+					kept[index] = nil
+					delete(pushes, entry.Key)
+				}
+				if created >= 0 {
+					kept[indices[created]] = nil
+					updates[entry.Key] = indices[:created]
+					continue
+				}
+				updates[entry.Key] = []int{len(kept)}
+				kept = append(kept, entry)
+				continue
+			}
+			if len(indices) > 0 && second.Operation == OpModify {
+				index := indices[len(indices)-1]
+				first, err := decodeUpdate(kept[index])
+				if err != nil {
+					return err
+				}
+				switch {
+				case first.Operation == OpModify:
+					kept[index] = nil
+					indices = indices[:len(indices)-1]
+				case first.Operation == OpCreate && index == lastEntry(kept):
+					merged := CreateUpdateMessage(OpCreate, second.Object)
+					data, err := json.Marshal(&merged)
+					if err != nil {
+						return err
+					}
+					kept[index] = &OutboxEntry{Sequence: entry.Sequence, Type: MsgUpdate, Key: entry.Key, Message: data}
+					continue
+				}
+			}
+			updates[entry.Key] = append(indices, len(kept))
+			kept = append(kept, entry)
+		default:
+			kept = append(kept, entry)
+		}
+	}
+	o.pending = o.pending[:0]
+	for _, entry := range kept {
+		if entry != nil {
+			o.pending = append(o.pending, entry)
+		}
+	}
+	return o.compact()
+}
+
+/*
+add writes a new entry for message to the log.
+*/
+func (o *Outbox) add(message interface{}, payload string) (uint64, error) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return 0, err
+	}
+	var header struct {
+		Type           MsgType
+		Identification string
+		Object         struct{ Identification string }
+	}
+	err = json.Unmarshal(data, &header)
+	if err != nil || header.Type == MsgNone {
+		return 0, ErrIllegalParameters
+	}
+	entry := &OutboxEntry{Type: header.Type, Key: header.Identification, Message: data}
+	if header.Type == MsgUpdate {
+		entry.Key = header.Object.Identification
+	}
+	var staging string
+	if payload != "" {
+		// copied before locking, large files would block the outbox otherwise
+		id, err := NewIdentifier()
+		if err != nil {
+			return 0, err
+		}
+		staging = o.dir + "/" + outboxStaging + id
+		err = copyPayload(payload, staging)
+		if err != nil {
+			return 0, err
+		}
+		// only removes anything if the rename below did not happen
+		defer FS.Remove(staging)
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if payload == "" {
+		for _, queued := range o.pending {
+			if !queued.Payload && queued.Type == entry.Type && bytes.Equal(queued.Message, data) {
+				return queued.Sequence, nil
+			}
+		}
+	}
+	entry.Sequence = o.next
+	if payload != "" {
+		entry.Payload = true
+		err = FS.Rename(staging, o.payloadPath(entry.Sequence))
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = o.append(&outboxRecord{Entry: entry})
+	if err != nil {
+		if entry.Payload {
+			FS.Remove(o.payloadPath(entry.Sequence))
+		}
+		return 0, err
+	}
+	o.next++
+	o.pending = append(o.pending, entry)
+	return entry.Sequence, nil
+}
+
+/*
+load reads the log. Returns false if the log ended with a partial record, for
+example after a crash while appending.
+*/
+func (o *Outbox) load() (bool, error) {
+	var data []byte
+	err := loadWithBackup(o.dir+"/"+OUTBOXLOG, func(read []byte) error {
+		data = read
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	clean := len(data) == 0 || data[len(data)-1] == '\n'
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		record := &outboxRecord{}
+		if json.Unmarshal(line, record) != nil {
+			clean = false
+			continue
+		}
+		switch {
+		case record.Entry != nil:
+			o.pending = append(o.pending, record.Entry)
+			if record.Entry.Sequence >= o.next {
+				o.next = record.Entry.Sequence + 1
+			}
+		case record.Ack != 0:
+			if index := o.find(record.Ack); index >= 0 {
+				o.pending = append(o.pending[:index], o.pending[index+1:]...)
+				o.acked++
+			}
+		case record.Next > o.next:
+			o.next = record.Next
+		}
+	}
+	return clean, nil
+}
+
+/*
+append writes a single record to the end of the log and syncs it.
+*/
+func (o *Outbox) append(record *outboxRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	path := o.dir + "/" + OUTBOXLOG
+	_, statErr := FS.Stat(path)
+	file, err := FS.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, Permissions.PrivateFile)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(data, '\n'))
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	if os.IsNotExist(statErr) {
+		return syncDirectory(o.dir)
+	}
+	return nil
+}
+
+/*
+compact atomically replaces the log with the pending entries and removes all
+payloads that are no longer referenced.
+*/
+func (o *Outbox) compact() error {
+	buffer := &bytes.Buffer{}
+	encoder := json.NewEncoder(buffer)
+	err := encoder.Encode(&outboxRecord{Next: o.next})
+	if err != nil {
+		return err
+	}
+	referenced := make(map[string]bool)
+	for _, entry := range o.pending {
+		err = encoder.Encode(&outboxRecord{Entry: entry})
+		if err != nil {
+			return err
+		}
+		if entry.Payload {
+			referenced[strconv.FormatUint(entry.Sequence, 10)] = true
+		}
+	}
+	err = WriteFileAtomic(o.dir+"/"+OUTBOXLOG, buffer.Bytes(), Permissions.PrivateFile, false)
+	if err != nil {
+		return err
+	}
+	o.acked = 0
+	stats, err := FS.ReadDir(o.dir)
+	if err != nil {
+		return err
+	}
+	for _, stat := range stats {
+		name := stat.Name()
+		if _, err := strconv.ParseUint(name, 10, 64); err == nil && !referenced[name] {
+			FS.Remove(o.dir + "/" + name)
+		}
+	}
+	return nil
+}
+
+func (o *Outbox) find(sequence uint64) int {
+	for i, entry := range o.pending {
+		if entry.Sequence == sequence {
+			return i
+		}
+	}
+	return -1
+}
+
+func (o *Outbox) payloadPath(sequence uint64) string {
+	return o.dir + "/" + strconv.FormatUint(sequence, 10)
+}
+
+/*
+lastEntry returns the index of the last entry that is not nil.
+*/
+func lastEntry(entries []*OutboxEntry) int {
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i] != nil {
+			return i
+		}
+	}
+	return -1
+}
+
+/*
+lastCreation returns the position within indices of the last pending creation
+among the updates of an object in entries, or -1 if there is none.
+*/
+func lastCreation(entries []*OutboxEntry, indices []int) (int, error) {
+	for i := len(indices) - 1; i >= 0; i-- {
+		msg, err := decodeUpdate(entries[indices[i]])
+		if err != nil {
+			return -1, err
+		}
+		if msg.Operation == OpCreate {
+			return i, nil
+		}
+	}
+	return -1, nil
+}
+
+func decodeUpdate(entry *OutboxEntry) (*UpdateMessage, error) {
+	msg := &UpdateMessage{}
+	err := json.Unmarshal(entry.Message, msg)
+	return msg, err
+}
+
+/*
+copyPayload copies the file at from to to and syncs it.
+*/
+func copyPayload(from, to string) error {
+	source, err := FS.Open(from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	target, err := FS.OpenFile(to, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, Permissions.PrivateFile)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(target, source)
+	if err == nil {
+		err = target.Sync()
+	}
+	closeErr := target.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		FS.Remove(to)
+	}
+	return err
+}
@@ -0,0 +1,187 @@
+package shared
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestOutbox_Replay(t *testing.T) {
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	err := MakeEncryptedDir(root)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	writeTestFiles(t, root, map[string]string{"file": "payload"})
+	outbox, err := OpenOutbox(root, "peer")
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	update := CreateUpdateMessage(OpCreate, ObjectInfo{Identification: "a", Name: "a"})
+	first, _ := outbox.Add(&update)
+	again, _ := outbox.Add(&update)
+	if first != 1 || again != first {
+		t.Error("Expected duplicate to keep sequence 1, got", first, again)
+	}
+	push := CreatePushMessage("a", OtObject)
+	second, err := outbox.AddPush(&push, root+"/file")
+	if err != nil || second != 2 {
+		t.Error("Expected sequence 2, got", second, err)
+	}
+	// later changes of the original must not affect the queued payload
+	writeTestFiles(t, root, map[string]string{"file": "changed"})
+	if _, err := outbox.Add(update); err != ErrIllegalParameters {
+		t.Error("Expected message without pointer to be rejected, got", err)
+	}
+	// a restart keeps everything
+	outbox, err = OpenOutbox(root, "peer")
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	var sent []uint64
+	failure := errors.New("offline")
+	err = outbox.Replay(func(entry OutboxEntry) error {
+		if entry.Sequence == 2 {
+			file, err := outbox.OpenPayload(entry.Sequence)
+			if err != nil {
+				t.Fatal("Expected payload, got", err)
+			}
+			data, _ := io.ReadAll(file)
+			file.Close()
+			if string(data) != "payload" {
+				t.Error("Expected", "payload", "got", string(data))
+			}
+			return failure
+		}
+		sent = append(sent, entry.Sequence)
+		return nil
+	})
+	if err != failure || len(sent) != 1 || sent[0] != 1 {
+		t.Error("Expected replay to stop after 1, got", sent, err)
+	}
+	outbox, _ = OpenOutbox(root, "peer")
+	pending := outbox.Pending()
+	if len(pending) != 1 || pending[0].Sequence != 2 || pending[0].Type != MsgPush {
+		t.Fatal("Expected pending push, got", pending)
+	}
+	outbox.Ack(2)
+	if _, err := os.Stat(outbox.payloadPath(2)); !os.IsNotExist(err) {
+		t.Error("Expected acknowledged payload to be removed")
+	}
+	// sequence numbers are never reused, even after compaction
+	outbox.Compact()
+	outbox, _ = OpenOutbox(root, "peer")
+	third, _ := outbox.Add(&update)
+	if third != 3 {
+		t.Error("Expected", 3, "got", third)
+	}
+}
+
+func TestOutbox_Compact(t *testing.T) {
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	err := MakeTinzeniteDir(root)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	outbox, err := OpenOutbox(root, "peer")
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	add := func(op Operation, id, content string) {
+		msg := CreateUpdateMessage(op, ObjectInfo{Identification: id, Content: content})
+		_, err := outbox.Add(&msg)
+		if err != nil {
+			t.Fatal("Expected no error, got", err)
+		}
+	}
+	add(OpModify, "a", "1")
+	add(OpCreate, "b", "1")
+	add(OpModify, "a", "2")
+	add(OpModify, "b", "2")
+	add(OpModify, "a", "3")
+	add(OpCreate, "c", "1")
+	add(OpRemove, "c", "")
+	add(OpModify, "d", "1")
+	add(OpRemove, "d", "")
+	add(OpCreate, "e", "1")
+	add(OpModify, "e", "2")
+	// all updates and pushes of a removed object are dropped, even with other
+	// entries in between
+	add(OpCreate, "f", "1")
+	add(OpModify, "a", "4")
+	add(OpModify, "f", "2")
+	writeTestFiles(t, root, map[string]string{"file": "data"})
+	push := CreatePushMessage("f", OtObject)
+	_, err = outbox.AddPush(&push, root+"/file")
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	add(OpRemove, "f", "")
+	err = outbox.Compact()
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	type testEntry struct {
+		sequence  uint64
+		operation Operation
+		id        string
+		content   string
+	}
+	// b is not merged across the modification of a in between
+	want := []testEntry{
+		{2, OpCreate, "b", "1"},
+		{4, OpModify, "b", "2"},
+		{9, OpRemove, "d", ""},
+		{11, OpCreate, "e", "2"},
+		{13, OpModify, "a", "4"}}
+	// compaction must survive a restart
+	outbox, _ = OpenOutbox(root, "peer")
+	pending := outbox.Pending()
+	if len(pending) != len(want) {
+		t.Fatal("Expected", len(want), "entries, got", len(pending))
+	}
+	for i, entry := range pending {
+		msg, _ := decodeUpdate(&entry)
+		got := testEntry{entry.Sequence, msg.Operation, msg.Object.Identification, msg.Object.Content}
+		if got != want[i] {
+			t.Error("Expected", want[i], "got", got)
+		}
+	}
+	if _, err := outbox.OpenPayload(15); !os.IsNotExist(err) {
+		t.Error("Expected payload of the dropped push to be removed, got", err)
+	}
+}
+
+func TestOutbox_PartialRecord(t *testing.T) {
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	err := MakeTinzeniteDir(root)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	outbox, _ := OpenOutbox(root, "peer")
+	msg := CreateRequestMessage(OtObject, "a")
+	outbox.Add(&msg)
+	// simulate a crash while appending
+	file, _ := os.OpenFile(outbox.dir+"/"+OUTBOXLOG, os.O_WRONLY|os.O_APPEND, 0600)
+	file.WriteString(`{"Entry":{"Seq`)
+	file.Close()
+	outbox, err = OpenOutbox(root, "peer")
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	other := CreateRequestMessage(OtObject, "b")
+	outbox.Add(&other)
+	outbox, _ = OpenOutbox(root, "peer")
+	pending := outbox.Pending()
+	if len(pending) != 2 || pending[1].Sequence != 2 {
+		t.Error("Expected two entries after recovery, got", pending)
+	}
+	_, err = OpenOutbox(root, "../peer")
+	if err != ErrIllegalParameters {
+		t.Error("Expected", ErrIllegalParameters, "got", err)
+	}
+}
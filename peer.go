@@ -1,9 +1,11 @@
 package shared
 
 import (
+	"context"
 	"encoding/json"
-	"io/ioutil"
 	"log"
+	"os"
+	"strings"
 )
 
 /*
@@ -41,31 +43,60 @@ func CreatePeer(name string, address string, trusted bool) (*Peer, error) {
 LoadPeers loads all peers for the given tinzenite root path.
 */
 func LoadPeers(root string) (map[string]*Peer, error) {
+	return LoadPeersContext(context.Background(), root, nil)
+}
+
+/*
+LoadPeersContext works like LoadPeers but stops once the context is canceled and
+reports the amount of peer files read to progress, which may be nil.
+*/
+func LoadPeersContext(ctx context.Context, root string, progress ProgressFunc) (map[string]*Peer, error) {
 	path := root + "/" + TINZENITEDIR + "/" + ORGDIR + "/" + PEERSDIR
-	peersFiles, err := ioutil.ReadDir(path)
+	peersFiles, err := FS.ReadDir(path)
 	if err != nil {
 		return nil, err
 	}
-	peers := make(map[string]*Peer)
+	// a peer may only exist as backup if a crash happened while storing it
+	var names []string
 	for _, stat := range peersFiles {
-		data, err := ioutil.ReadFile(path + "/" + stat.Name())
-		if err != nil {
-			log.Println("Error loading peer " + stat.Name() + " from disk!")
+		name := strings.TrimSuffix(stat.Name(), BACKUPENDING)
+		if stat.IsDir() || !strings.HasSuffix(name, ENDING) || Contains(names, name) {
 			continue
 		}
+		names = append(names, name)
+	}
+	total := int64(len(names))
+	reportProgress(progress, 0, total)
+	peers := make(map[string]*Peer)
+	for i, name := range names {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			// failed files are skipped, so the previous one is done here
+			reportProgress(progress, int64(i), total)
+		}
 		peer := &Peer{}
-		err = json.Unmarshal(data, peer)
+		err := loadWithBackup(path+"/"+name, func(data []byte) error {
+			*peer = Peer{}
+			return json.Unmarshal(data, peer)
+		})
 		if err != nil {
-			log.Println("Error unmarshaling peer " + stat.Name() + " from disk!")
+			log.Println("Error loading peer " + name + " from disk!")
 			continue
 		}
 		peers[peer.Address] = peer
 	}
+	if total > 0 {
+		reportProgress(progress, total, total)
+	}
 	return peers, nil
 }
 
 /*
-StoreTo the given path a JSON representation of peer.
+StoreTo the given path a JSON representation of peer. As the peers directory is
+synchronized, no backup is kept and, if path is the peers directory of a
+Tinzenite or encrypted directory, the file is staged in its LOCALDIR.
 */
 func (p *Peer) StoreTo(path string) error {
 	// prepare data to write
@@ -73,10 +104,25 @@ func (p *Peer) StoreTo(path string) error {
 	if err != nil {
 		return err
 	}
+	staging := ""
+	if base := strings.TrimSuffix(path, "/"+ORGDIR+"/"+PEERSDIR); base != path {
+		if exists, _ := DirectoryExists(base + "/" + LOCALDIR); exists {
+			staging = base + "/" + LOCALDIR
+		}
+	}
 	// add file name and ending
 	path = path + "/" + p.Identification + ENDING
 	// write
-	return ioutil.WriteFile(path, data, FILEPERMISSIONMODE)
+	err = writeFileStaged(path, data, Permissions.SharedFile, staging)
+	if err != nil {
+		return err
+	}
+	// backups of older versions would otherwise keep spreading
+	err = FS.Remove(path + BACKUPENDING)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
 }
 
 /*
@@ -0,0 +1,152 @@
+package shared
+
+import (
+	"os"
+	"strings"
+)
+
+/*
+PermissionPolicy defines the modes of the files and directories created by
+Tinzenite. Secrets and local state are private to the user, synchronized
+organisational data may be read by the group. User files keep the mode of their
+source as stored in ObjectInfo.Mode; the user modes are only used when creating
+objects without a known mode.
+*/
+type PermissionPolicy struct {
+	PrivateFile os.FileMode // LOCALDIR, tox dumps, AUTHJSON and transfers
+	PrivateDir  os.FileMode
+	SharedFile  os.FileMode // ORGDIR and the .tinignore of TINZENITEDIR
+	SharedDir   os.FileMode
+	UserFile    os.FileMode
+	UserDir     os.FileMode
+}
+
+/*
+DefaultPermissions is the least privilege PermissionPolicy.
+*/
+var DefaultPermissions = PermissionPolicy{
+	PrivateFile: 0600,
+	PrivateDir:  0700,
+	SharedFile:  0640,
+	SharedDir:   0750,
+	UserFile:    0644,
+	UserDir:     0755}
+
+/*
+Permissions is the PermissionPolicy used by all functions of this package.
+*/
+var Permissions = DefaultPermissions
+
+/*
+Mode returns the mode for the object at subpath. For Tinzenite directories the
+subpath is relative to the root containing TINZENITEDIR; if encrypted is set it
+is relative to the root of an encrypted peer, which only contains Tinzenite
+data.
+*/
+func (p PermissionPolicy) Mode(subpath string, dir, encrypted bool) os.FileMode {
+	elements := strings.Split(subpath, "/")
+	if !encrypted {
+		if elements[0] != TINZENITEDIR {
+			return p.choose(dir, p.UserFile, p.UserDir)
+		}
+		elements = elements[1:]
+		if len(elements) == 1 && elements[0] == TINIGNORE {
+			return p.SharedFile
+		}
+	}
+	switch {
+	case len(elements) == 0 || elements[0] == "":
+		// the directory itself must be readable to reach ORGDIR
+		return p.SharedDir
+	case elements[0] == ORGDIR && !(len(elements) == 2 && elements[1] == AUTHJSON):
+		return p.choose(dir, p.SharedFile, p.SharedDir)
+	default:
+		return p.choose(dir, p.PrivateFile, p.PrivateDir)
+	}
+}
+
+func (p PermissionPolicy) choose(dir bool, file, directory os.FileMode) os.FileMode {
+	if dir {
+		return directory
+	}
+	return file
+}
+
+/*
+limit removes the bits from mode that the policy does not allow for Tinzenite
+data at subpath below a Tinzenite root. User files are not limited.
+*/
+func (p PermissionPolicy) limit(subpath string, dir bool, mode os.FileMode) os.FileMode {
+	if subpath != TINZENITEDIR && !strings.HasPrefix(subpath, TINZENITEDIR+"/") {
+		return mode
+	}
+	return mode & p.Mode(subpath, dir, false)
+}
+
+/*
+RepairPermissions removes all permission bits beyond the current policy from the
+Tinzenite data below root, which is either a Tinzenite directory or the root of
+an encrypted peer. Permissions are only ever tightened. Returns the subpaths of
+all repaired objects.
+*/
+func RepairPermissions(root string) ([]string, error) {
+	return checkPermissions(root, true)
+}
+
+/*
+checkPermissions returns the subpaths of all objects with permissions beyond the
+policy, tightening them if fix is set.
+*/
+func checkPermissions(root string, fix bool) ([]string, error) {
+	encrypted := false
+	start := TINZENITEDIR
+	if !IsTinzenite(root) {
+		if !IsEncrypted(root) {
+			return nil, ErrNotTinzenite
+		}
+		encrypted = true
+		start = ""
+	}
+	var repaired []string
+	var repair func(subpath string) error
+	repair = func(subpath string) error {
+		path := CreatePath(root, subpath).FullPath()
+		stat, err := FS.Lstat(path)
+		if err != nil {
+			return err
+		}
+		if stat.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		mode := stat.Mode().Perm()
+		allowed := Permissions.Mode(subpath, stat.IsDir(), encrypted)
+		if mode&^allowed != 0 {
+			if fix {
+				err := FS.Chmod(path, mode&allowed)
+				if err != nil {
+					return err
+				}
+			}
+			repaired = append(repaired, subpath)
+		}
+		if !stat.IsDir() {
+			return nil
+		}
+		stats, err := FS.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, child := range stats {
+			err := repair(joinPath(subpath, child.Name()))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := repair(start)
+	if err != nil {
+		return nil, err
+	}
+	return repaired, nil
+}
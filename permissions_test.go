@@ -0,0 +1,83 @@
+package shared
+
+import (
+	"os"
+	"testing"
+)
+
+func TestPermissionPolicy_Mode(t *testing.T) {
+	type testMode struct {
+		subpath   string
+		dir       bool
+		encrypted bool
+		want      os.FileMode
+	}
+	tests := []testMode{
+		{"photo.jpg", false, false, 0644},
+		{"photos", true, false, 0755},
+		{TINZENITEDIR, true, false, 0750},
+		{TINZENITEDIR + "/" + TINIGNORE, false, false, 0640},
+		{TINZENITEDIR + "/" + LOCALDIR, true, false, 0700},
+		{STORETOXDUMPDIR + "/" + SELFPEERJSON, false, false, 0600},
+		{STOREPEERDIR, true, false, 0750},
+		{STOREPEERDIR + "/peer.json", false, false, 0640},
+		{STOREAUTHDIR + "/" + AUTHJSON, false, false, 0600},
+		{TINZENITEDIR + "/" + RECEIVINGDIR + "/file", false, false, 0600},
+		{"", true, true, 0750},
+		{LOCALDIR + "/" + SELFPEERJSON, false, true, 0600},
+		{ORGDIR + "/" + PEERSDIR + "/peer.json", false, true, 0640},
+		{ORGDIR + "/" + AUTHJSON, false, true, 0600},
+		{"encrypteddata", false, true, 0600},
+	}
+	for _, test := range tests {
+		got := DefaultPermissions.Mode(test.subpath, test.dir, test.encrypted)
+		if got != test.want {
+			t.Error("Expected", test.want, "for", test.subpath, "got", got)
+		}
+	}
+}
+
+func Test_RepairPermissions(t *testing.T) {
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	err := MakeTinzeniteDir(root)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	// created objects must already follow the policy
+	repaired, err := RepairPermissions(root)
+	if err != nil || len(repaired) != 0 {
+		t.Error("Expected nothing to repair, got", repaired, err)
+	}
+	peer, _ := CreatePeer("name", "address", false)
+	dump := &ToxPeerDump{SelfPeer: peer}
+	dump.StoreTo(root + "/" + STORETOXDUMPDIR)
+	os.WriteFile(root+"/user.txt", nil, 0644)
+	// simulate a tree created by older versions
+	loose := []string{STORETOXDUMPDIR + "/" + SELFPEERJSON, STORETOXDUMPDIR, STOREPEERDIR, "user.txt"}
+	for _, subpath := range loose {
+		err := os.Chmod(root+"/"+subpath, 0777)
+		if err != nil {
+			t.Fatal("Failed test setup", err)
+		}
+	}
+	repaired, err = RepairPermissions(root)
+	if err != nil || len(repaired) != 3 {
+		t.Error("Expected 3 repaired objects, got", repaired, err)
+	}
+	want := map[string]os.FileMode{
+		STORETOXDUMPDIR + "/" + SELFPEERJSON: 0600,
+		STORETOXDUMPDIR:                      0700,
+		STOREPEERDIR:                         0750,
+		"user.txt":                           0777}
+	for subpath, mode := range want {
+		stat, _ := os.Stat(root + "/" + subpath)
+		if stat.Mode().Perm() != mode {
+			t.Error("Expected", mode, "for", subpath, "got", stat.Mode().Perm())
+		}
+	}
+	_, err = RepairPermissions(root + "/" + "user.txt")
+	if err != ErrNotTinzenite {
+		t.Error("Expected", ErrNotTinzenite, "got", err)
+	}
+}
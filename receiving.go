@@ -0,0 +1,426 @@
+package shared
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+receivingFlush is the amount of bytes after which the received ranges of a
+Transfer are stored automatically.
+*/
+const receivingFlush = 8 * 1024 * 1024
+
+/*
+ByteRange is the range of bytes from Start up to, but excluding, End.
+*/
+type ByteRange struct {
+	Start int64
+	End   int64
+}
+
+/*
+Receiver manages the transfers staged in RECEIVINGDIR. Every incoming object has
+a staging file named by its identification and a sidecar file listing the
+ranges already received, so that transfers can be resumed after a restart.
+*/
+type Receiver struct {
+	dir    string
+	mutex  sync.Mutex
+	active map[string]*Transfer
+}
+
+/*
+Transfer is a single staged object being received. All methods are safe for
+concurrent use.
+*/
+type Transfer struct {
+	receiver *Receiver
+	mutex    sync.Mutex
+	state    transferState
+	file     File
+	unsaved  int64 // bytes written since the ranges were stored
+}
+
+/*
+transferState is the content of the sidecar file of a Transfer.
+*/
+type transferState struct {
+	Identification string
+	Content        string      // expected content hash, verified when finishing
+	Size           int64       // expected size
+	Mode           os.FileMode `json:",omitempty"` // applied when finishing
+	Ranges         []ByteRange // received, sorted and not overlapping
+}
+
+/*
+CreateReceiver returns the Receiver of the Tinzenite or encrypted directory at
+root.
+*/
+func CreateReceiver(root string) (*Receiver, error) {
+	kind := DetectDirKind(root)
+	if kind == DkNone {
+		return nil, ErrNotTinzenite
+	}
+	return &Receiver{
+		dir:    layoutBase(root, kind) + "/" + RECEIVINGDIR,
+		active: make(map[string]*Transfer)}, nil
+}
+
+/*
+Start returns the Transfer for the given file object, resuming an earlier one if
+it is for the same content. A staged transfer of other content, for example of
+an older version, is discarded.
+*/
+func (r *Receiver) Start(obj *ObjectInfo) (*Transfer, error) {
+	id := obj.Identification
+	if id == "" || strings.ContainsAny(id, "/\\") || strings.HasPrefix(id, ".") || obj.Directory {
+		return nil, ErrIllegalParameters
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if t, exists := r.active[id]; exists {
+		t.mutex.Lock()
+		open := t.file != nil
+		if open && t.state.Content == obj.Content && t.state.Size == obj.Size {
+			t.mutex.Unlock()
+			return t, nil
+		}
+		if open {
+			t.discard()
+		}
+		t.mutex.Unlock()
+		// a closed transfer is resumed from its files below
+		delete(r.active, id)
+	}
+	t := &Transfer{receiver: r}
+	err := loadWithBackup(r.statePath(id), func(data []byte) error {
+		return json.Unmarshal(data, &t.state)
+	})
+	if err != nil || t.state.Content != obj.Content || t.state.Size != obj.Size {
+		// start over, removing anything left
+		FS.Remove(r.dir + "/" + id)
+		t.state = transferState{Identification: id, Content: obj.Content, Size: obj.Size}
+	}
+	t.state.Mode = obj.Mode
+	t.file, err = FS.OpenFile(r.dir+"/"+id, os.O_RDWR|os.O_CREATE, Permissions.PrivateFile)
+	if err != nil {
+		return nil, err
+	}
+	// ranges beyond the end of the staging file were never written durably
+	stat, err := t.file.Stat()
+	if err != nil {
+		t.file.Close()
+		return nil, err
+	}
+	t.state.Ranges = clipRanges(t.state.Ranges, stat.Size())
+	err = t.store()
+	if err != nil {
+		t.file.Close()
+		return nil, err
+	}
+	r.active[id] = t
+	return t, nil
+}
+
+/*
+Pending returns the identifications of all staged transfers, including those of
+earlier runs that can be resumed.
+*/
+func (r *Receiver) Pending() ([]string, error) {
+	stats, err := FS.ReadDir(r.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, stat := range stats {
+		name := strings.TrimSuffix(stat.Name(), BACKUPENDING)
+		if !strings.HasSuffix(name, ENDING) || strings.HasPrefix(name, ".") {
+			continue
+		}
+		id := strings.TrimSuffix(name, ENDING)
+		if !Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+/*
+Discard removes the staged transfer with the given identification.
+*/
+func (r *Receiver) Discard(id string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if t, exists := r.active[id]; exists {
+		delete(r.active, id)
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		return t.discard()
+	}
+	return r.remove(id)
+}
+
+/*
+WriteAt writes received data at the given offset. The ranges are stored every
+receivingFlush bytes; call Flush to store them earlier.
+*/
+func (t *Transfer) WriteAt(data []byte, offset int64) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.file == nil {
+		return os.ErrClosed
+	}
+	end := offset + int64(len(data))
+	if offset < 0 || end > t.state.Size {
+		return ErrIllegalParameters
+	}
+	_, err := t.file.WriteAt(data, offset)
+	if err != nil {
+		return err
+	}
+	t.state.Ranges = addRange(t.state.Ranges, ByteRange{Start: offset, End: end})
+	t.unsaved += int64(len(data))
+	if t.unsaved >= receivingFlush {
+		return t.flush()
+	}
+	return nil
+}
+
+/*
+Flush makes all data written so far durable and stores the received ranges.
+*/
+func (t *Transfer) Flush() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.file == nil {
+		return os.ErrClosed
+	}
+	return t.flush()
+}
+
+/*
+Missing returns the ranges that have not been received yet.
+*/
+func (t *Transfer) Missing() []ByteRange {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var missing []ByteRange
+	var position int64
+	for _, received := range t.state.Ranges {
+		if received.Start > position {
+			missing = append(missing, ByteRange{Start: position, End: received.Start})
+		}
+		position = received.End
+	}
+	if position < t.state.Size {
+		missing = append(missing, ByteRange{Start: position, End: t.state.Size})
+	}
+	return missing
+}
+
+/*
+Received returns the amount of bytes received so far.
+*/
+func (t *Transfer) Received() int64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var received int64
+	for _, value := range t.state.Ranges {
+		received += value.End - value.Start
+	}
+	return received
+}
+
+/*
+Complete returns whether all data has been received.
+*/
+func (t *Transfer) Complete() bool {
+	return len(t.Missing()) == 0
+}
+
+/*
+Finish verifies the complete transfer against the expected content hash and
+atomically moves it to path. On a mismatch the transfer is discarded and
+ErrContentMismatch returned. Returns ErrIllegalFileState if data is missing.
+*/
+func (t *Transfer) Finish(path string) error {
+	if !t.Complete() {
+		return ErrIllegalFileState
+	}
+	err := t.finish(path)
+	t.forget()
+	return err
+}
+
+func (t *Transfer) finish(path string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.file == nil {
+		return os.ErrClosed
+	}
+	err := t.file.Sync()
+	if err != nil {
+		return err
+	}
+	staging := t.receiver.dir + "/" + t.state.Identification
+	if t.state.Content != "" {
+		matches, err := HashMatches(staging, t.state.Content)
+		if err != nil {
+			return err
+		}
+		if !matches {
+			t.discard()
+			return ErrContentMismatch
+		}
+	}
+	if t.state.Mode != 0 {
+		err = FS.Chmod(staging, t.state.Mode)
+		if err != nil {
+			return err
+		}
+	}
+	err = FS.Rename(staging, path)
+	if err != nil {
+		return err
+	}
+	dir, _ := splitFilePath(path)
+	err = syncDirectory(dir)
+	if err != nil {
+		return err
+	}
+	return t.discard()
+}
+
+/*
+Close stores the received ranges and closes the staging file so that the
+transfer can be resumed later.
+*/
+func (t *Transfer) Close() error {
+	t.mutex.Lock()
+	if t.file == nil {
+		t.mutex.Unlock()
+		return nil
+	}
+	err := t.flush()
+	closeErr := t.file.Close()
+	t.file = nil
+	t.mutex.Unlock()
+	t.forget()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+/*
+flush syncs the staging file before storing the ranges, so that the sidecar
+never claims data that could still be lost.
+*/
+func (t *Transfer) flush() error {
+	err := t.file.Sync()
+	if err != nil {
+		return err
+	}
+	t.unsaved = 0
+	return t.store()
+}
+
+func (t *Transfer) store() error {
+	data, err := json.Marshal(&t.state)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(t.receiver.statePath(t.state.Identification), data, Permissions.PrivateFile, false)
+}
+
+/*
+discard closes and removes the transfer. The mutex of the transfer must be
+held; it stays in the active transfers of the receiver until forgotten.
+*/
+func (t *Transfer) discard() error {
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+	return t.receiver.remove(t.state.Identification)
+}
+
+/*
+forget removes the transfer from the active ones of the receiver once it has
+been closed. The receiver mutex is always taken before the transfer mutex, so
+the latter must not be held.
+*/
+func (t *Transfer) forget() {
+	r := t.receiver
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	t.mutex.Lock()
+	closed := t.file == nil
+	t.mutex.Unlock()
+	if active := r.active[t.state.Identification]; closed && active == t {
+		delete(r.active, t.state.Identification)
+	}
+}
+
+/*
+remove deletes all files of the transfer with the given identification.
+*/
+func (r *Receiver) remove(id string) error {
+	for _, path := range []string{r.dir + "/" + id, r.statePath(id), r.statePath(id) + BACKUPENDING} {
+		err := FS.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Receiver) statePath(id string) string {
+	return r.dir + "/" + id + ENDING
+}
+
+/*
+addRange inserts value into the sorted ranges, merging overlapping and adjacent
+ones.
+*/
+func addRange(ranges []ByteRange, value ByteRange) []ByteRange {
+	if value.Start >= value.End {
+		return ranges
+	}
+	ranges = append(ranges, value)
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Start < ranges[j].Start
+	})
+	merged := ranges[:1]
+	for _, next := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if next.Start <= last.End {
+			if next.End > last.End {
+				last.End = next.End
+			}
+			continue
+		}
+		merged = append(merged, next)
+	}
+	return merged
+}
+
+/*
+clipRanges removes everything beyond size from the ranges.
+*/
+func clipRanges(ranges []ByteRange, size int64) []ByteRange {
+	var clipped []ByteRange
+	for _, value := range ranges {
+		if value.End > size {
+			value.End = size
+		}
+		if value.Start < value.End {
+			clipped = append(clipped, value)
+		}
+	}
+	return clipped
+}
@@ -0,0 +1,139 @@
+package shared
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestReceiver_Resume(t *testing.T) {
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	err := MakeTinzeniteDir(root)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	content := bytes.Repeat([]byte("tinzenite"), 1000)
+	writeTestFiles(t, root, map[string]string{"original": string(content)})
+	hash, _ := ContentHash(root + "/original")
+	obj := &ObjectInfo{Identification: "abc", Content: hash, Size: int64(len(content)), Mode: 0600}
+	receiver, err := CreateReceiver(root)
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	transfer, err := receiver.Start(obj)
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	transfer.WriteAt(content[:1000], 0)
+	transfer.WriteAt(content[5000:6000], 5000)
+	transfer.WriteAt(content[1000:2000], 1000)
+	if transfer.Finish(root+"/copy") != ErrIllegalFileState {
+		t.Error("Expected incomplete transfer to fail")
+	}
+	err = transfer.Close()
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	// a restart resumes where the transfer stopped
+	receiver, _ = CreateReceiver(root)
+	pending, err := receiver.Pending()
+	if err != nil || len(pending) != 1 || pending[0] != "abc" {
+		t.Error("Expected pending abc, got", pending, err)
+	}
+	transfer, err = receiver.Start(obj)
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	missing := transfer.Missing()
+	want := []ByteRange{{2000, 5000}, {6000, int64(len(content))}}
+	if len(missing) != len(want) || missing[0] != want[0] || missing[1] != want[1] {
+		t.Error("Expected", want, "got", missing)
+	}
+	if transfer.Received() != 3000 {
+		t.Error("Expected", 3000, "got", transfer.Received())
+	}
+	for _, part := range missing {
+		transfer.WriteAt(content[part.Start:part.End], part.Start)
+	}
+	err = transfer.Finish(root + "/copy")
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	data, _ := os.ReadFile(root + "/copy")
+	stat, _ := os.Stat(root + "/copy")
+	if !bytes.Equal(data, content) || stat.Mode().Perm() != 0600 {
+		t.Error("Expected received content with mode 0600, got", stat.Mode())
+	}
+	pending, _ = receiver.Pending()
+	if len(pending) != 0 {
+		t.Error("Expected no pending transfers, got", pending)
+	}
+}
+
+func TestReceiver_Mismatch(t *testing.T) {
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	err := MakeTinzeniteDir(root)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	writeTestFiles(t, root, map[string]string{"original": "expected"})
+	hash, _ := ContentHash(root + "/original")
+	receiver, _ := CreateReceiver(root)
+	_, err = receiver.Start(&ObjectInfo{Identification: "../x", Size: 1})
+	if err != ErrIllegalParameters {
+		t.Error("Expected illegal parameters, got", err)
+	}
+	transfer, err := receiver.Start(&ObjectInfo{Identification: "abc", Content: hash, Size: 8})
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	if transfer.WriteAt([]byte("too long!"), 0) != ErrIllegalParameters {
+		t.Error("Expected write beyond size to fail")
+	}
+	transfer.WriteAt([]byte("corrupt!"), 0)
+	err = transfer.Finish(root + "/copy")
+	if err != ErrContentMismatch {
+		t.Error("Expected", ErrContentMismatch, "got", err)
+	}
+	if _, err := os.Stat(root + "/copy"); !os.IsNotExist(err) {
+		t.Error("Expected no file to be moved into place")
+	}
+	pending, _ := receiver.Pending()
+	if len(pending) != 0 {
+		t.Error("Expected mismatching transfer to be discarded, got", pending)
+	}
+}
+
+func TestReceiver_Concurrent(t *testing.T) {
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	err := MakeTinzeniteDir(root)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	receiver, _ := CreateReceiver(root)
+	obj := &ObjectInfo{Identification: "abc", Size: 4}
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			defer func() { done <- true }()
+			for j := 0; j < 20; j++ {
+				transfer, err := receiver.Start(obj)
+				if err != nil {
+					continue
+				}
+				transfer.WriteAt([]byte("a"), int64(i))
+				if j%2 == 0 {
+					transfer.Close()
+				} else {
+					receiver.Discard("abc")
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+}
@@ -0,0 +1,336 @@
+package shared
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+DirectoryEntry is a Tinzenite directory registered on this machine.
+*/
+type DirectoryEntry struct {
+	Path       string // absolute path of the directory
+	Kind       DirKind
+	Name       string
+	Added      time.Time
+	LastOpened time.Time `json:",omitzero"`
+}
+
+/*
+registryFile is the content of the REGISTRYJSON file.
+*/
+type registryFile struct {
+	Directories []DirectoryEntry
+}
+
+// serializes access within the process, the file lock only works across them
+var registryMutex sync.RWMutex
+
+/*
+RegisterDirectory adds the directory at path to the registry. If it already is
+registered, only the kind and name are updated. An empty name defaults to the
+last element of the path.
+*/
+func RegisterDirectory(path string, kind DirKind, name string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	path = filepath.ToSlash(path)
+	if name == "" {
+		name = lastElement(path)
+	}
+	return updateRegistry(func(registry *registryFile) error {
+		if entry := registry.find(path); entry != nil {
+			entry.Kind = kind
+			entry.Name = name
+			return nil
+		}
+		registry.Directories = append(registry.Directories, DirectoryEntry{
+			Path:  path,
+			Kind:  kind,
+			Name:  name,
+			Added: time.Now()})
+		return nil
+	})
+}
+
+/*
+UnregisterDirectory removes the directory at path from the registry. Paths that
+are not registered are ignored.
+*/
+func UnregisterDirectory(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	path = filepath.ToSlash(path)
+	return updateRegistry(func(registry *registryFile) error {
+		registry.remove(func(entry DirectoryEntry) bool {
+			return entry.Path == path
+		})
+		return nil
+	})
+}
+
+/*
+TouchDirectory sets the time the registered directory at path was last opened to
+now. Returns ErrNotRegistered if the path is not registered.
+*/
+func TouchDirectory(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	path = filepath.ToSlash(path)
+	return updateRegistry(func(registry *registryFile) error {
+		entry := registry.find(path)
+		if entry == nil {
+			return ErrNotRegistered
+		}
+		entry.LastOpened = time.Now()
+		return nil
+	})
+}
+
+/*
+ListDirectories returns all registered directories in the order they were
+added. Nothing is written, so neither the configuration directory nor the lock
+file is created if the registry does not exist yet.
+*/
+func ListDirectories() ([]DirectoryEntry, error) {
+	dir, err := configDirectory()
+	if err != nil {
+		return nil, err
+	}
+	registry := &registryFile{}
+	path := dir + "/" + REGISTRYJSON
+	if registryMissing(path) {
+		// only the file of older versions may exist
+		err = registry.migrate()
+		if err != nil {
+			return nil, err
+		}
+		return registry.Directories, nil
+	}
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	unlock, err := lockRegistry(path+".lock", true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	err = registry.load(path)
+	if err != nil {
+		return nil, err
+	}
+	return registry.Directories, nil
+}
+
+/*
+PruneDirectories removes all directories from the registry that no longer exist
+or are no Tinzenite directory of their kind. Returns the removed entries.
+*/
+func PruneDirectories() ([]DirectoryEntry, error) {
+	var pruned []DirectoryEntry
+	err := updateRegistry(func(registry *registryFile) error {
+		registry.remove(func(entry DirectoryEntry) bool {
+			if DetectDirKind(entry.Path) == entry.Kind {
+				return false
+			}
+			pruned = append(pruned, entry)
+			return true
+		})
+		if len(pruned) == 0 {
+			return errRegistryUnchanged
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pruned, nil
+}
+
+/*
+updateRegistry loads the registry while holding its lock, applies modify and
+stores the result. If modify returns errRegistryUnchanged nothing is written.
+The old DIRECTORYLIST file is migrated if no registry exists yet; it is left in
+place for older versions.
+*/
+func updateRegistry(modify func(registry *registryFile) error) error {
+	dir, err := configDirectory()
+	if err != nil {
+		return err
+	}
+	err = makeDirectoryMode(dir, Permissions.PrivateDir)
+	if err != nil {
+		return err
+	}
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	unlock, err := lockRegistry(dir+"/"+REGISTRYJSON+".lock", false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	registry := &registryFile{}
+	path := dir + "/" + REGISTRYJSON
+	err = registry.load(path)
+	if err != nil {
+		return err
+	}
+	err = modify(registry)
+	if err == errRegistryUnchanged {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(registry, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, data, Permissions.PrivateFile, true)
+}
+
+/*
+load reads the registry at path. The old DIRECTORYLIST file is migrated if no
+registry exists yet.
+*/
+func (r *registryFile) load(path string) error {
+	err := loadWithBackup(path, func(data []byte) error {
+		*r = registryFile{}
+		return json.Unmarshal(data, r)
+	})
+	if os.IsNotExist(err) {
+		return r.migrate()
+	}
+	return err
+}
+
+/*
+registryMissing returns whether neither the registry at path nor its backup
+exist.
+*/
+func registryMissing(path string) bool {
+	_, err := FS.Lstat(path)
+	_, backupErr := FS.Lstat(path + BACKUPENDING)
+	return os.IsNotExist(err) && os.IsNotExist(backupErr)
+}
+
+/*
+lockRegistry locks the file at path against other processes, shared with other
+readers if shared is set. Readers never create the file: if it is missing,
+nobody has written the registry under the lock and the atomic writes suffice.
+Files not backed by the operating system can not be locked, but are private to
+the process anyway.
+*/
+func lockRegistry(path string, shared bool) (func(), error) {
+	var file File
+	var err error
+	if shared {
+		file, err = FS.Open(path)
+		if os.IsNotExist(err) {
+			return func() {}, nil
+		}
+	} else {
+		file, err = FS.OpenFile(path, os.O_RDWR|os.O_CREATE, Permissions.PrivateFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = lockFile(file, true, shared)
+	if err == ErrUnsupported {
+		return func() { file.Close() }, nil
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return func() {
+		unlockFile(file)
+		file.Close()
+	}, nil
+}
+
+/*
+migrate reads the paths of the DIRECTORYLIST file of older versions. They are
+normalized like the paths of RegisterDirectory.
+*/
+func (r *registryFile) migrate() error {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	data, err := readFile(FS, filepath.ToSlash(home)+"/.config/tinzenite/"+DIRECTORYLIST)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, path := range strings.Split(string(data), "\n") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		path = filepath.ToSlash(path)
+		if r.find(path) != nil {
+			continue
+		}
+		kind := DetectDirKind(path)
+		if kind == DkNone {
+			kind = DkTinzenite
+		}
+		r.Directories = append(r.Directories, DirectoryEntry{
+			Path:  path,
+			Kind:  kind,
+			Name:  lastElement(path),
+			Added: now})
+	}
+	return nil
+}
+
+func (r *registryFile) find(path string) *DirectoryEntry {
+	for i := range r.Directories {
+		if r.Directories[i].Path == path {
+			return &r.Directories[i]
+		}
+	}
+	return nil
+}
+
+func (r *registryFile) remove(matches func(entry DirectoryEntry) bool) {
+	kept := r.Directories[:0]
+	for _, entry := range r.Directories {
+		if !matches(entry) {
+			kept = append(kept, entry)
+		}
+	}
+	r.Directories = kept
+}
+
+/*
+configDirectory returns the directory for the machine wide configuration of
+Tinzenite, honoring XDG_CONFIG_HOME.
+*/
+func configDirectory() (string, error) {
+	if config := os.Getenv("XDG_CONFIG_HOME"); filepath.IsAbs(config) {
+		return filepath.ToSlash(config) + "/tinzenite", nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(home) + "/.config/tinzenite", nil
+}
@@ -0,0 +1,127 @@
+package shared
+
+import (
+	"os"
+	"sync"
+	"testing"
+)
+
+func Test_RegisterDirectory(t *testing.T) {
+	config := makeTempDir("", "config")
+	defer removeTemp(config)
+	t.Setenv("XDG_CONFIG_HOME", config)
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	err := MakeTinzeniteDir(root)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	err = RegisterDirectory(root, DkTinzenite, "photos")
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	if _, err := os.Stat(config + "/tinzenite/" + REGISTRYJSON); err != nil {
+		t.Error("Expected registry in XDG_CONFIG_HOME, got", err)
+	}
+	err = TouchDirectory(root)
+	if err != nil {
+		t.Error("Expected no error, got", err)
+	}
+	entries, err := ListDirectories()
+	if err != nil || len(entries) != 1 {
+		t.Fatal("Expected one entry, got", entries, err)
+	}
+	entry := entries[0]
+	if entry.Path != root || entry.Name != "photos" || entry.Kind != DkTinzenite ||
+		entry.Added.IsZero() || entry.LastOpened.IsZero() {
+		t.Error("Expected complete entry, got", entry)
+	}
+	err = TouchDirectory(config)
+	if err != ErrNotRegistered {
+		t.Error("Expected", ErrNotRegistered, "got", err)
+	}
+	// old wrappers
+	paths, err := ReadDirectoryList()
+	if err != nil || len(paths) != 1 || paths[0] != root {
+		t.Error("Expected", root, "got", paths, err)
+	}
+	err = RemoveDotTinzenite(root)
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	paths, _ = ReadDirectoryList()
+	if len(paths) != 0 {
+		t.Error("Expected removed directory to be unregistered, got", paths)
+	}
+}
+
+func Test_ListDirectoriesMissing(t *testing.T) {
+	config := makeTempDir("", "config")
+	defer removeTemp(config)
+	t.Setenv("XDG_CONFIG_HOME", config)
+	entries, err := ListDirectories()
+	if err != nil || len(entries) != 0 {
+		t.Error("Expected no entries, got", entries, err)
+	}
+	if _, err := os.Lstat(config + "/tinzenite"); !os.IsNotExist(err) {
+		t.Error("Expected listing not to create the configuration directory")
+	}
+	// an existing but empty configuration directory stays untouched too
+	os.Mkdir(config+"/tinzenite", 0700)
+	entries, err = ListDirectories()
+	if err != nil || len(entries) != 0 {
+		t.Error("Expected no entries, got", entries, err)
+	}
+	if _, err := os.Lstat(config + "/tinzenite/" + REGISTRYJSON + ".lock"); !os.IsNotExist(err) {
+		t.Error("Expected listing not to create the lock file")
+	}
+}
+
+func Test_PruneDirectories(t *testing.T) {
+	config := makeTempDir("", "config")
+	defer removeTemp(config)
+	t.Setenv("XDG_CONFIG_HOME", config)
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	kept := root + "/kept"
+	MakeTinzeniteDir(kept)
+	var wait sync.WaitGroup
+	for _, path := range []string{kept, root + "/gone", root + "/other"} {
+		wait.Add(1)
+		go func(path string) {
+			defer wait.Done()
+			err := WriteDirectoryList(path)
+			if err != nil {
+				t.Error("Expected no error, got", err)
+			}
+		}(path)
+	}
+	wait.Wait()
+	entries, _ := ListDirectories()
+	if len(entries) != 3 {
+		t.Fatal("Expected concurrent registrations to be kept, got", entries)
+	}
+	pruned, err := PruneDirectories()
+	if err != nil || len(pruned) != 2 {
+		t.Error("Expected 2 pruned entries, got", pruned, err)
+	}
+	paths, _ := ReadDirectoryList()
+	if len(paths) != 1 || paths[0] != kept {
+		t.Error("Expected", kept, "got", paths)
+	}
+}
+
+func Test_registryMigration(t *testing.T) {
+	defer func(old FileSystem) { FS = old }(FS)
+	FS = CreateMemFileSystem()
+	t.Setenv("XDG_CONFIG_HOME", "/config")
+	t.Setenv("HOME", "/home")
+	legacy := "/home/.config/tinzenite/" + DIRECTORYLIST
+	FS.MkdirAll("/home/.config/tinzenite", 0700)
+	// paths are normalized, so duplicates differing in form are merged
+	writeFile(FS, legacy, []byte("/data/one\n/data/two/\n\n/data/../data/one\n"), 0600)
+	paths, err := ReadDirectoryList()
+	if err != nil || len(paths) != 2 || paths[0] != "/data/one" || paths[1] != "/data/two" {
+		t.Error("Expected migrated paths, got", paths, err)
+	}
+}
@@ -0,0 +1,363 @@
+package shared
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Tombstone records the removal of an object. It is stored in REMOVEDIR below a
+directory named by the object identification: REMOVECHECKDIR holds an empty
+file for every peer that must acknowledge the removal and REMOVEDONEDIR one for
+every peer that has. Because every peer only ever adds its own file, the
+directories synchronize between peers without conflicts.
+*/
+type Tombstone struct {
+	Identification string
+	Path           string  // subpath of the object when it was removed
+	Version        Version // version of the object when it was removed
+	Removed        time.Time
+	Completed      time.Time `json:",omitzero"` // set once all peers have acknowledged
+	Check          []string  `json:"-"`         // peers that must acknowledge
+	Done           []string  `json:"-"`         // peers that have acknowledged
+}
+
+/*
+Missing returns the peers that have not acknowledged the removal yet.
+*/
+func (t *Tombstone) Missing() []string {
+	var missing []string
+	for _, peer := range t.Check {
+		if !Contains(t.Done, peer) {
+			missing = append(missing, peer)
+		}
+	}
+	return missing
+}
+
+/*
+Complete returns whether all peers have acknowledged the removal. A tombstone
+without any peers to check is incomplete, as its REMOVECHECKDIR may not have
+been synchronized yet.
+*/
+func (t *Tombstone) Complete() bool {
+	return len(t.Check) > 0 && len(t.Missing()) == 0
+}
+
+/*
+RemovalTracker keeps the tombstones of a Tinzenite directory so that removed
+objects are not resurrected by peers that were offline during the removal.
+Peers acknowledge a removal, usually by replying with a NoRemoved notification,
+once they have applied it. Completed removals are moved to REMOVESTOREDIR, which
+is never synchronized, and forgotten after a retention period. All methods are
+safe for concurrent use.
+*/
+type RemovalTracker struct {
+	root  string
+	self  string
+	mutex sync.Mutex
+}
+
+/*
+CreateRemovalTracker returns the RemovalTracker of the Tinzenite directory at
+root for the local peer with the identification self.
+*/
+func CreateRemovalTracker(root, self string) (*RemovalTracker, error) {
+	if self == "" {
+		return nil, ErrIllegalParameters
+	}
+	if !IsTinzenite(root) {
+		return nil, ErrNotTinzenite
+	}
+	return &RemovalTracker{root: root, self: self}, nil
+}
+
+/*
+Remove creates the tombstone for the given object. All given peers must
+acknowledge the removal; the local peer has applied it already. If a tombstone
+exists, the given peers are added to it.
+*/
+func (r *RemovalTracker) Remove(obj *ObjectInfo, peers []string) (*Tombstone, error) {
+	if !validRemovalName(obj.Identification) {
+		return nil, ErrIllegalParameters
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	tomb, err := r.get(obj.Identification)
+	if os.IsNotExist(err) {
+		tomb = &Tombstone{
+			Identification: obj.Identification,
+			Path:           obj.Path,
+			Version:        obj.Version.Copy(),
+			Removed:        time.Now()}
+		err = r.makeDir(r.tombPath(obj.Identification))
+		if err == nil {
+			err = r.store(tomb)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, peer := range append([]string{r.self}, peers...) {
+		if !validRemovalName(peer) {
+			return nil, ErrIllegalParameters
+		}
+		err = r.mark(obj.Identification, REMOVECHECKDIR, peer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = r.mark(obj.Identification, REMOVEDONEDIR, r.self)
+	if err != nil {
+		return nil, err
+	}
+	return r.get(obj.Identification)
+}
+
+/*
+Acknowledge records that peer has applied the removal of the object with the
+given identification. Returns ErrUntracked if no tombstone exists.
+*/
+func (r *RemovalTracker) Acknowledge(id, peer string) error {
+	if !validRemovalName(id) || !validRemovalName(peer) {
+		return ErrIllegalParameters
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	exists, err := r.exists(r.tombPath(id))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrUntracked
+	}
+	return r.mark(id, REMOVEDONEDIR, peer)
+}
+
+/*
+Get returns the tombstone of the object with the given identification. Returns
+ErrUntracked if no tombstone exists.
+*/
+func (r *RemovalTracker) Get(id string) (*Tombstone, error) {
+	if !validRemovalName(id) {
+		return nil, ErrIllegalParameters
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	tomb, err := r.get(id)
+	if os.IsNotExist(err) {
+		return nil, ErrUntracked
+	}
+	return tomb, err
+}
+
+/*
+Tombstones returns all tombstones sorted by identification.
+*/
+func (r *RemovalTracker) Tombstones() ([]*Tombstone, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	ids, err := r.list(r.removePath())
+	if err != nil {
+		return nil, err
+	}
+	var tombs []*Tombstone
+	for _, id := range ids {
+		tomb, err := r.get(id)
+		if err != nil {
+			// may still be incomplete if it is currently synchronized
+			continue
+		}
+		tombs = append(tombs, tomb)
+	}
+	return tombs, nil
+}
+
+/*
+IsRemoved returns whether the object with the given identification has been
+removed, either by a tombstone or by a completed removal that has not been
+forgotten yet. Updates for such objects must not be applied.
+*/
+func (r *RemovalTracker) IsRemoved(id string) bool {
+	if !validRemovalName(id) {
+		return false
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, path := range []string{r.tombPath(id), r.storePath(id)} {
+		if exists, _ := r.exists(path); exists {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Collect removes all completed tombstones, keeping a record of them in
+REMOVESTOREDIR, and forgets records that were completed longer than retention
+ago. Returns the identifications of all collected tombstones.
+*/
+func (r *RemovalTracker) Collect(retention time.Duration) ([]string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	ids, err := r.list(r.removePath())
+	if err != nil {
+		return nil, err
+	}
+	var collected []string
+	for _, id := range ids {
+		tomb, err := r.get(id)
+		if err != nil || !tomb.Complete() {
+			continue
+		}
+		tomb.Completed = time.Now()
+		data, err := json.MarshalIndent(tomb, "", "  ")
+		if err != nil {
+			return collected, err
+		}
+		err = WriteFileAtomic(r.storePath(id), data, Permissions.PrivateFile, false)
+		if err != nil {
+			return collected, err
+		}
+		err = FS.RemoveAll(r.tombPath(id))
+		if err != nil {
+			return collected, err
+		}
+		collected = append(collected, id)
+	}
+	stored, err := r.list(r.root + "/" + TINZENITEDIR + "/" + LOCALDIR + "/" + REMOVESTOREDIR)
+	if err != nil {
+		return collected, err
+	}
+	for _, id := range stored {
+		tomb := &Tombstone{}
+		err := loadWithBackup(r.storePath(id), func(data []byte) error {
+			return json.Unmarshal(data, tomb)
+		})
+		if err != nil || time.Since(tomb.Completed) < retention {
+			continue
+		}
+		err = FS.Remove(r.storePath(id))
+		if err != nil && !os.IsNotExist(err) {
+			return collected, err
+		}
+	}
+	return collected, nil
+}
+
+/*
+get reads the tombstone of the given identification including its peers.
+*/
+func (r *RemovalTracker) get(id string) (*Tombstone, error) {
+	tomb := &Tombstone{}
+	err := loadWithBackup(r.tombPath(id)+"/"+id+ENDING, func(data []byte) error {
+		return json.Unmarshal(data, tomb)
+	})
+	if err != nil {
+		return nil, err
+	}
+	tomb.Check, err = r.list(r.tombPath(id) + "/" + REMOVECHECKDIR)
+	if err != nil {
+		return nil, err
+	}
+	tomb.Done, err = r.list(r.tombPath(id) + "/" + REMOVEDONEDIR)
+	if err != nil {
+		return nil, err
+	}
+	return tomb, nil
+}
+
+func (r *RemovalTracker) store(tomb *Tombstone) error {
+	data, err := json.MarshalIndent(tomb, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := r.tombPath(tomb.Identification) + "/" + tomb.Identification + ENDING
+	// REMOVEDIR is synchronized, so the temporary file is kept in TEMPDIR
+	staging := r.root + "/" + TINZENITEDIR + "/" + TEMPDIR
+	return writeFileStaged(path, data, Permissions.Mode(r.subpath(path), false, false), staging)
+}
+
+/*
+mark creates the empty file of peer in the given sub directory of a tombstone.
+*/
+func (r *RemovalTracker) mark(id, dir, peer string) error {
+	path := r.tombPath(id) + "/" + dir
+	err := r.makeDir(path)
+	if err != nil {
+		return err
+	}
+	path += "/" + peer
+	if exists, err := r.exists(path); exists || err != nil {
+		return err
+	}
+	err = writeFile(FS, path, nil, Permissions.Mode(r.subpath(path), false, false))
+	if err != nil {
+		return err
+	}
+	return syncDirectory(r.tombPath(id) + "/" + dir)
+}
+
+func (r *RemovalTracker) makeDir(path string) error {
+	return makeDirectoryMode(path, Permissions.Mode(r.subpath(path), true, false))
+}
+
+/*
+list returns the sorted names of all entries in the directory at path, ignoring
+backups and temporary files. A missing directory is empty.
+*/
+func (r *RemovalTracker) list(path string) ([]string, error) {
+	stats, err := FS.ReadDir(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, stat := range stats {
+		name := stat.Name()
+		if strings.HasPrefix(name, ".") || strings.HasSuffix(name, BACKUPENDING) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (r *RemovalTracker) exists(path string) (bool, error) {
+	_, err := FS.Lstat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (r *RemovalTracker) removePath() string {
+	return r.root + "/" + TINZENITEDIR + "/" + REMOVEDIR
+}
+
+func (r *RemovalTracker) tombPath(id string) string {
+	return r.removePath() + "/" + id
+}
+
+func (r *RemovalTracker) storePath(id string) string {
+	return r.root + "/" + TINZENITEDIR + "/" + LOCALDIR + "/" + REMOVESTOREDIR + "/" + id
+}
+
+func (r *RemovalTracker) subpath(path string) string {
+	return strings.TrimPrefix(path, r.root+"/")
+}
+
+/*
+validRemovalName returns whether name can be used as a file name in the removal
+directories.
+*/
+func validRemovalName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "/\\") && !strings.HasPrefix(name, ".")
+}
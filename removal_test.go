@@ -0,0 +1,99 @@
+package shared
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRemovalTracker_Collect(t *testing.T) {
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	err := MakeTinzeniteDir(root)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	if _, err := CreateRemovalTracker(root, ""); err != ErrIllegalParameters {
+		t.Error("Expected", ErrIllegalParameters, "got", err)
+	}
+	tracker, err := CreateRemovalTracker(root, "self")
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	obj := &ObjectInfo{Identification: "abc", Path: "dir/file", Version: Version{"self": 2}}
+	tomb, err := tracker.Remove(obj, []string{"a", "b"})
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	missing := tomb.Missing()
+	if tomb.Path != "dir/file" || len(missing) != 2 || missing[0] != "a" || missing[1] != "b" {
+		t.Error("Expected a and b to be missing, got", missing)
+	}
+	if !tracker.IsRemoved("abc") || tracker.IsRemoved("other") {
+		t.Error("Expected only abc to be removed")
+	}
+	if tracker.Acknowledge("other", "a") != ErrUntracked {
+		t.Error("Expected untracked acknowledgement to fail")
+	}
+	tracker.Acknowledge("abc", "a")
+	collected, err := tracker.Collect(time.Hour)
+	if err != nil || len(collected) != 0 {
+		t.Error("Expected incomplete removal to be kept, got", collected, err)
+	}
+	// a peer that is offline can acknowledge later, even to a new tracker
+	tracker, _ = CreateRemovalTracker(root, "self")
+	tracker.Acknowledge("abc", "b")
+	tomb, err = tracker.Get("abc")
+	if err != nil || !tomb.Complete() || tomb.Version["self"] != 2 {
+		t.Error("Expected complete tombstone, got", tomb, err)
+	}
+	collected, err = tracker.Collect(time.Hour)
+	if err != nil || len(collected) != 1 || collected[0] != "abc" {
+		t.Error("Expected abc to be collected, got", collected, err)
+	}
+	if _, err := os.Stat(root + "/" + TINZENITEDIR + "/" + REMOVEDIR + "/abc"); !os.IsNotExist(err) {
+		t.Error("Expected tombstone to be removed")
+	}
+	// the completed removal is still known until the retention passed
+	if !tracker.IsRemoved("abc") {
+		t.Error("Expected abc to still be removed")
+	}
+	if _, err := tracker.Get("abc"); err != ErrUntracked {
+		t.Error("Expected", ErrUntracked, "got", err)
+	}
+	tracker.Collect(0)
+	if tracker.IsRemoved("abc") {
+		t.Error("Expected abc to be forgotten")
+	}
+	tombs, err := tracker.Tombstones()
+	if err != nil || len(tombs) != 0 {
+		t.Error("Expected no tombstones, got", tombs, err)
+	}
+}
+
+func TestRemovalTracker_Incomplete(t *testing.T) {
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	err := MakeTinzeniteDir(root)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	tracker, _ := CreateRemovalTracker(root, "self")
+	obj := &ObjectInfo{Identification: "abc", Version: Version{"self": 1}}
+	tracker.Remove(obj, nil)
+	obj.Version.Increase("self")
+	tomb, _ := tracker.Get("abc")
+	if tomb.Version["self"] != 1 {
+		t.Error("Expected tombstone to keep its own version, got", tomb.Version)
+	}
+	// only the record has been synchronized, the check files are missing
+	os.RemoveAll(root + "/" + TINZENITEDIR + "/" + REMOVEDIR + "/abc/" + REMOVECHECKDIR)
+	tomb, _ = tracker.Get("abc")
+	if tomb.Complete() {
+		t.Error("Expected tombstone without check files to be incomplete")
+	}
+	collected, err := tracker.Collect(time.Hour)
+	if err != nil || len(collected) != 0 {
+		t.Error("Expected nothing to be collected, got", collected, err)
+	}
+}
@@ -0,0 +1,346 @@
+package shared
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+REPAIRATTEMPTS is the default amount of peers asked for a missing object before
+the repair is given up.
+*/
+const REPAIRATTEMPTS = 3
+
+/*
+RepairPeer is a peer that can be asked for objects by the RepairCoordinator.
+Implementations usually send a RequestMessage; tests may use fake peers.
+*/
+type RepairPeer interface {
+	// Identification of the peer.
+	Identification() string
+	// Storage returns whether the peer is an encrypted storage peer, which is
+	// only asked once no other peer is known to have the object.
+	Storage() bool
+	// Has returns whether the peer is known to have the version of obj.
+	Has(obj *ObjectInfo) bool
+	// Request asks the peer to send obj. A NoMissing notification is expected
+	// if it can not.
+	Request(obj *ObjectInfo) error
+}
+
+/*
+RepairReport describes the state of the repair of a single object.
+*/
+type RepairReport struct {
+	Identification string
+	Path           string
+	Version        Version
+	Attempts       int
+	Asked          []string // peers asked, in order
+	Missing        []string // peers that replied that they lack the object
+	Failed         bool
+	Reason         string // why the repair failed
+}
+
+func (r RepairReport) String() string {
+	text := "repair of " + r.Path + " (" + r.Identification + ") "
+	if r.Failed {
+		text += "failed: " + r.Reason
+	} else {
+		text += "pending"
+	}
+	return text + fmt.Sprintf(", %d attempts, asked [%s], missing at [%s]",
+		r.Attempts, strings.Join(r.Asked, " "), strings.Join(r.Missing, " "))
+}
+
+/*
+RepairCoordinator fetches objects that peers reported as missing. Whenever a
+peer replies to a request with a NoMissing notification, the next peer that has
+the version of the object is asked, falling back to storage peers. After
+Attempts requests without success the repair is given up and reported. All
+methods are safe for concurrent use.
+*/
+type RepairCoordinator struct {
+	Attempts int // maximal amount of requests per object
+	mutex    sync.Mutex
+	peers    map[string]RepairPeer
+	repairs  map[string]*repairState
+}
+
+type repairState struct {
+	obj    ObjectInfo
+	report RepairReport
+}
+
+/*
+CreateRepairCoordinator returns a RepairCoordinator asking the given peers,
+with REPAIRATTEMPTS attempts.
+*/
+func CreateRepairCoordinator(peers []RepairPeer) *RepairCoordinator {
+	r := &RepairCoordinator{
+		Attempts: REPAIRATTEMPTS,
+		peers:    make(map[string]RepairPeer),
+		repairs:  make(map[string]*repairState)}
+	for _, peer := range peers {
+		r.peers[peer.Identification()] = peer
+	}
+	return r
+}
+
+/*
+AddPeer adds a peer that can be asked, replacing one with the same
+identification.
+*/
+func (r *RepairCoordinator) AddPeer(peer RepairPeer) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.peers[peer.Identification()] = peer
+}
+
+/*
+RemovePeer removes the peer with the given identification, for example once it
+went offline.
+*/
+func (r *RepairCoordinator) RemovePeer(id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.peers, id)
+}
+
+/*
+Missing records that peer lacks obj, usually because it replied to a request
+with a NoMissing notification. The next peer is only asked when a repair starts
+or when the peer asked last replies for the first time, so that duplicated or
+late notifications do not spend attempts. Returns ErrRepairFailed if the repair
+has been given up.
+*/
+func (r *RepairCoordinator) Missing(peer string, obj *ObjectInfo) error {
+	r.mutex.Lock()
+	state, exists := r.repairs[obj.Identification]
+	started := !exists || !state.obj.Version.Equal(obj.Version)
+	if started {
+		// a newer version starts over
+		state = &repairState{obj: *obj.shallowCopy(), report: RepairReport{
+			Identification: obj.Identification,
+			Path:           obj.Path,
+			Version:        obj.Version.Copy()}}
+		r.repairs[obj.Identification] = state
+	}
+	if state.report.Failed {
+		r.mutex.Unlock()
+		return ErrRepairFailed
+	}
+	known := Contains(state.report.Missing, peer)
+	asked := state.report.Asked
+	replied := !known && len(asked) > 0 && asked[len(asked)-1] == peer
+	if !known {
+		state.report.Missing = append(state.report.Missing, peer)
+	}
+	r.mutex.Unlock()
+	if !started && !replied {
+		return nil
+	}
+	return r.next(obj.Identification)
+}
+
+/*
+Notify handles a NotifyMessage received from peer. Only NoMissing notifications
+for objects that are currently repaired are handled; returns ErrUntracked for
+others. The object is needed because the message only contains its
+identification, see Missing.
+*/
+func (r *RepairCoordinator) Notify(peer string, msg *NotifyMessage) error {
+	if msg.Notify != NoMissing {
+		return ErrIllegalParameters
+	}
+	r.mutex.Lock()
+	state, exists := r.repairs[msg.Identification]
+	r.mutex.Unlock()
+	if !exists {
+		return ErrUntracked
+	}
+	return r.Missing(peer, &state.obj)
+}
+
+/*
+Received marks the repair of the object with the given identification as done.
+*/
+func (r *RepairCoordinator) Received(id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.repairs, id)
+}
+
+/*
+Lacking returns the identifications of the objects that peer reported as
+missing and that are still being repaired.
+*/
+func (r *RepairCoordinator) Lacking(peer string) []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var ids []string
+	for id, state := range r.repairs {
+		if Contains(state.report.Missing, peer) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+/*
+Report returns the reports of all pending and failed repairs sorted by path.
+*/
+func (r *RepairCoordinator) Report() []RepairReport {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var reports []RepairReport
+	for _, state := range r.repairs {
+		report := state.report
+		report.Asked = append([]string{}, report.Asked...)
+		report.Missing = append([]string{}, report.Missing...)
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].Path == reports[j].Path {
+			return reports[i].Identification < reports[j].Identification
+		}
+		return reports[i].Path < reports[j].Path
+	})
+	return reports
+}
+
+/*
+Forget removes all failed repairs, for example after they have been reported.
+*/
+func (r *RepairCoordinator) Forget() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for id, state := range r.repairs {
+		if state.report.Failed {
+			delete(r.repairs, id)
+		}
+	}
+}
+
+/*
+next asks the next candidate for the object. Peers are asked without holding
+the mutex so that they may reply synchronously.
+*/
+func (r *RepairCoordinator) next(id string) error {
+	for {
+		r.mutex.Lock()
+		state, err := r.pending(id)
+		if state == nil {
+			r.mutex.Unlock()
+			return err
+		}
+		peers := r.candidates(state)
+		obj := state.obj
+		r.mutex.Unlock()
+		peer := choosePeer(peers, &obj)
+		r.mutex.Lock()
+		if r.repairs[id] != state {
+			// received or restarted with a newer version in the meantime
+			r.mutex.Unlock()
+			continue
+		}
+		if state.report.Failed {
+			r.mutex.Unlock()
+			return ErrRepairFailed
+		}
+		if peer == nil {
+			r.fail(state, "no other peer has the object")
+			r.mutex.Unlock()
+			return ErrRepairFailed
+		}
+		if !state.askable(peer.Identification()) {
+			// asked by a concurrent call in the meantime
+			r.mutex.Unlock()
+			continue
+		}
+		state.report.Attempts++
+		state.report.Asked = append(state.report.Asked, peer.Identification())
+		r.mutex.Unlock()
+		err = peer.Request(&obj)
+		if err == nil {
+			return nil
+		}
+		// unreachable peers count as an attempt, try the next one right away
+	}
+}
+
+/*
+pending returns the state of the repair if another peer may be asked. Returns a
+nil state and no error if the object has been received in the meantime. The
+mutex must be held.
+*/
+func (r *RepairCoordinator) pending(id string) (*repairState, error) {
+	state, exists := r.repairs[id]
+	if !exists {
+		return nil, nil
+	}
+	if state.report.Failed {
+		return nil, ErrRepairFailed
+	}
+	if state.report.Attempts >= r.Attempts {
+		r.fail(state, fmt.Sprintf("gave up after %d attempts", state.report.Attempts))
+		return nil, ErrRepairFailed
+	}
+	return state, nil
+}
+
+/*
+candidates returns the peers that have not been asked for the object yet and
+are not known to lack it, in order of identification. The mutex must be held.
+*/
+func (r *RepairCoordinator) candidates(state *repairState) []RepairPeer {
+	var ids []string
+	for id := range r.peers {
+		if state.askable(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	peers := make([]RepairPeer, len(ids))
+	for i, id := range ids {
+		peers[i] = r.peers[id]
+	}
+	return peers
+}
+
+/*
+askable returns whether the peer may be asked, as every peer is asked at most
+once per repair.
+*/
+func (s *repairState) askable(id string) bool {
+	return !Contains(s.report.Asked, id) && !Contains(s.report.Missing, id)
+}
+
+/*
+choosePeer returns the peer to ask next: first those known to have the version
+of the object, then storage peers, both in the given order. The peers are
+queried, so the mutex must not be held.
+*/
+func choosePeer(peers []RepairPeer, obj *ObjectInfo) RepairPeer {
+	var storage RepairPeer
+	for _, peer := range peers {
+		if peer.Storage() {
+			if storage == nil {
+				storage = peer
+			}
+			continue
+		}
+		if peer.Has(obj) {
+			return peer
+		}
+	}
+	return storage
+}
+
+func (r *RepairCoordinator) fail(state *repairState, reason string) {
+	state.report.Failed = true
+	state.report.Reason = reason
+}
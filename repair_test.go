@@ -0,0 +1,182 @@
+package shared
+
+import (
+	"errors"
+	"testing"
+)
+
+/*
+testRepairPeer is an in memory peer that either sends the object right away or
+replies that it is missing.
+*/
+type testRepairPeer struct {
+	id          string
+	storage     bool
+	has         bool
+	missing     bool // replies with NoMissing despite has
+	offline     bool
+	coordinator *RepairCoordinator
+	requests    int
+}
+
+func (p *testRepairPeer) Identification() string { return p.id }
+func (p *testRepairPeer) Storage() bool          { return p.storage }
+
+func (p *testRepairPeer) Has(obj *ObjectInfo) bool {
+	// peers may use the coordinator, so it must not be locked when asked
+	if p.coordinator != nil {
+		p.coordinator.Lacking(p.id)
+	}
+	return p.has
+}
+
+func (p *testRepairPeer) Request(obj *ObjectInfo) error {
+	p.requests++
+	if p.offline {
+		return errors.New("offline")
+	}
+	if p.missing || (!p.has && !p.storage) {
+		msg := CreateNotifyMessage(NoMissing, obj.Identification, OtObject)
+		p.coordinator.Notify(p.id, &msg)
+		return nil
+	}
+	p.coordinator.Received(obj.Identification)
+	return nil
+}
+
+func TestRepairCoordinator_Missing(t *testing.T) {
+	obj := &ObjectInfo{Identification: "abc", Path: "file", Version: Version{"a": 1}}
+	type testRepair struct {
+		peers    []*testRepairPeer
+		attempts int
+		asked    []string
+		failed   bool
+	}
+	tests := []testRepair{
+		// the second peer with the version sends it
+		{[]*testRepairPeer{{id: "b", has: true, missing: true}, {id: "c", has: true}, {id: "d", has: true}},
+			3, []string{"b", "c"}, false},
+		// peers without the version are skipped, storage peers asked last
+		{[]*testRepairPeer{{id: "b", storage: true}, {id: "c"}, {id: "d", has: true, offline: true}},
+			3, []string{"d", "b"}, false},
+		// give up after the configured attempts
+		{[]*testRepairPeer{{id: "b", has: true, missing: true}, {id: "c", has: true, missing: true}, {id: "d", has: true}},
+			2, []string{"b", "c"}, true},
+		// give up once nobody is left
+		{[]*testRepairPeer{{id: "b", has: true, missing: true}, {id: "c"}},
+			3, []string{"b"}, true}}
+	for i, test := range tests {
+		coordinator := CreateRepairCoordinator(nil)
+		coordinator.Attempts = test.attempts
+		for _, peer := range test.peers {
+			peer.coordinator = coordinator
+			coordinator.AddPeer(peer)
+		}
+		// a has already replied that it lacks the object
+		coordinator.AddPeer(&testRepairPeer{id: "a", has: true, coordinator: coordinator})
+		// failures may be returned to the nested notification of a peer
+		err := coordinator.Missing("a", obj)
+		if err != nil && err != ErrRepairFailed {
+			t.Error(i, "Expected no error, got", err)
+		}
+		reports := coordinator.Report()
+		if !test.failed {
+			if len(reports) != 0 {
+				t.Error(i, "Expected repair to be done, got", reports)
+			}
+			continue
+		}
+		if len(reports) != 1 || !reports[0].Failed || reports[0].Reason == "" {
+			t.Fatal(i, "Expected failed report, got", reports)
+		}
+		if len(reports[0].Asked) != len(test.asked) {
+			t.Error(i, "Expected", test.asked, "got", reports[0].Asked)
+		}
+		for j, id := range test.asked {
+			if reports[0].Asked[j] != id {
+				t.Error(i, "Expected", test.asked, "got", reports[0].Asked)
+			}
+		}
+		lacking := coordinator.Lacking("a")
+		if len(lacking) != 1 || lacking[0] != "abc" {
+			t.Error(i, "Expected a to lack abc, got", lacking)
+		}
+		coordinator.Forget()
+		if len(coordinator.Report()) != 0 {
+			t.Error(i, "Expected failed repairs to be forgotten")
+		}
+	}
+}
+
+func TestRepairCoordinator_Notify(t *testing.T) {
+	coordinator := CreateRepairCoordinator(nil)
+	msg := CreateNotifyMessage(NoMissing, "unknown", OtObject)
+	if coordinator.Notify("a", &msg) != ErrUntracked {
+		t.Error("Expected notification of unknown object to be untracked")
+	}
+	msg = CreateNotifyMessage(NoRemoved, "unknown", OtObject)
+	if coordinator.Notify("a", &msg) != ErrIllegalParameters {
+		t.Error("Expected other notifications to be rejected")
+	}
+	// a pending request is kept until the object is received
+	coordinator.AddPeer(&pendingRepairPeer{&testRepairPeer{id: "b", has: true}})
+	obj := &ObjectInfo{Identification: "abc", Path: "file", Version: Version{"a": 1}}
+	err := coordinator.Missing("a", obj)
+	reports := coordinator.Report()
+	if err != nil || len(reports) != 1 || reports[0].Failed || reports[0].Attempts != 1 {
+		t.Fatal("Expected pending repair, got", reports, err)
+	}
+	msg = CreateNotifyMessage(NoMissing, "abc", OtObject)
+	if coordinator.Notify("b", &msg) != ErrRepairFailed {
+		t.Error("Expected repair to fail without other peers")
+	}
+	coordinator.Received("abc")
+	if len(coordinator.Report()) != 0 {
+		t.Error("Expected repair to be done")
+	}
+}
+
+/*
+pendingRepairPeer accepts requests without answering.
+*/
+type pendingRepairPeer struct {
+	*testRepairPeer
+}
+
+func (p *pendingRepairPeer) Request(obj *ObjectInfo) error {
+	p.requests++
+	return nil
+}
+
+func TestRepairCoordinator_Duplicate(t *testing.T) {
+	coordinator := CreateRepairCoordinator(nil)
+	b := &testRepairPeer{id: "b", has: true}
+	c := &testRepairPeer{id: "c", has: true}
+	coordinator.AddPeer(&pendingRepairPeer{b})
+	coordinator.AddPeer(&pendingRepairPeer{c})
+	obj := &ObjectInfo{Identification: "abc", Path: "file", Version: Version{"a": 1}}
+	err := coordinator.Missing("a", obj)
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	// the same notification twice only asks the next peer once
+	msg := CreateNotifyMessage(NoMissing, "abc", OtObject)
+	for i := 0; i < 2; i++ {
+		err = coordinator.Notify("b", &msg)
+		if err != nil {
+			t.Error("Expected no error, got", err)
+		}
+	}
+	// peers that were not asked last only get recorded
+	err = coordinator.Notify("d", &msg)
+	if err != nil {
+		t.Error("Expected no error, got", err)
+	}
+	reports := coordinator.Report()
+	if len(reports) != 1 || reports[0].Attempts != 2 || b.requests != 1 || c.requests != 1 {
+		t.Fatal("Expected two attempts, got", reports)
+	}
+	if len(reports[0].Missing) != 3 || !Contains(reports[0].Missing, "d") {
+		t.Error("Expected a, b and d to lack the object, got", reports[0].Missing)
+	}
+}
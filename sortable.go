@@ -22,6 +22,23 @@ func (s Sortable) Less(i, j int) bool {
 	return s[i].Path < s[j].Path
 }
 
+/*
+byName allows sorting ObjectInfos by their name.
+*/
+type byName []*ObjectInfo
+
+func (s byName) Len() int {
+	return len(s)
+}
+
+func (s byName) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s byName) Less(i, j int) bool {
+	return s[i].Name < s[j].Name
+}
+
 /*
 SortableUpdateMessage allows the sorting of UpdateMessages
 */
@@ -0,0 +1,271 @@
+package shared
+
+import (
+	"path"
+	"strings"
+)
+
+/*
+Tinignore is a parsed .tinignore file. The syntax is the same as that of
+.gitignore files:
+
+	# comment, \# for a literal leading hash
+	name        matches objects called name at any depth
+	/name       matches name only directly within the directory of the file
+	dir/name    matches relative to the directory of the file (any inner '/')
+	name/       matches only directories
+	!name       re-includes an object excluded by an earlier pattern
+	*, ?, [a-z] match within a single path element
+	dir/**      matches everything within dir
+	**          as a leading or inner path element matches zero or more
+	            directories, so a leading one matches at any depth
+
+Trailing spaces are ignored unless escaped with a backslash. Later patterns
+take precedence over earlier ones.
+*/
+type Tinignore struct {
+	base     string // subpath of the directory containing the file
+	patterns []ignorePattern
+}
+
+/*
+ignorePattern is a single line of a .tinignore file.
+*/
+type ignorePattern struct {
+	segments []string // pattern split at '/', unanchored patterns start with "**"
+	negate   bool
+	dirOnly  bool
+}
+
+/*
+ParseTinignore parses the content of a .tinignore file that lies in the
+directory at the given subpath (empty for the root).
+*/
+func ParseTinignore(base, content string) *Tinignore {
+	t := &Tinignore{base: base}
+	for _, line := range strings.Split(content, "\n") {
+		pattern, ok := parseIgnoreLine(line)
+		if ok {
+			t.patterns = append(t.patterns, pattern)
+		}
+	}
+	return t
+}
+
+/*
+LoadTinignore reads the .tinignore file in the directory at subpath below root.
+Returns ErrNoTinIgnore if the directory has none.
+*/
+func LoadTinignore(root, subpath string) (*Tinignore, error) {
+	return loadTinignore(FS, root, subpath)
+}
+
+func loadTinignore(fsys FileSystem, root, subpath string) (*Tinignore, error) {
+	path := CreatePath(root, subpath).FullPath() + "/" + TINIGNORE
+	stat, err := fsys.Lstat(path)
+	if err != nil || stat.IsDir() {
+		return nil, ErrNoTinIgnore
+	}
+	data, err := readFile(fsys, path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTinignore(subpath, string(data)), nil
+}
+
+/*
+loadTinignoreDefault works like LoadTinignore but returns the TINDIRIGNORE rules
+for the .tinzenite directory if its .tinignore is missing.
+*/
+func loadTinignoreDefault(fsys FileSystem, root, subpath string) (*Tinignore, error) {
+	t, err := loadTinignore(fsys, root, subpath)
+	if err == ErrNoTinIgnore && subpath == TINZENITEDIR {
+		return ParseTinignore(TINZENITEDIR, TINDIRIGNORE), nil
+	}
+	return t, err
+}
+
+func parseIgnoreLine(line string) (ignorePattern, bool) {
+	pattern := ignorePattern{}
+	line = strings.TrimSuffix(line, "\r")
+	// trailing spaces are removed unless escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return pattern, false
+	}
+	if strings.HasPrefix(line, "!") {
+		pattern.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		pattern.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return pattern, false
+	}
+	// any '/' left means the pattern is relative to the .tinignore directory
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	for _, segment := range strings.Split(line, "/") {
+		// empty segments from "a//b" are meaningless
+		if segment != "" {
+			pattern.segments = append(pattern.segments, negateClass(segment))
+		}
+	}
+	if !anchored {
+		pattern.segments = append([]string{"**"}, pattern.segments...)
+	}
+	return pattern, len(pattern.segments) > 0
+}
+
+/*
+negateClass converts negated character classes from the "[!a]" syntax of
+.gitignore files to the "[^a]" syntax of path.Match.
+*/
+func negateClass(segment string) string {
+	data := []byte(segment)
+	for i := 0; i < len(data)-1; i++ {
+		switch {
+		case data[i] == '\\':
+			// skip escaped character
+			i++
+		case data[i] == '[' && data[i+1] == '!':
+			data[i+1] = '^'
+		}
+	}
+	return string(data)
+}
+
+/*
+match returns whether any pattern of the file matches the given subpath and if
+so, whether the last matching pattern ignores it.
+*/
+func (t *Tinignore) match(subpath string, dir bool) (matched, ignored bool) {
+	relative := subpath
+	if t.base != "" {
+		if !strings.HasPrefix(subpath, t.base+"/") {
+			return false, false
+		}
+		relative = subpath[len(t.base)+1:]
+	}
+	elements := strings.Split(relative, "/")
+	// last matching pattern wins
+	for i := len(t.patterns) - 1; i >= 0; i-- {
+		pattern := t.patterns[i]
+		if pattern.dirOnly && !dir {
+			continue
+		}
+		if matchSegments(pattern.segments, elements) {
+			return true, !pattern.negate
+		}
+	}
+	return false, false
+}
+
+/*
+matchSegments matches the path elements against the pattern segments where "**"
+matches any number of elements.
+*/
+func matchSegments(segments, elements []string) bool {
+	for len(segments) > 0 {
+		if segments[0] == "**" {
+			// a trailing "**" matches everything inside, but not the directory itself
+			if len(segments) == 1 {
+				return len(elements) > 0
+			}
+			for i := 0; i <= len(elements); i++ {
+				if matchSegments(segments[1:], elements[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(elements) == 0 {
+			return false
+		}
+		ok, err := path.Match(segments[0], elements[0])
+		if err != nil || !ok {
+			return false
+		}
+		segments = segments[1:]
+		elements = elements[1:]
+	}
+	return len(elements) == 0
+}
+
+/*
+IgnoreMatcher combines the .tinignore files of a directory and all of its
+parents. Files of deeper directories take precedence.
+*/
+type IgnoreMatcher struct {
+	files []*Tinignore // ordered from the root downwards
+}
+
+/*
+CreateIgnoreMatcher returns a matcher for the given files, which must be ordered
+from the root downwards.
+*/
+func CreateIgnoreMatcher(files ...*Tinignore) *IgnoreMatcher {
+	return &IgnoreMatcher{files: files}
+}
+
+/*
+LoadIgnoreMatcher loads the .tinignore files of the directory at subpath below
+root and of all of its parents.
+*/
+func LoadIgnoreMatcher(root, subpath string) (*IgnoreMatcher, error) {
+	m := CreateIgnoreMatcher()
+	dir := ""
+	elements := strings.Split(subpath, "/")
+	for i := 0; ; i++ {
+		t, err := loadTinignoreDefault(FS, root, dir)
+		if err == nil {
+			m = m.With(t)
+		} else if err != ErrNoTinIgnore {
+			return nil, err
+		}
+		if subpath == "" || i == len(elements) {
+			return m, nil
+		}
+		dir = joinPath(dir, elements[i])
+	}
+}
+
+/*
+With returns a new matcher that additionally applies the given file, which must
+be located below the directories of all files already contained.
+*/
+func (m *IgnoreMatcher) With(t *Tinignore) *IgnoreMatcher {
+	files := make([]*Tinignore, len(m.files), len(m.files)+1)
+	copy(files, m.files)
+	return &IgnoreMatcher{files: append(files, t)}
+}
+
+/*
+Ignored returns whether the object at subpath is ignored. An object within an
+ignored directory is always ignored and can not be re-included.
+*/
+func (m *IgnoreMatcher) Ignored(subpath string, dir bool) bool {
+	for i := 0; i < len(subpath); i++ {
+		if subpath[i] == '/' && m.matches(subpath[:i], true) {
+			return true
+		}
+	}
+	return m.matches(subpath, dir)
+}
+
+/*
+matches is Ignored without checking the parent directories, which is enough if
+the tree is walked and ignored directories are never entered.
+*/
+func (m *IgnoreMatcher) matches(subpath string, dir bool) bool {
+	for i := len(m.files) - 1; i >= 0; i-- {
+		if matched, ignored := m.files[i].match(subpath, dir); matched {
+			return ignored
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package shared
+
+import "testing"
+
+type testIgnore struct {
+	content string
+	path    string
+	dir     bool
+	want    bool
+}
+
+func Test_Tinignore(t *testing.T) {
+	testIgnores := []testIgnore{
+		// empty and comments
+		{"", "a", false, false},
+		{"# a", "a", false, false},
+		{"\n\n  \n", "a", false, false},
+		{"\\#a", "#a", false, true},
+		// unanchored names match at any depth
+		{"a", "a", false, true},
+		{"a", "a", true, true},
+		{"a", "x/a", false, true},
+		{"a", "x/y/a", true, true},
+		{"a", "ab", false, false},
+		{"a", "x/ab", false, false},
+		// anchored patterns
+		{"/a", "a", false, true},
+		{"/a", "x/a", false, false},
+		{"x/a", "x/a", false, true},
+		{"x/a", "y/x/a", false, false},
+		{"/x/a", "x/a", false, true},
+		{"/local", "local", true, true},
+		{"/local", "org/local", true, false},
+		// directory only
+		{"a/", "a", true, true},
+		{"a/", "a", false, false},
+		{"a/", "x/a", true, true},
+		{"/a/", "x/a", true, false},
+		{"x/a/", "x/a", true, true},
+		{"x/a/", "x/a", false, false},
+		// wildcards
+		{"*.log", "error.log", false, true},
+		{"*.log", "x/error.log", false, true},
+		{"*.log", "error.log.txt", false, false},
+		{"x/*.log", "x/error.log", false, true},
+		{"x/*.log", "x/y/error.log", false, false},
+		{"*", "anything", false, true},
+		{"?.txt", "a.txt", false, true},
+		{"?.txt", "ab.txt", false, false},
+		{"[ab].txt", "b.txt", false, true},
+		{"[ab].txt", "c.txt", false, false},
+		{"[!ab].txt", "c.txt", false, true},
+		{"/x*z", "x/z", false, false},
+		{"x*", "x/y", false, true}, // directory x is ignored
+		{"[", "[", false, false},   // malformed pattern never matches
+		// double asterisks
+		{"**/a", "a", false, true},
+		{"**/a", "x/y/a", false, true},
+		{"**/x/a", "x/a", false, true},
+		{"**/x/a", "y/x/a", false, true},
+		{"**/x/a", "x/y/a", false, false},
+		{"x/**", "x", true, false},
+		{"x/**", "x/a", false, true},
+		{"x/**", "x/a/b", false, true},
+		{"x/**", "y/x/a", false, false},
+		{"x/**/a", "x/a", false, true},
+		{"x/**/a", "x/y/a", false, true},
+		{"x/**/a", "x/y/z/a", false, true},
+		{"x/**/a", "x/y/z/b", false, false},
+		{"x/**/*.log", "x/y/e.log", false, true},
+		{"x**", "xyz", false, true},
+		// negation, the last matching pattern wins
+		{"*.log\n!keep.log", "keep.log", false, false},
+		{"*.log\n!keep.log", "drop.log", false, true},
+		{"!keep.log\n*.log", "keep.log", false, true},
+		{"\\!a", "!a", false, true},
+		{"!a", "a", false, false},
+		// trailing spaces
+		{"a  ", "a", false, true},
+		{"a\\ ", "a ", false, true},
+		{"a\r", "a", false, true},
+		// TINDIRIGNORE as used within .tinzenite
+		{TINDIRIGNORE, LOCALDIR, true, true},
+		{TINDIRIGNORE, RECEIVINGDIR, true, true},
+		{TINDIRIGNORE, ORGDIR, true, false},
+		{TINDIRIGNORE, ORGDIR + "/" + LOCALDIR, true, false}}
+	for _, test := range testIgnores {
+		matcher := CreateIgnoreMatcher(ParseTinignore("", test.content))
+		got := matcher.Ignored(test.path, test.dir)
+		if got != test.want {
+			t.Errorf("Expected %v for %q with %q (dir %v), got %v", test.want, test.path, test.content, test.dir, got)
+		}
+	}
+}
+
+func TestIgnoreMatcher_Ignored(t *testing.T) {
+	matcher := CreateIgnoreMatcher(
+		ParseTinignore("", "*.log\nbuild/\n!important.log"),
+		ParseTinignore("sub", "/local\n!debug.log\nimportant.log\n"),
+		ParseTinignore("sub/deep", "!*.log"))
+	testIgnores := []testIgnore{
+		// root file applies everywhere
+		{"", "a.log", false, true},
+		{"", "important.log", false, false},
+		{"", "other/debug.log", false, true},
+		// nested files take precedence within their directory only
+		{"", "sub/debug.log", false, false},
+		{"", "sub/important.log", false, true},
+		{"", "sub/deep/x.log", false, false},
+		{"", "local", true, false},
+		{"", "sub/local", true, true},
+		{"", "sub/x/local", true, false},
+		// contents of ignored directories can not be re-included
+		{"", "build/keep.txt", false, true},
+		{"", "sub/local/debug.log", false, true},
+		{"", "sub/deep/build/x.log", false, true}}
+	for _, test := range testIgnores {
+		got := matcher.Ignored(test.path, test.dir)
+		if got != test.want {
+			t.Errorf("Expected %v for %q (dir %v), got %v", test.want, test.path, test.dir, got)
+		}
+	}
+}
+
+func Test_LoadIgnoreMatcher(t *testing.T) {
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	writeTestFiles(t, root, map[string]string{
+		TINIGNORE:               "*.tmp",
+		"a/b/" + TINIGNORE:      "!keep.tmp",
+		TINZENITEDIR + "/x.txt": ""})
+	matcher, err := LoadIgnoreMatcher(root, "a/b")
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	if !matcher.Ignored("a/b/drop.tmp", false) || matcher.Ignored("a/b/keep.tmp", false) {
+		t.Error("Expected nested .tinignore to be applied")
+	}
+	// .tinzenite without .tinignore falls back to TINDIRIGNORE
+	matcher, err = LoadIgnoreMatcher(root, TINZENITEDIR)
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	if !matcher.Ignored(TINZENITEDIR+"/"+TEMPDIR, true) {
+		t.Error("Expected TINDIRIGNORE to be applied")
+	}
+}
@@ -1,10 +1,34 @@
 package shared
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/json"
-	"io/ioutil"
+	"fmt"
+	"os"
 )
 
+// Formats of stored tox dumps.
+const (
+	/*TOXDUMPPLAIN is the unencrypted format of older versions.*/
+	TOXDUMPPLAIN = 0
+	/*TOXDUMPENCRYPTED is the format protected with a passphrase.*/
+	TOXDUMPENCRYPTED = 1
+	/*TOXDUMPITERATIONS is the PBKDF2 iteration count for new encrypted dumps.*/
+	TOXDUMPITERATIONS = 600000
+	/*TOXDUMPMAXITERATIONS is the highest iteration count accepted when loading,
+	so that a modified dump can not stall the key derivation.*/
+	TOXDUMPMAXITERATIONS = 100 * TOXDUMPITERATIONS
+	/*TOXDUMPKDF names the key derivation function of encrypted dumps.*/
+	TOXDUMPKDF = "pbkdf2-sha256"
+)
+
+// iteration count of new encrypted dumps, lowered by tests
+var toxDumpIterations = TOXDUMPITERATIONS
+
 /*
 ToxPeerDump stores the self peer information along with the tox binary data
 required for it to work.
@@ -15,31 +39,286 @@ type ToxPeerDump struct {
 }
 
 /*
-LoadToxDumpFrom loads the toxPeerDump file from the given path.
+encryptedToxDump is the stored form of a ToxPeerDump protected by a passphrase.
+The key is derived from the passphrase with the KDF and used to seal the JSON of
+the dump with AES-256-GCM.
+*/
+type encryptedToxDump struct {
+	Format     int
+	KDF        string
+	Iterations int
+	Salt       []byte
+	Nonce      []byte
+	Data       []byte
+}
+
+/*
+LoadToxDumpFrom loads the toxPeerDump file from the given path. If the file is
+missing or corrupt, the backup of the previous version is loaded instead, unless
+the file is encrypted and the backup is not. Returns ErrEncryptedDump if the
+dump is protected by a passphrase.
 */
 func LoadToxDumpFrom(path string) (*ToxPeerDump, error) {
-	path = path + "/" + SELFPEERJSON
-	data, err := ioutil.ReadFile(path)
+	return loadToxDump(path, "")
+}
+
+/*
+LoadEncryptedToxDumpFrom works like LoadToxDumpFrom but decrypts a dump protected
+by a passphrase. Unencrypted dumps are loaded too. Returns ErrWrongPassphrase if
+the dump can not be decrypted.
+*/
+func LoadEncryptedToxDumpFrom(path, passphrase string) (*ToxPeerDump, error) {
+	if passphrase == "" {
+		return nil, ErrIllegalParameters
+	}
+	return loadToxDump(path, passphrase)
+}
+
+/*
+IsToxDumpEncrypted returns whether the tox dump at the given path is protected
+by a passphrase.
+*/
+func IsToxDumpEncrypted(path string) (bool, error) {
+	data, err := readFile(FS, path+"/"+SELFPEERJSON)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
-	toxPeerDump := &ToxPeerDump{}
-	err = json.Unmarshal(data, toxPeerDump)
+	format, err := toxDumpFormat(data)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
-	return toxPeerDump, nil
+	return format == TOXDUMPENCRYPTED, nil
 }
 
 /*
-StoreTo the toxPeerDump to the given path.
+StoreTo the toxPeerDump to the given path. Returns ErrEncryptedDump if an
+encrypted dump is stored there, as it would be replaced by an unencrypted one;
+use StoreEncryptedTo instead.
 */
 func (t *ToxPeerDump) StoreTo(path string) error {
+	for _, name := range []string{SELFPEERJSON, SELFPEERJSON + BACKUPENDING} {
+		data, err := readFile(FS, path+"/"+name)
+		if err != nil {
+			continue
+		}
+		if format, err := toxDumpFormat(data); err == nil && format == TOXDUMPENCRYPTED {
+			return ErrEncryptedDump
+		}
+	}
 	// prepare data to write
 	data, err := json.MarshalIndent(t, "", "  ")
 	if err != nil {
 		return err
 	}
 	path = path + "/" + SELFPEERJSON
-	return ioutil.WriteFile(path, data, FILEPERMISSIONMODE)
+	// the previous dump is kept as the tox identity must never get lost
+	return WriteFileAtomic(path, data, Permissions.PrivateFile, true)
+}
+
+/*
+StoreEncryptedTo stores the toxPeerDump to the given path, encrypted with the
+passphrase. An unencrypted backup of a previous version is removed.
+*/
+func (t *ToxPeerDump) StoreEncryptedTo(path, passphrase string) error {
+	if passphrase == "" {
+		return ErrIllegalParameters
+	}
+	plain, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	dump := &encryptedToxDump{
+		Format:     TOXDUMPENCRYPTED,
+		KDF:        TOXDUMPKDF,
+		Iterations: toxDumpIterations,
+		Salt:       make([]byte, 16)}
+	_, err = rand.Read(dump.Salt)
+	if err != nil {
+		return err
+	}
+	aead, err := dump.cipher(passphrase)
+	if err != nil {
+		return err
+	}
+	dump.Nonce = make([]byte, aead.NonceSize())
+	_, err = rand.Read(dump.Nonce)
+	if err != nil {
+		return err
+	}
+	dump.Data = aead.Seal(nil, dump.Nonce, plain, dump.header())
+	data, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		return err
+	}
+	path = path + "/" + SELFPEERJSON
+	err = WriteFileAtomic(path, data, Permissions.PrivateFile, true)
+	if err != nil {
+		return err
+	}
+	backup, err := readFile(FS, path+BACKUPENDING)
+	if err != nil {
+		// no backup, nothing to leak
+		return nil
+	}
+	if format, err := toxDumpFormat(backup); err != nil || format != TOXDUMPENCRYPTED {
+		return FS.Remove(path + BACKUPENDING)
+	}
+	return nil
+}
+
+/*
+EncryptToxDump upgrades the unencrypted tox dump at the given path in place to
+one protected by the passphrase.
+*/
+func EncryptToxDump(path, passphrase string) error {
+	dump, err := LoadToxDumpFrom(path)
+	if err != nil {
+		return err
+	}
+	return dump.StoreEncryptedTo(path, passphrase)
+}
+
+/*
+ChangeToxDumpPassphrase re-encrypts the tox dump at the given path with a new
+passphrase. The backup encrypted with the old passphrase is removed.
+*/
+func ChangeToxDumpPassphrase(path, oldPassphrase, newPassphrase string) error {
+	dump, err := LoadEncryptedToxDumpFrom(path, oldPassphrase)
+	if err != nil {
+		return err
+	}
+	err = dump.StoreEncryptedTo(path, newPassphrase)
+	if err != nil {
+		return err
+	}
+	err = FS.Remove(path + "/" + SELFPEERJSON + BACKUPENDING)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+/*
+loadToxDump loads the dump at path, decrypting it if a passphrase is given. An
+unencrypted backup is never loaded in place of an encrypted dump, as it may be
+an old copy that was not meant to be used anymore.
+*/
+func loadToxDump(path, passphrase string) (*ToxPeerDump, error) {
+	path = path + "/" + SELFPEERJSON
+	encrypted := false
+	if data, err := readFile(FS, path); err == nil {
+		format, err := toxDumpFormat(data)
+		encrypted = err == nil && format == TOXDUMPENCRYPTED
+	}
+	toxPeerDump := &ToxPeerDump{}
+	err := loadWithBackup(path, func(data []byte) error {
+		if encrypted {
+			if format, err := toxDumpFormat(data); err != nil || format != TOXDUMPENCRYPTED {
+				return ErrEncryptedDump
+			}
+		}
+		dump, err := parseToxDump(data, passphrase)
+		if err == nil {
+			toxPeerDump = dump
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return toxPeerDump, nil
+}
+
+/*
+parseToxDump reads a stored dump of any format.
+*/
+func parseToxDump(data []byte, passphrase string) (*ToxPeerDump, error) {
+	format, err := toxDumpFormat(data)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case TOXDUMPPLAIN:
+	case TOXDUMPENCRYPTED:
+		if passphrase == "" {
+			return nil, ErrEncryptedDump
+		}
+		data, err = decryptToxDump(data, passphrase)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrUnsupported
+	}
+	dump := &ToxPeerDump{}
+	err = json.Unmarshal(data, dump)
+	if err != nil {
+		return nil, err
+	}
+	if dump.SelfPeer == nil {
+		return nil, ErrIllegalFileState
+	}
+	return dump, nil
+}
+
+func decryptToxDump(data []byte, passphrase string) ([]byte, error) {
+	dump := &encryptedToxDump{}
+	err := json.Unmarshal(data, dump)
+	if err != nil {
+		return nil, err
+	}
+	if dump.KDF != TOXDUMPKDF {
+		return nil, ErrUnsupported
+	}
+	aead, err := dump.cipher(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(dump.Nonce) != aead.NonceSize() {
+		return nil, ErrIllegalFileState
+	}
+	plain, err := aead.Open(nil, dump.Nonce, dump.Data, dump.header())
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return plain, nil
+}
+
+/*
+toxDumpFormat returns the format of a stored dump. Unencrypted dumps have no
+format field and thus TOXDUMPPLAIN.
+*/
+func toxDumpFormat(data []byte) (int, error) {
+	header := &struct{ Format int }{}
+	err := json.Unmarshal(data, header)
+	if err != nil {
+		return 0, err
+	}
+	return header.Format, nil
+}
+
+/*
+cipher derives the key from the passphrase and returns the AEAD for it.
+*/
+func (e *encryptedToxDump) cipher(passphrase string) (cipher.AEAD, error) {
+	if e.Iterations <= 0 || e.Iterations > TOXDUMPMAXITERATIONS {
+		return nil, ErrIllegalFileState
+	}
+	key, err := pbkdf2.Key(sha256.New, passphrase, e.Salt, e.Iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+/*
+header is authenticated along with the data so that the parameters can not be
+modified.
+*/
+func (e *encryptedToxDump) header() []byte {
+	return []byte(fmt.Sprintf("%d:%s:%d:%x", e.Format, e.KDF, e.Iterations, e.Salt))
 }
@@ -0,0 +1,113 @@
+package shared
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestToxPeerDump_StoreEncryptedTo(t *testing.T) {
+	defer func(old int) { toxDumpIterations = old }(toxDumpIterations)
+	// keep the test fast, the count is stored with the dump
+	toxDumpIterations = 1000
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	peer, _ := CreatePeer("name", "address", false)
+	secret := []byte("tox private key")
+	dump := &ToxPeerDump{SelfPeer: peer, ToxData: secret}
+	err := dump.StoreTo(root)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	// upgrade in place
+	err = EncryptToxDump(root, "correct")
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	if encrypted, _ := IsToxDumpEncrypted(root); !encrypted {
+		t.Error("Expected dump to be encrypted")
+	}
+	for _, name := range []string{SELFPEERJSON, SELFPEERJSON + BACKUPENDING} {
+		data, _ := os.ReadFile(root + "/" + name)
+		if bytes.Contains(data, secret) || bytes.Contains(data, []byte("dG94IHByaXZhdGUga2V5")) {
+			t.Error("Expected no plain tox data in", name)
+		}
+	}
+	_, err = LoadToxDumpFrom(root)
+	if err != ErrEncryptedDump {
+		t.Error("Expected", ErrEncryptedDump, "got", err)
+	}
+	_, err = LoadEncryptedToxDumpFrom(root, "wrong")
+	if err != ErrWrongPassphrase {
+		t.Error("Expected", ErrWrongPassphrase, "got", err)
+	}
+	loaded, err := LoadEncryptedToxDumpFrom(root, "correct")
+	if err != nil || !bytes.Equal(loaded.ToxData, secret) || loaded.SelfPeer.Name != "name" {
+		t.Error("Expected decrypted dump, got", loaded, err)
+	}
+	// change of passphrase
+	err = ChangeToxDumpPassphrase(root, "correct", "new")
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	_, err = LoadEncryptedToxDumpFrom(root, "correct")
+	if err != ErrWrongPassphrase {
+		t.Error("Expected old passphrase to fail, got", err)
+	}
+	loaded, err = LoadEncryptedToxDumpFrom(root, "new")
+	if err != nil || !bytes.Equal(loaded.ToxData, secret) {
+		t.Error("Expected decrypted dump, got", loaded, err)
+	}
+	// an encrypted dump is never replaced by an unencrypted one
+	err = dump.StoreTo(root)
+	if err != ErrEncryptedDump {
+		t.Error("Expected", ErrEncryptedDump, "got", err)
+	}
+	// nor is an unencrypted backup loaded in place of a damaged one
+	writeFile(FS, root+"/"+SELFPEERJSON+BACKUPENDING, []byte(`{"SelfPeer":{"Name":"old"}}`), 0600)
+	writeFile(FS, root+"/"+SELFPEERJSON, []byte(`{"Format":1,"Data":"AA=="}`), 0600)
+	for _, passphrase := range []string{"", "new"} {
+		loaded, err = loadToxDump(root, passphrase)
+		if err == nil {
+			t.Error("Expected unencrypted backup to be refused, got", loaded)
+		}
+	}
+	// unencrypted dumps load with a passphrase too
+	plain := makeTempDir("", "plain")
+	defer removeTemp(plain)
+	dump.StoreTo(plain)
+	loaded, err = LoadEncryptedToxDumpFrom(plain, "new")
+	if err != nil || !bytes.Equal(loaded.ToxData, secret) {
+		t.Error("Expected plain dump, got", loaded, err)
+	}
+}
+
+func Test_decryptToxDumpTampered(t *testing.T) {
+	defer func(old int) { toxDumpIterations = old }(toxDumpIterations)
+	toxDumpIterations = 1000
+	defer func(old FileSystem) { FS = old }(FS)
+	FS = CreateMemFileSystem()
+	FS.MkdirAll("/root", 0700)
+	peer, _ := CreatePeer("name", "address", false)
+	dump := &ToxPeerDump{SelfPeer: peer, ToxData: []byte("key")}
+	err := dump.StoreEncryptedTo("/root", "pass")
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	data, _ := readFile(FS, "/root/"+SELFPEERJSON)
+	// lowering the iteration count must be detected
+	tampered := bytes.Replace(data, []byte(`"Iterations": 1000`), []byte(`"Iterations": 1`), 1)
+	if bytes.Equal(tampered, data) {
+		t.Fatal("Failed test setup")
+	}
+	_, err = decryptToxDump(tampered, "pass")
+	if err != ErrWrongPassphrase {
+		t.Error("Expected", ErrWrongPassphrase, "got", err)
+	}
+	// raising it beyond the limit is rejected before deriving the key
+	tampered = bytes.Replace(data, []byte(`"Iterations": 1000`), []byte(`"Iterations": 1000000000`), 1)
+	_, err = decryptToxDump(tampered, "pass")
+	if err != ErrIllegalFileState {
+		t.Error("Expected", ErrIllegalFileState, "got", err)
+	}
+}
@@ -0,0 +1,304 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+/*
+Finding is a single problem or notice found by Validate.
+*/
+type Finding struct {
+	Severity Severity
+	Path     string // subpath below the validated root
+	Message  string
+	Repaired bool
+}
+
+func (f Finding) String() string {
+	text := f.Severity.String() + ": " + f.Path + ": " + f.Message
+	if f.Repaired {
+		text += " (repaired)"
+	}
+	return text
+}
+
+/*
+Validate checks the structure of the Tinzenite or encrypted directory at root:
+all required directories, the .tinignore of TINZENITEDIR, the peer files, the
+self dump, the model, the auth file, the layout version and the permissions. If
+repair is set, everything that can be fixed without losing data is: missing
+directories are created, the .tinignore is rewritten, damaged files with a
+valid backup are restored, permissions are tightened and outdated layouts are
+migrated. Returns ErrNotTinzenite if root is neither kind of directory and, if
+repair is set, ErrUnsupported without touching anything if the layout is newer
+than supported, as its structure can not be known. Repairs hold the
+InstanceLock, so a *LockedError is returned if another instance uses the
+directory.
+*/
+func Validate(root string, repair bool) ([]Finding, error) {
+	kind := DetectDirKind(root)
+	if kind == DkNone {
+		return nil, ErrNotTinzenite
+	}
+	if version, _, err := ReadLayout(root); repair && err == nil && version > LayoutVersion(kind) {
+		return nil, ErrUnsupported
+	}
+	v := &validator{root: root, kind: kind, repair: repair}
+	if repair {
+		lock, err := v.lock()
+		if err != nil {
+			return nil, err
+		}
+		defer lock.Release()
+	}
+	if kind == DkTinzenite {
+		v.prefix = TINZENITEDIR + "/"
+	}
+	v.directories()
+	if kind == DkTinzenite {
+		v.tinignore()
+	}
+	outdated := v.layout()
+	v.selfDump()
+	v.peers()
+	if kind == DkTinzenite {
+		v.model()
+	}
+	v.auth()
+	v.permissions()
+	if outdated >= 0 && repair {
+		err := migrate(root, kind)
+		if err != nil {
+			v.add(SvError, v.findings[outdated].Path, "migration failed: "+err.Error(), false)
+		} else {
+			v.findings[outdated].Repaired = true
+		}
+	}
+	return v.findings, nil
+}
+
+/*
+validator collects the findings of Validate.
+*/
+type validator struct {
+	root     string
+	kind     DirKind
+	prefix   string // prefix of the subpaths of all Tinzenite data
+	repair   bool
+	findings []Finding
+}
+
+/*
+lock acquires the InstanceLock for repairs. A missing LOCALDIR, which no
+instance could have locked, is created first.
+*/
+func (v *validator) lock() (*InstanceLock, error) {
+	lock, err := AcquireInstanceLock(v.root)
+	if !os.IsNotExist(err) {
+		return lock, err
+	}
+	err = makeDirectoryMode(layoutBase(v.root, v.kind)+"/"+LOCALDIR, Permissions.PrivateDir)
+	if err != nil {
+		return nil, err
+	}
+	return AcquireInstanceLock(v.root)
+}
+
+func (v *validator) add(severity Severity, subpath, message string, repaired bool) {
+	v.findings = append(v.findings, Finding{Severity: severity, Path: subpath, Message: message, Repaired: repaired})
+}
+
+func (v *validator) full(subpath string) string {
+	return CreatePath(v.root, subpath).FullPath()
+}
+
+/*
+directories checks that all required directories exist.
+*/
+func (v *validator) directories() {
+	required := []string{ORGDIR, ORGDIR + "/" + PEERSDIR, LOCALDIR, RECEIVINGDIR, SENDINGDIR}
+	if v.kind == DkTinzenite {
+		required = append(required, TEMPDIR, REMOVEDIR, LOCALDIR+"/"+REMOVESTOREDIR)
+	}
+	for _, dir := range required {
+		subpath := v.prefix + dir
+		stat, err := FS.Lstat(v.full(subpath))
+		if err == nil && stat.IsDir() {
+			continue
+		}
+		if err == nil {
+			v.add(SvError, subpath, "is not a directory", false)
+			continue
+		}
+		repaired := false
+		if v.repair {
+			mode := Permissions.Mode(subpath, true, v.kind == DkEncrypted)
+			repaired = makeDirectoryMode(v.full(subpath), mode) == nil
+		}
+		v.add(SvError, subpath, "directory is missing", repaired)
+	}
+}
+
+/*
+tinignore checks that the .tinignore of TINZENITEDIR excludes the local data.
+*/
+func (v *validator) tinignore() {
+	subpath := TINZENITEDIR + "/" + TINIGNORE
+	data, err := readFile(FS, v.full(subpath))
+	if err == nil && string(data) == TINDIRIGNORE {
+		return
+	}
+	message := "content differs, local data may be synchronized"
+	if err != nil {
+		message = "missing, local data may be synchronized"
+	}
+	repaired := false
+	if v.repair {
+		repaired = writeFile(FS, v.full(subpath), []byte(TINDIRIGNORE), Permissions.SharedFile) == nil
+	}
+	v.add(SvWarning, subpath, message, repaired)
+}
+
+/*
+layout checks the layout version and returns the index of the finding of an
+outdated layout, so that it can be migrated once all other checks are done, or
+-1.
+*/
+func (v *validator) layout() int {
+	subpath := v.prefix + LOCALDIR + "/" + LAYOUTJSON
+	version, _, err := ReadLayout(v.root)
+	current := LayoutVersion(v.kind)
+	switch {
+	case err != nil:
+		v.add(SvError, subpath, "unreadable: "+err.Error(), false)
+	case version > current:
+		v.add(SvError, subpath, fmt.Sprintf("layout version %d is newer than the supported %d", version, current), false)
+	case version < current:
+		v.add(SvWarning, subpath, fmt.Sprintf("layout version %d is outdated, current is %d", version, current), false)
+		return len(v.findings) - 1
+	}
+	return -1
+}
+
+func (v *validator) selfDump() {
+	subpath := v.prefix + LOCALDIR + "/" + SELFPEERJSON
+	encrypted := false
+	valid := v.file(subpath, SvError, func(data []byte) error {
+		_, err := parseToxDump(data, "")
+		if err == ErrEncryptedDump {
+			encrypted = true
+			return nil
+		}
+		return err
+	})
+	if valid && encrypted {
+		v.add(SvInfo, subpath, "encrypted, content can not be verified", false)
+	}
+}
+
+func (v *validator) peers() {
+	dir := v.prefix + ORGDIR + "/" + PEERSDIR
+	stats, err := FS.ReadDir(v.full(dir))
+	if err != nil {
+		// already reported as missing directory
+		return
+	}
+	var names []string
+	for _, stat := range stats {
+		name := strings.TrimSuffix(stat.Name(), BACKUPENDING)
+		if stat.IsDir() || !strings.HasSuffix(name, ENDING) || Contains(names, name) {
+			continue
+		}
+		names = append(names, name)
+	}
+	valid := 0
+	for _, name := range names {
+		ok := v.file(dir+"/"+name, SvError, func(data []byte) error {
+			peer := &Peer{}
+			err := json.Unmarshal(data, peer)
+			if err == nil && peer.Identification == "" {
+				err = ErrIllegalFileState
+			}
+			return err
+		})
+		if ok {
+			valid++
+		}
+	}
+	if valid == 0 {
+		v.add(SvWarning, dir, "no peers, the directory is not connected", false)
+	}
+}
+
+func (v *validator) model() {
+	v.file(STOREMODELDIR+"/"+MODELJSON, SvInfo, func(data []byte) error {
+		root := &ObjectInfo{}
+		err := json.Unmarshal(data, root)
+		if err != nil {
+			return err
+		}
+		model, err := CreateModel(root)
+		if err != nil {
+			return err
+		}
+		return model.Check()
+	})
+}
+
+func (v *validator) auth() {
+	v.file(v.prefix+ORGDIR+"/"+AUTHJSON, SvWarning, func(data []byte) error {
+		var value map[string]interface{}
+		return json.Unmarshal(data, &value)
+	})
+}
+
+func (v *validator) permissions() {
+	loose, err := checkPermissions(v.root, v.repair)
+	if err != nil {
+		v.add(SvError, v.prefix, "permissions could not be checked: "+err.Error(), false)
+		return
+	}
+	for _, subpath := range loose {
+		v.add(SvWarning, subpath, "permissions are too open", v.repair)
+	}
+}
+
+/*
+file checks that the file at subpath can be parsed. A missing file is reported
+with the given severity, a damaged one as error. Damaged or missing files with a
+valid backup are restored from it when repairing. Returns whether the file is
+valid.
+*/
+func (v *validator) file(subpath string, missing Severity, parse func(data []byte) error) bool {
+	path := v.full(subpath)
+	data, err := readFile(FS, path)
+	if err == nil {
+		err = parse(data)
+	}
+	if err == nil {
+		return true
+	}
+	severity := SvError
+	message := "damaged: " + err.Error()
+	if os.IsNotExist(err) {
+		severity = missing
+		message = "missing"
+	}
+	backup, backupErr := readFile(FS, path+BACKUPENDING)
+	if backupErr == nil {
+		backupErr = parse(backup)
+	}
+	repaired := false
+	if backupErr == nil {
+		message += ", backup is valid"
+		if v.repair {
+			mode := Permissions.Mode(subpath, false, v.kind == DkEncrypted)
+			repaired = WriteFileAtomic(path, backup, mode, false) == nil
+		}
+	}
+	v.add(severity, subpath, message, repaired)
+	return repaired
+}
@@ -0,0 +1,95 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func Test_Validate(t *testing.T) {
+	root := makeTempDir("", "root")
+	defer removeTemp(root)
+	err := MakeTinzeniteDir(root)
+	if err != nil {
+		t.Fatal("Failed test setup", err)
+	}
+	base := root + "/" + TINZENITEDIR
+	peer, _ := CreatePeer("name", "address", false)
+	(&ToxPeerDump{SelfPeer: peer}).StoreTo(base + "/" + LOCALDIR)
+	peer.StoreTo(base + "/" + ORGDIR + "/" + PEERSDIR)
+	peer.StoreTo(base + "/" + ORGDIR + "/" + PEERSDIR)
+	writeFile(FS, base+"/"+ORGDIR+"/"+AUTHJSON, []byte(`{"Secure":"x"}`), 0600)
+	tree, _ := CreateBuilder(root, "self").Build(context.Background())
+	data, _ := json.Marshal(tree)
+	writeFile(FS, root+"/"+STOREMODELDIR+"/"+MODELJSON, data, 0600)
+	findings, err := Validate(root, false)
+	if err != nil || len(findings) != 0 {
+		t.Error("Expected healthy directory, got", findings, err)
+	}
+	// damage the directory
+	os.RemoveAll(base + "/" + SENDINGDIR)
+	writeFile(FS, base+"/"+TINIGNORE, []byte("# empty"), 0640)
+	peerPath := base + "/" + ORGDIR + "/" + PEERSDIR + "/" + peer.Identification + ENDING
+	writeFile(FS, peerPath, []byte("{"), 0640)
+	os.Remove(base + "/" + LOCALDIR + "/" + SELFPEERJSON + BACKUPENDING)
+	writeFile(FS, base+"/"+LOCALDIR+"/"+SELFPEERJSON, []byte("{"), 0600)
+	os.Chmod(base+"/"+LOCALDIR, 0777)
+	os.Remove(base + "/" + LOCALDIR + "/" + LAYOUTJSON)
+	want := map[string]Severity{
+		TINZENITEDIR + "/" + SENDINGDIR:                   SvError,
+		TINZENITEDIR + "/" + TINIGNORE:                    SvWarning,
+		STORETOXDUMPDIR + "/" + LAYOUTJSON:                SvWarning,
+		STORETOXDUMPDIR + "/" + SELFPEERJSON:              SvError,
+		STOREPEERDIR + "/" + peer.Identification + ENDING: SvError,
+		STOREPEERDIR:    SvWarning,
+		STORETOXDUMPDIR: SvWarning}
+	findings, _ = Validate(root, false)
+	if len(findings) != len(want) {
+		t.Error("Expected", len(want), "findings, got", findings)
+	}
+	for _, finding := range findings {
+		if severity, exists := want[finding.Path]; !exists || severity != finding.Severity || finding.Repaired {
+			t.Error("Unexpected finding", finding)
+		}
+	}
+	// everything but the files without backup can be repaired, peers are
+	// synchronized and therefore never keep a backup
+	unrepairable := map[string]bool{
+		STORETOXDUMPDIR + "/" + SELFPEERJSON:              true,
+		STOREPEERDIR + "/" + peer.Identification + ENDING: true,
+		STOREPEERDIR: true}
+	findings, _ = Validate(root, true)
+	for _, finding := range findings {
+		if finding.Repaired == unrepairable[finding.Path] {
+			t.Error("Unexpected repair state of", finding)
+		}
+	}
+	findings, _ = Validate(root, false)
+	if len(findings) != len(unrepairable) {
+		t.Error("Expected only the unrepairable findings to be left, got", findings)
+	}
+	for _, finding := range findings {
+		if !unrepairable[finding.Path] {
+			t.Error("Unexpected finding", finding)
+		}
+	}
+	_, err = Validate(base+"/"+ORGDIR, false)
+	if err != ErrNotTinzenite {
+		t.Error("Expected", ErrNotTinzenite, "got", err)
+	}
+	// newer layouts are reported but never repaired
+	writeLayout(root, DkTinzenite, LayoutVersion(DkTinzenite)+1)
+	os.RemoveAll(base + "/" + SENDINGDIR)
+	_, err = Validate(root, true)
+	if err != ErrUnsupported {
+		t.Error("Expected", ErrUnsupported, "got", err)
+	}
+	if exists, _ := DirectoryExists(base + "/" + SENDINGDIR); exists {
+		t.Error("Expected nothing to be repaired")
+	}
+	findings, err = Validate(root, false)
+	if err != nil || len(findings) == 0 {
+		t.Error("Expected findings without repair, got", findings, err)
+	}
+}
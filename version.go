@@ -19,6 +19,20 @@ func CreateVersion() Version {
 	return Version{}
 }
 
+/*
+Copy returns an independent copy of the version.
+*/
+func (v Version) Copy() Version {
+	if v == nil {
+		return nil
+	}
+	version := make(Version, len(v))
+	for id, value := range v {
+		version[id] = value
+	}
+	return version
+}
+
 /*
 Increase the version for the given peer based on the already existing versions.
 */